@@ -2,18 +2,18 @@ package ex
 
 import (
 	"context"
-	"errors"
 	"io"
 
 	"github.com/rwool/ex/ex/internal/signal"
+	"github.com/rwool/ex/ex/internal/sshtarget"
 )
 
 // ErrNotRunning indicates a failure due to the command not running.
-var ErrNotRunning = errors.New("command not running")
+var ErrNotRunning = sshtarget.ErrNotRunning
 
 // ErrSignalUnsupported indicates that an attempt to use an unsupported
 // signal was made.
-var ErrSignalUnsupported = errors.New("unsupported signal")
+var ErrSignalUnsupported = sshtarget.ErrSignalUnsupported
 
 // Command represents the execution of a command.
 //
@@ -39,6 +39,9 @@ type Command interface {
 	SetEnv(vars map[string]string)
 
 	// Run runs the command and waits for it to finish.
+	//
+	// If the command exits unsuccessfully, the returned error wraps an
+	// *ExitError.
 	Run(ctx context.Context) (Recorder, error)
 
 	// Start begins execution of the command, but does not wait for it to
@@ -47,9 +50,17 @@ type Command interface {
 
 	// Wait waits for a command to finish that was previously started with
 	// Start.
+	//
+	// If the command exits unsuccessfully, the returned error wraps an
+	// *ExitError.
 	Wait() error
 }
 
+// ExitError indicates that a command exited unsuccessfully, or without
+// reporting how it exited. Its ExitStatus is also recorded by the Recorder of
+// the command.
+type ExitError = sshtarget.ExitError
+
 // WindowChanger wraps the functions to set/change the window dimensions.
 type WindowChanger interface {
 	// SetWindowChange sets a channel that can be received from to get terminal
@@ -63,6 +74,24 @@ type WindowChanger interface {
 	SetTerm(height, width int)
 }
 
+// InputRecorder wraps the function to record the input of a command.
+type InputRecorder interface {
+	// RecordInput records the input of the command along with its output.
+	//
+	// If redact is not nil, the input is recorded as it returns, which allows
+	// secrets, such as passwords, to be left out of the recording.
+	RecordInput(redact InputRedactor)
+}
+
+// RecordingSinkSetter wraps the function to set where the recording of a
+// command is stored.
+type RecordingSinkSetter interface {
+	// SetRecordingSink sets the sink that the output and the input of the
+	// command are recorded to, which keeps them in memory by default. It must
+	// be called before the command is run.
+	SetRecordingSink(sink RecordingSink)
+}
+
 // Signal is a representation of a real or virtual OS signal.
 type Signal = signal.Signal
 
@@ -70,6 +99,8 @@ type Signal = signal.Signal
 type Signaller interface {
 	// Signal sends a signal to the process.
 	// If the command is not running, ErrNotRunning will be returned.
+	// If the signal cannot be sent to the command, ErrSignalUnsupported will
+	// be returned.
 	Signal(Signal) error
 }
 
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"regexp"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -46,7 +47,6 @@ type Ex struct {
 	connections list.List
 	dialer      Dialer
 	logger      log.Logger
-	doneC       chan struct{}
 
 	stdOut io.Writer
 	stdErr io.Writer
@@ -54,9 +54,14 @@ type Ex struct {
 	nameToTargetsMu sync.RWMutex
 	nameToTargets   map[string]Target
 
+	// completedCommands are the recordings of the commands that have
+	// finished, in the order that they finished.
 	recordingsMu      sync.RWMutex
-	recorderC         chan *recorder.Recorder
 	completedCommands []*recorder.Recorder
+
+	// signalForwarder forwards signals to the running commands, if enabled
+	// with ForwardSignals.
+	signalForwarder *signalForwarder
 }
 
 // New creates a new Ex object for executing commands remotely.
@@ -77,36 +82,37 @@ func New(logger log.Logger, stdOut, stdErr io.Writer) *Ex {
 	}
 
 	r := &Ex{
-		doneC: make(chan struct{}),
-
 		logger: logger,
 		stdOut: stdOut,
 		stdErr: stdErr,
 
 		nameToTargets: make(map[string]Target),
-
-		recorderC: make(chan *recorder.Recorder),
 	}
 	r.SetDialer(&net.Dialer{})
 
-	go func() {
-		for {
-			select {
-			case rec := <-r.recorderC:
-				r.recordingsMu.Lock()
-				r.completedCommands = append(r.completedCommands, rec)
-				// TODO Sort the slice here.
-				r.recordingsMu.Unlock()
-			// TODO Add Close case.
-			case <-r.doneC:
-				return
-			}
-		}
-	}()
-
 	return r
 }
 
+// addCompleted adds the recording of a command that has finished.
+func (r *Ex) addCompleted(rec *recorder.Recorder) {
+	r.recordingsMu.Lock()
+	defer r.recordingsMu.Unlock()
+
+	r.completedCommands = append(r.completedCommands, rec)
+}
+
+// Search finds the matches of the regular expression in the recordings of the
+// commands that have finished, in the order that the commands finished.
+//
+// Commands that were started are included once Wait returns.
+func (r *Ex) Search(re *regexp.Regexp, opts *SearchOptions) ([]SearchMatch, error) {
+	r.recordingsMu.RLock()
+	recs := append([]*recorder.Recorder(nil), r.completedCommands...)
+	r.recordingsMu.RUnlock()
+
+	return recorder.Search(recs, re, opts)
+}
+
 // SetDialer sets the dialer that will be used for all connections to remote
 // systems.
 func (r *Ex) SetDialer(d Dialer) {
@@ -147,36 +153,136 @@ type SSHTargetConfig struct {
 	Auths []SSHAuthorizer
 	// HostKeyCallback is a function that is called to verify a host key.
 	HostKeyCallback SSHHostKeyCallback
+	// ForwardAgent is the agent that will be forwarded to the sessions of
+	// the target. Agent forwarding is disabled if this is nil.
+	ForwardAgent SSHAgent
+	// JumpHosts are the hosts that the connection to the target is made
+	// through, in order. The target is dialed directly if there are none.
+	JumpHosts []SSHJumpHost
 }
 
+// SSHJumpHost is an SSH server that the connection to a target is made
+// through, as with the ProxyJump option of ssh(1).
+//
+// Each jump host is authenticated, and has its host key verified, separately
+// from the target.
+type SSHJumpHost struct {
+	// Host is the host of the jump host, as resolved by the previous jump
+	// host, or by the dialer for the first jump host.
+	Host string
+	// Port is the port of the jump host.
+	Port uint16
+	// User is the name of the user to log in to the jump host as.
+	User string
+	// Auths is a list of the authorization methods for the jump host.
+	Auths []SSHAuthorizer
+	// HostKeyCallback is a function that is called to verify the host key of
+	// the jump host.
+	HostKeyCallback SSHHostKeyCallback
+}
+
+// SSHCommand is a command run with an SSH target.
+//
+// Signals sent to the command are delivered to the remote process.
 type SSHCommand struct {
 	*sshtarget.SSHSession
+
+	// completed is given the recording once the command finishes.
+	completed     func(*recorder.Recorder)
+	rec           *recorder.Recorder
+	completedOnce sync.Once
 }
 
+var (
+	_ CommandSignalWinCher = &SSHCommand{}
+	_ InputRecorder        = &SSHCommand{}
+	_ RecordingSinkSetter  = &SSHCommand{}
+)
+
 // Run runs the session and waits for it to complete.
 func (s *SSHCommand) Run(ctx context.Context) (Recorder, error) {
-	return s.SSHSession.Run(ctx)
+	rec, err := s.SSHSession.Run(ctx)
+	s.complete(rec)
+	return rec, err
 }
 
 // Start starts the session in a sesparate goroutine.
 //
 // The returned Recorder pointer should not be dereferenced until after Wait
-// completes.
+// completes, other than to subscribe to its events.
 func (s *SSHCommand) Start(ctx context.Context) (Recorder, error) {
-	return s.SSHSession.Start(ctx)
+	rec, err := s.SSHSession.Start(ctx)
+	s.rec = rec
+	return rec, err
+}
+
+// Wait waits for the session to complete after calling Start.
+func (s *SSHCommand) Wait() error {
+	err := s.SSHSession.Wait()
+	if s.rec != nil {
+		s.complete(s.rec)
+	}
+	return err
+}
+
+// complete reports the recording of the finished command, once.
+func (s *SSHCommand) complete(rec *recorder.Recorder) {
+	if s.completed == nil || rec == nil {
+		return
+	}
+	s.completedOnce.Do(func() { s.completed(rec) })
 }
 
 // SSHTarget adapts the internal SSHTarget to the Target interface.
 //
 // This is necessary due to Go not having covariance.
+//
+// SSHTarget is also a Dialer that connects through the SSH connection, so it
+// may be given to SetDialer to reach other targets through it.
 type SSHTarget struct {
 	*sshtarget.SSHTarget
+
+	// completed is given the recordings of the commands that finish.
+	completed func(*recorder.Recorder)
 }
 
+var _ Dialer = &SSHTarget{}
+
+// SSHForward is a port forward made through an SSH target with its
+// ForwardLocal, ForwardRemote or ForwardDynamic methods.
+type SSHForward = sshtarget.Forward
+
+// SSHSOCKSConfig contains the optional settings for the SOCKS5 proxy of a
+// dynamic forward made with the ForwardDynamic method of an SSH target.
+type SSHSOCKSConfig = sshtarget.SOCKSConfig
+
+// SSHSOCKSRule allows or denies the connections of a dynamic forward to
+// matching destinations.
+type SSHSOCKSRule = sshtarget.SOCKSRule
+
+// SSHTransferOptions contains the optional settings of the file transfers
+// made with the Upload and Download methods of an SSH target.
+type SSHTransferOptions = sshtarget.TransferOptions
+
+// SSHTransferProgress is the progress of copying a single file with the Upload
+// or Download methods of an SSH target.
+type SSHTransferProgress = sshtarget.TransferProgress
+
+// ErrSSHTargetClosed indicates that an SSH target was used after being closed.
+var ErrSSHTargetClosed = sshtarget.ErrNoSSHConnection
+
+// ErrSSHNetworkUnsupported indicates that an SSH target was asked to dial a
+// network other than TCP.
+var ErrSSHNetworkUnsupported = sshtarget.ErrUnsupportedNetwork
+
+// ErrSSHTransferUnsupported indicates that a file operation of an SSH target
+// is not supported because the SSH server has no SFTP subsystem.
+var ErrSSHTransferUnsupported = sshtarget.ErrTransferUnsupported
+
 // Command runs a command with the SSHTarget.
 func (s *SSHTarget) Command(cmd string, args ...string) Command {
 	t := s.SSHTarget.Command(cmd, args...)
-	return &SSHCommand{SSHSession: t}
+	return &SSHCommand{SSHSession: t, completed: s.completed}
 }
 
 // NewSSHTarget creates an SSH target to the given system.
@@ -187,33 +293,62 @@ func (r *Ex) NewSSHTarget(ctx context.Context, conf *SSHTargetConfig) (Target, e
 	if conf.HostKeyCallback == nil {
 		return nil, errors.New("no host key callback")
 	}
+	if len(conf.Auths) == 0 {
+		return nil, errors.New("no authorizers")
+	}
+	for i, hop := range conf.JumpHosts {
+		if hop.HostKeyCallback == nil {
+			return nil, errors.Errorf("no host key callback for jump host at index %d", i)
+		}
+		if len(hop.Auths) == 0 {
+			return nil, errors.Errorf("no authorizers for jump host at index %d", i)
+		}
+	}
 
 	if _, ok := r.nameToTargets[conf.Name]; ok {
 		return nil, errors.New("target already exists with the given name")
 	}
 
-	hkcOpt := sshtarget.HostKeyValidationOption(conf.HostKeyCallback)
+	opts := []sshtarget.Option{sshtarget.HostKeyValidationOption(conf.HostKeyCallback)}
+	if conf.ForwardAgent != nil {
+		opts = append(opts, sshtarget.AgentForwardingOption(conf.ForwardAgent))
+	}
+	if len(conf.JumpHosts) > 0 {
+		hops := make([]sshtarget.JumpHost, len(conf.JumpHosts))
+		for i, hop := range conf.JumpHosts {
+			hops[i] = sshtarget.JumpHost{
+				Host:            hop.Host,
+				Port:            hop.Port,
+				User:            hop.User,
+				Auths:           authConvert(hop.Auths),
+				HostKeyCallback: hop.HostKeyCallback,
+			}
+		}
+		opts = append(opts, sshtarget.JumpHostsOption(hops...))
+	}
 	target, err := sshtarget.New(ctx,
 		r.logger,
 		r.dialer,
 		conf.Host,
 		conf.Port,
-		[]sshtarget.Option{hkcOpt},
+		opts,
 		conf.User,
 		authConvert(conf.Auths))
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create SSH target")
 	}
 
-	t := &SSHTarget{SSHTarget: target}
+	t := &SSHTarget{SSHTarget: target, completed: r.addCompleted}
 	r.nameToTargets[conf.Name] = t
 	r.logger.Debugf("Added SSH target: %s", conf.Name)
 
 	return t, nil
 }
 
-// Close closes all currently open connections.
+// Close closes all currently open connections, and stops forwarding signals.
 func (r *Ex) Close() error {
+	r.StopForwardingSignals()
+
 	r.nameToTargetsMu.Lock()
 	defer r.nameToTargetsMu.Unlock()
 
@@ -237,6 +372,5 @@ func (r *Ex) Close() error {
 		}
 	}
 
-	close(r.doneC)
 	return nil
 }
@@ -3,7 +3,17 @@ package ex_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	errors2 "errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -21,6 +31,7 @@ import (
 
 	"github.com/rwool/ex/ex/internal/sshtarget"
 	"github.com/rwool/ex/log"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestEx(t *testing.T) {
@@ -64,6 +75,28 @@ func TestEx(t *testing.T) {
 
 	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output")
 	assert.Empty(t, stderr.String(), "unexpected data in stderr")
+	assert.Equal(t, &ex.ExitStatus{}, rec.ExitStatus(), "unexpected exit status")
+
+	saved := &bytes.Buffer{}
+	require.NoError(t, rec.Save(saved), "error saving recording")
+	loaded, err := ex.LoadRecording(saved)
+	require.NoError(t, err, "error loading recording")
+	stdout.Reset()
+	require.NoError(t, loaded.Replay(&stdout, &stderr, 0), "error replaying loaded recording")
+	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output of loaded recording")
+	assert.Equal(t, &ex.ExitStatus{}, loaded.ExitStatus(), "unexpected loaded exit status")
+
+	rec, err = target.Command("doesNotExist").Run(ctx)
+	var exitErr *ex.ExitError
+	require.True(t, errors2.As(err, &exitErr), "error must be an exit error: %+v", err)
+	assert.Equal(t, 127, exitErr.Code, "unexpected exit code")
+	assert.Equal(t, &ex.ExitStatus{Code: 127}, rec.ExitStatus(), "unexpected exit status")
+	stdout.Reset()
+	require.NoError(t, rec.ReplayWithOptions(ex.ReplayOptions{
+		Stdout:   &stdout,
+		Renderer: ex.NewPrefixRenderer(map[ex.RecordingSource]string{ex.RecordedStdout: "out: "}, false),
+	}), "error replaying recording")
+	assert.Equal(t, "out: -bash: doesNotExist: command not found\n", stdout.String(), "unexpected rendered output")
 
 	require.NoError(t, e.Close(), "unexpected error closing Ex")
 
@@ -106,3 +139,310 @@ func TestExFailedLogin(t *testing.T) {
 	assert.True(t, strings.Contains(errors.Cause(err).Error(), "ssh: handshake failed"),
 		"unexpected error from failing to authenticate")
 }
+
+func TestExHostKeyMismatch(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	dialer, _, stopServer := sshtarget.NewSSHServer(logger)
+	defer func() {
+		stopServer()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	if v, ok := dialer.(io.Closer); ok {
+		defer v.Close()
+	}
+
+	f, err := ioutil.TempFile("", "known_hosts")
+	require.NoError(t, err, "unable to create temporary file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "unable to generate key")
+	otherKey, err := ssh.NewPublicKey(priv.Public())
+	require.NoError(t, err, "unable to create public key")
+	require.NoError(t, ex.AddToKnownHosts(f, []string{"127.0.0.1:22"}, otherKey, false, ex.MarkerNone),
+		"unable to add host key")
+	hkc, err := ex.KnownHostsFilesCallback(f.Name())
+	require.NoError(t, err, "unable to create known_hosts callback")
+
+	e := ex.New(logger, nil, nil)
+	e.SetDialer(dialer)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	_, err = e.NewSSHTarget(ctx, &ex.SSHTargetConfig{
+		Name: "Server 1",
+		Host: "127.0.0.1",
+		Port: 22,
+		User: "test",
+		Auths: []ex.SSHAuthorizer{
+			ex.NewSSHPasswordAuth("Password123"),
+		},
+		HostKeyCallback: hkc,
+	})
+
+	defer func() {
+		require.NoError(t, e.Close(), "error closing Ex")
+		require.Empty(t, logBuf.String(), "unexpected log output")
+	}()
+	require.Error(t, err, "changed host key must be rejected")
+	assert.True(t, ex.IsKeyChange(err), "unexpected error for changed host key: %+v", err)
+	_, ok := errors.Cause(err).(*ex.SSHHostKeyError)
+	assert.True(t, ok, "error must be caused by a host key error")
+}
+
+func TestExJumpHost(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	targetDialer, targetKey, stopTarget := sshtarget.NewSSHServer(logger)
+	var requested []string
+	bastionDialer, bastionKey, stopBastion := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{
+		DirectTCPIP: func(host string, port uint32) (net.Conn, error) {
+			requested = append(requested, net.JoinHostPort(host, strconv.Itoa(int(port))))
+			return targetDialer.DialContext(context.Background(), "tcp", "127.0.0.1:22")
+		},
+	})
+	defer func() {
+		stopBastion()
+		stopTarget()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	for _, d := range []interface{}{bastionDialer, targetDialer} {
+		if v, ok := d.(io.Closer); ok {
+			defer v.Close()
+		}
+	}
+
+	e := ex.New(logger, nil, nil)
+	e.SetDialer(bastionDialer)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	target, err := e.NewSSHTarget(ctx, &ex.SSHTargetConfig{
+		Name: "Server 1",
+		Host: "10.0.0.5",
+		Port: 22,
+		User: "test",
+		Auths: []ex.SSHAuthorizer{
+			ex.NewSSHPasswordAuth("Password123"),
+		},
+		HostKeyCallback: sshtarget.FixedHostKey(targetKey),
+		JumpHosts: []ex.SSHJumpHost{{
+			Host: "bastion.example.com",
+			Port: 22,
+			User: "test",
+			Auths: []ex.SSHAuthorizer{
+				ex.NewSSHPasswordAuth("Password123"),
+			},
+			HostKeyCallback: sshtarget.FixedHostKey(bastionKey),
+		}},
+	})
+	require.NoError(t, err, "error creating target")
+
+	rec, err := target.Command("whoami").Run(ctx)
+	require.NoError(t, err, "error running whoami")
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, rec.Replay(&stdout, &stderr, 0), "error replaying recording")
+	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output")
+	assert.Equal(t, []string{"10.0.0.5:22"}, requested, "target must be dialed through the jump host")
+
+	require.NoError(t, e.Close(), "unexpected error closing Ex")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExSSHTargetDialer(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	targetDialer, targetKey, stopTarget := sshtarget.NewSSHServer(logger)
+	bastionDialer, bastionKey, stopBastion := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{
+		DirectTCPIP: func(host string, port uint32) (net.Conn, error) {
+			return targetDialer.DialContext(context.Background(), "tcp", "127.0.0.1:22")
+		},
+	})
+	defer func() {
+		stopBastion()
+		stopTarget()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	for _, d := range []interface{}{bastionDialer, targetDialer} {
+		if v, ok := d.(io.Closer); ok {
+			defer v.Close()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	newTarget := func(e *ex.Ex, host string, hostKey ssh.PublicKey) (ex.Target, error) {
+		return e.NewSSHTarget(ctx, &ex.SSHTargetConfig{
+			Name: host,
+			Host: host,
+			Port: 22,
+			User: "test",
+			Auths: []ex.SSHAuthorizer{
+				ex.NewSSHPasswordAuth("Password123"),
+			},
+			HostKeyCallback: sshtarget.FixedHostKey(hostKey),
+		})
+	}
+
+	e := ex.New(logger, nil, nil)
+	e.SetDialer(bastionDialer)
+	bastion, err := newTarget(e, "bastion.example.com", bastionKey)
+	require.NoError(t, err, "error creating bastion target")
+
+	dialer, ok := bastion.(ex.Dialer)
+	require.True(t, ok, "SSH target must be a dialer")
+	tunnelled := ex.New(logger, nil, nil)
+	tunnelled.SetDialer(dialer)
+	target, err := newTarget(tunnelled, "10.0.0.5", targetKey)
+	require.NoError(t, err, "error creating target through bastion")
+
+	rec, err := target.Command("whoami").Run(ctx)
+	require.NoError(t, err, "error running whoami")
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, rec.Replay(&stdout, &stderr, 0), "error replaying recording")
+	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output")
+
+	require.NoError(t, tunnelled.Close(), "unexpected error closing tunnelled Ex")
+	require.NoError(t, e.Close(), "unexpected error closing Ex")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExRecordInput(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	_, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := target.Command("cat")
+	ir, ok := cmd.(ex.InputRecorder)
+	require.True(t, ok, "SSH commands must support recording input")
+	ir.RecordInput(nil)
+	cmd.SetInput(strings.NewReader("hello\n"))
+	rec, err := cmd.Run(ctx)
+	require.NoError(t, err, "error running cat")
+
+	var stdout, input bytes.Buffer
+	require.NoError(t, rec.ReplayWithOptions(ex.ReplayOptions{Stdout: &stdout, Input: &input}),
+		"error replaying recording")
+	assert.Equal(t, "hello\n", stdout.String(), "unexpected stdout output")
+	assert.Equal(t, "hello\n", input.String(), "unexpected recorded input")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExRecordingSink(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "recording")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	_, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sink, err := ex.NewFileRecordingSink(filepath.Join(dir, "whoami.log"))
+	require.NoError(t, err, "unable to create sink")
+	defer sink.Close()
+	cmd := target.Command("whoami")
+	ss, ok := cmd.(ex.RecordingSinkSetter)
+	require.True(t, ok, "SSH commands must support recording sinks")
+	ss.SetRecordingSink(sink)
+	rec, err := cmd.Run(ctx)
+	require.NoError(t, err, "error running whoami")
+
+	var stdout bytes.Buffer
+	require.NoError(t, rec.Replay(&stdout, &stdout, 0), "error replaying recording")
+	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output")
+	var events []ex.RecordingEvent
+	require.NoError(t, sink.Events(func(e ex.RecordingEvent) error {
+		events = append(events, e)
+		return nil
+	}))
+	require.Len(t, events, 1, "output must be stored in the sink")
+	assert.Equal(t, ex.RecordedStdout, events[0].Source, "unexpected source")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExSubscribe(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	_, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	in, inWriter := io.Pipe()
+	cmd := target.Command("cat")
+	cmd.SetInput(in)
+	rec, err := cmd.Start(ctx)
+	require.NoError(t, err, "error starting cat")
+	sub, err := rec.Subscribe(false)
+	require.NoError(t, err, "unable to subscribe")
+	defer sub.Close()
+
+	_, err = inWriter.Write([]byte("live\n"))
+	require.NoError(t, err, "unable to write input")
+	e, err := sub.Next(ctx)
+	require.NoError(t, err, "error following output")
+	assert.Equal(t, ex.RecordedStdout, e.Source, "unexpected source")
+	assert.Equal(t, "live\n", string(e.Data), "unexpected live output")
+
+	inWriter.Close()
+	require.NoError(t, cmd.Wait(), "error waiting for cat")
+	_, err = sub.Next(ctx)
+	assert.Equal(t, io.EOF, err, "subscription must end with the command")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExSearch(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	e, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := target.Command("whoami").Run(ctx)
+	require.NoError(t, err, "error running whoami")
+	_, err = target.Command("doesNotExist").Run(ctx)
+	require.Error(t, err, "missing command must fail")
+
+	cmd := target.Command("cat")
+	cmd.SetInput(strings.NewReader("permission denied\n"))
+	_, err = cmd.Start(ctx)
+	require.NoError(t, err, "error starting cat")
+	require.NoError(t, cmd.Wait(), "error waiting for cat")
+
+	matches, err := e.Search(regexp.MustCompile(`command not found|permission denied`), &ex.SearchOptions{Context: 1})
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 2, "unexpected number of matches")
+	assert.Equal(t, "doesNotExist", matches[0].Recorder.Command(), "match must be from the failed command")
+	assert.Equal(t, ex.RecordedStdout, matches[0].Source, "unexpected source")
+	assert.Equal(t, "-bash: doesNotExist: command not found", matches[0].Text, "unexpected line")
+	assert.Equal(t, "cat", matches[1].Recorder.Command(), "started commands must be searched once waited on")
+
+	var recs []ex.Recorder
+	for _, m := range matches {
+		recs = append(recs, m.Recorder)
+	}
+	matches, err = ex.SearchRecordings(recs, regexp.MustCompile(regexp.QuoteMeta("doesNotExist")), nil)
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 1, "unexpected number of matches")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
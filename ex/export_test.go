@@ -0,0 +1,19 @@
+package ex
+
+// Exported for testing.
+
+// SetUnhandledSignalFunc sets the function called for forwarded signals that
+// no command is sent, returning a function that restores the previous one.
+func SetUnhandledSignalFunc(f func(Signal) error) (restore func()) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	prev := relay.unhandled
+	relay.unhandled = f
+	return func() {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+
+		relay.unhandled = prev
+	}
+}
@@ -0,0 +1,231 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Default dimensions of the terminal in asciicasts of commands that were not
+// run in a terminal.
+const (
+	defaultAsciicastWidth  = 80
+	defaultAsciicastHeight = 24
+)
+
+// asciicastHeader is the header line of an asciicast v2 file.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastEvent is an event of an asciicast.
+type asciicastEvent struct {
+	offset    time.Duration
+	eventType string
+	data      string
+}
+
+// MarshalJSON marshals the event as an array of its time in seconds, its type
+// and its data.
+func (ae asciicastEvent) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(ae.data)
+	if err != nil {
+		return nil, err
+	}
+	seconds := strconv.FormatFloat(ae.offset.Seconds(), 'f', 6, 64)
+	return []byte(fmt.Sprintf("[%s, %q, %s]", seconds, ae.eventType, data)), nil
+}
+
+// WriteAsciicast writes the recording as an asciicast v2 file, which can be
+// played with asciinema players.
+//
+// The output of both streams is written as output events, as asciicasts do not
+// distinguish between them, and recorded input is written as input events. The
+// size of the terminal is given in the header,
+// with changes to it written as resize events. Commands that were not run in a
+// terminal are given a size of 80x24.
+func (r *Recorder) WriteAsciicast(w io.Writer) error {
+	r.stateMu.Lock()
+	header := asciicastHeader{
+		Version: 2,
+		Width:   r.termSize.Width,
+		Height:  r.termSize.Height,
+		Command: strings.Join(append([]string{r.cmd}, r.args...), " "),
+	}
+	if !r.recordingStart.IsZero() {
+		header.Timestamp = r.recordingStart.Unix()
+	}
+	if header.Width <= 0 || header.Height <= 0 {
+		header.Width, header.Height = defaultAsciicastWidth, defaultAsciicastHeight
+	}
+	if r.term != "" {
+		header.Env = map[string]string{"TERM": r.term}
+	}
+	if shell, ok := r.env["SHELL"]; ok {
+		if header.Env == nil {
+			header.Env = map[string]string{}
+		}
+		header.Env["SHELL"] = shell
+	}
+	var events []asciicastEvent
+	for _, e := range r.resizes {
+		events = append(events, asciicastEvent{
+			offset:    e.timeOffset,
+			eventType: "r",
+			data:      fmt.Sprintf("%dx%d", e.size.Width, e.size.Height),
+		})
+	}
+	r.stateMu.Unlock()
+
+	// Characters may be split across writes, so incomplete characters at the
+	// end of the output or input are held back until the next output or input.
+	pending := map[string][]byte{}
+	lastOffset := map[string]time.Duration{}
+	err := r.Sink().Events(func(e Event) error {
+		eventType := "o"
+		if e.Source == Stdin {
+			eventType = "i"
+		}
+		data := append(pending[eventType], e.Data...)
+		complete := completeUTF8(data)
+		pending[eventType] = append([]byte(nil), data[complete:]...)
+		lastOffset[eventType] = e.Offset
+		if complete == 0 {
+			return nil
+		}
+		events = append(events, asciicastEvent{
+			offset:    e.Offset,
+			eventType: eventType,
+			data:      string(data[:complete]),
+		})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to write asciicast")
+	}
+	for _, eventType := range []string{"o", "i"} {
+		if len(pending[eventType]) > 0 {
+			events = append(events, asciicastEvent{
+				offset:    lastOffset[eventType],
+				eventType: eventType,
+				data:      string(pending[eventType]),
+			})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].offset < events[j].offset })
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header); err != nil {
+		return errors.Wrap(err, "unable to write asciicast header")
+	}
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return errors.Wrap(err, "unable to write asciicast event")
+		}
+	}
+	return nil
+}
+
+// completeUTF8 returns the length of the given data without an incomplete
+// UTF-8 encoded character at its end.
+func completeUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if utf8.FullRune(data[i:]) {
+			return len(data)
+		}
+		return i
+	}
+	return len(data)
+}
+
+// ReadAsciicast reads an asciicast v2 file as a recording, which can then be
+// replayed. Its output is kept in memory.
+//
+// Output events are recorded as the output of stdout, input events as the
+// input of the command, and resize events as changes of the terminal size.
+// Other events, such as markers, are ignored.
+func ReadAsciicast(r io.Reader) (*Recorder, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*1024*1024)
+
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, errors.Wrap(err, "unable to read asciicast header")
+		}
+		return nil, errors.New("empty asciicast")
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(s.Bytes(), &header); err != nil {
+		return nil, errors.Wrap(err, "unable to parse asciicast header")
+	}
+	if header.Version != 2 {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "unable to read asciicast version %d", header.Version)
+	}
+
+	rec := NewRecorder()
+	rec.cmd = header.Command
+	rec.term = header.Env["TERM"]
+	rec.termSize = TermSize{Height: header.Height, Width: header.Width}
+	if header.Timestamp != 0 {
+		rec.recordingStart = time.Unix(header.Timestamp, 0)
+	}
+	if shell, ok := header.Env["SHELL"]; ok {
+		rec.env = map[string]string{"SHELL": shell}
+	}
+
+	for line := 2; s.Scan(); line++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(s.Bytes(), &event); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse asciicast event on line %d", line)
+		}
+		if len(event) != 3 {
+			return nil, errors.Errorf("invalid asciicast event on line %d", line)
+		}
+		seconds, ok1 := event[0].(float64)
+		eventType, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 || seconds < 0 {
+			return nil, errors.Errorf("invalid asciicast event on line %d", line)
+		}
+		offset := time.Duration(math.Round(seconds * float64(time.Second)))
+
+		switch eventType {
+		case "o":
+			rec.sink.Append(Event{Offset: offset, Source: Stdout, Data: []byte(data)})
+		case "i":
+			rec.sink.Append(Event{Offset: offset, Source: Stdin, Data: []byte(data)})
+		case "r":
+			var size TermSize
+			if _, err := fmt.Sscanf(data, "%dx%d", &size.Width, &size.Height); err != nil {
+				return nil, errors.Errorf("invalid asciicast resize on line %d", line)
+			}
+			rec.resizes = append(rec.resizes, resizeEvent{timeOffset: offset, size: size})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read asciicast")
+	}
+	rec.Finish()
+	return rec, nil
+}
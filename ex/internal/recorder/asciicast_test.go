@@ -0,0 +1,138 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderWriteAsciicast(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	rec.SetCommand("top", "-b")
+	rec.SetEnv(map[string]string{"SHELL": "/bin/bash", "LANG": "C"})
+	rec.SetTerm("xterm", 24, 80)
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+
+	// The euro sign is split across two writes.
+	euro := []byte("€")
+	stdoutWriter.Write(append([]byte("price: "), euro[:1]...))
+	time.Sleep(10 * time.Millisecond)
+	stderrWriter.Write(append(euro[1:], '\n'))
+	rec.AddResize(40, 120)
+	stdoutWriter.Write([]byte("done\r\n"))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.WriteAsciicast(buf), "unable to write asciicast")
+
+	s := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	require.True(t, s.Scan(), "missing header")
+	var header map[string]interface{}
+	require.NoError(t, json.Unmarshal(s.Bytes(), &header), "header must be JSON")
+	assert.EqualValues(t, 2, header["version"])
+	assert.EqualValues(t, 80, header["width"])
+	assert.EqualValues(t, 24, header["height"])
+	assert.EqualValues(t, rec.recordingStart.Unix(), header["timestamp"])
+	assert.Equal(t, "top -b", header["command"])
+	assert.Equal(t, map[string]interface{}{"TERM": "xterm", "SHELL": "/bin/bash"}, header["env"])
+
+	var events [][]interface{}
+	for s.Scan() {
+		var event []interface{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &event), "event must be JSON: %s", s.Text())
+		events = append(events, event)
+	}
+	require.Len(t, events, 4, "unexpected number of events")
+	assert.Equal(t, []interface{}{"o", "price: "}, events[0][1:])
+	assert.Equal(t, []interface{}{"o", "€\n"}, events[1][1:])
+	assert.Equal(t, []interface{}{"r", "120x40"}, events[2][1:])
+	assert.Equal(t, []interface{}{"o", "done\r\n"}, events[3][1:])
+	var last float64
+	for _, e := range events {
+		assert.True(t, e[0].(float64) >= last, "events must be in order")
+		last = e[0].(float64)
+	}
+	assert.True(t, events[1][0].(float64) >= 0.01, "offset must be in seconds")
+
+	loaded, err := ReadAsciicast(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err, "unable to read asciicast")
+	assert.Equal(t, "top -b", loaded.Command())
+	term, size := loaded.Term()
+	assert.Equal(t, "xterm", term)
+	assert.Equal(t, TermSize{Height: 24, Width: 80}, size)
+	require.Len(t, loaded.resizes, 1, "unexpected number of resizes")
+	assert.Equal(t, TermSize{Height: 40, Width: 120}, loaded.resizes[0].size)
+	assert.InDelta(t, rec.resizes[0].timeOffset, loaded.resizes[0].timeOffset, float64(time.Microsecond))
+	replayed := &bytes.Buffer{}
+	require.NoError(t, loaded.Replay(replayed, replayed, 0))
+	assert.Equal(t, "price: €\ndone\r\n", replayed.String(), "unexpected replayed output")
+
+	// Writing the read asciicast must give the same result.
+	rewritten := &bytes.Buffer{}
+	require.NoError(t, loaded.WriteAsciicast(rewritten))
+	assert.Equal(t, buf.String(), rewritten.String(), "asciicast changed by reading")
+}
+
+func TestRecorderWriteAsciicastNoTerm(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	rec.SetCommand("whoami")
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.WriteAsciicast(buf))
+	assert.Equal(t, `{"version":2,"width":80,"height":24,"command":"whoami"}`+"\n", buf.String())
+}
+
+func TestReadAsciicastInvalid(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	_, err := ReadAsciicast(strings.NewReader(`{"version": 1, "width": 80, "height": 24}`))
+	assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err), "version 1 must not be read")
+	_, err = ReadAsciicast(strings.NewReader(""))
+	assert.Error(t, err, "empty asciicast must not be read")
+	_, err = ReadAsciicast(strings.NewReader("{\"version\": 2}\n[1.0, \"o\"]\n"))
+	assert.Error(t, err, "short event must not be read")
+	_, err = ReadAsciicast(strings.NewReader("{\"version\": 2}\n[1.0, \"r\", \"wide\"]\n"))
+	assert.Error(t, err, "invalid resize must not be read")
+
+	rec, err := ReadAsciicast(strings.NewReader("{\"version\": 2}\n[0.5, \"m\", \"\"]\n[1.25, \"o\", \"hi\"]\n"))
+	require.NoError(t, err, "marker events must be ignored")
+	events := recordedEvents(t, rec)
+	require.Len(t, events, 1)
+	assert.Equal(t, 1250*time.Millisecond, events[0].Offset)
+}
+
+func TestRecorderAsciicastInput(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec, err := ReadAsciicast(strings.NewReader("{\"version\": 2, \"width\": 80, \"height\": 24}\n" +
+		"[0.5, \"i\", \"ls\\r\"]\n[1.25, \"o\", \"hi\"]\n"))
+	require.NoError(t, err, "unable to read asciicast")
+	events := recordedEvents(t, rec)
+	require.Len(t, events, 2)
+	assert.Equal(t, Stdin, events[0].Source, "input must be recorded as input")
+	assert.Equal(t, "ls\r", string(events[0].Data))
+
+	out, in := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, rec.ReplayWithOptions(ReplayOptions{Stdout: out, Input: in}))
+	assert.Equal(t, "hi", out.String(), "unexpected replayed output")
+	assert.Equal(t, "ls\r", in.String(), "unexpected replayed input")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.WriteAsciicast(buf), "unable to write asciicast")
+	assert.Equal(t, `{"version":2,"width":80,"height":24}`+"\n"+
+		`[0.500000,"i","ls\r"]`+"\n"+
+		`[1.250000,"o","hi"]`+"\n", buf.String())
+}
@@ -0,0 +1,235 @@
+package recorder
+
+import (
+	"encoding/json"
+	errors2 "errors"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FormatVersion is the version of the format that recordings are saved in.
+//
+// Recordings are saved as a single JSON object:
+//
+//	{
+//	  "version": 1,
+//	  "command": "ls",
+//	  "args": ["-l"],
+//	  "env": {"LANG": "C"},
+//	  "start": "2018-06-01T12:00:00.123456789Z",
+//	  "term": {"name": "xterm", "height": 24, "width": 80},
+//	  "output": [
+//	    {"offset": 1500000, "stream": "stdout", "data": "dG90YWwgMAo="}
+//	  ],
+//	  "resizes": [
+//	    {"offset": 2000000, "height": 40, "width": 120}
+//	  ],
+//	  "specialEvents": [
+//	    {"type": "Escape", "timestamp": "2018-06-01T12:00:01Z", "details": "~."}
+//	  ],
+//	  "exitStatus": {"code": 0, "signal": "", "coreDumped": false, "message": ""}
+//	}
+//
+// The offsets of the output and of the changes of the terminal size are the
+// nanoseconds since the start, and the data is base64 encoded. The output of
+// both streams is interleaved in the order it was written, along with the
+// input of the command in the "stdin" stream if it was recorded. The terminal is
+// null if the command was not run in one, and the exit status is null if the
+// command did not exit.
+//
+// The version is incremented for changes that older versions of this package
+// cannot read.
+const FormatVersion = 1
+
+// ErrUnsupportedVersion indicates that a recording was saved with a version of
+// the format that is not supported.
+var ErrUnsupportedVersion = errors2.New("unsupported recording format version")
+
+// savedRecording is a recording in the saved format.
+type savedRecording struct {
+	Version       int                 `json:"version"`
+	Command       string              `json:"command"`
+	Args          []string            `json:"args"`
+	Env           map[string]string   `json:"env"`
+	Start         time.Time           `json:"start"`
+	Term          *savedTerm          `json:"term"`
+	Output        []savedOutput       `json:"output"`
+	Resizes       []savedResize       `json:"resizes"`
+	SpecialEvents []savedSpecialEvent `json:"specialEvents"`
+	ExitStatus    *savedExitStatus    `json:"exitStatus"`
+}
+
+type savedTerm struct {
+	Name   string `json:"name"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
+
+type savedResize struct {
+	Offset time.Duration `json:"offset"`
+	Height int           `json:"height"`
+	Width  int           `json:"width"`
+}
+
+type savedOutput struct {
+	Offset time.Duration `json:"offset"`
+	Stream string        `json:"stream"`
+	Data   []byte        `json:"data"`
+}
+
+type savedSpecialEvent struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Details   interface{} `json:"details"`
+}
+
+type savedExitStatus struct {
+	Code       int    `json:"code"`
+	Signal     string `json:"signal"`
+	CoreDumped bool   `json:"coreDumped"`
+	Message    string `json:"message"`
+}
+
+// Names of the output streams in the saved format.
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+	stdinStream  = "stdin"
+)
+
+// Save writes the recording to the given writer, in the format described by
+// FormatVersion.
+//
+// The details of special events are saved as JSON, so they must be able to be
+// marshalled with encoding/json.
+func (r *Recorder) Save(w io.Writer) error {
+	r.stateMu.Lock()
+	sr := savedRecording{
+		Version: FormatVersion,
+		Command: r.cmd,
+		Args:    r.args,
+		Env:     r.env,
+		Start:   r.recordingStart,
+	}
+	if r.term != "" {
+		sr.Term = &savedTerm{
+			Name:   r.term,
+			Height: r.termSize.Height,
+			Width:  r.termSize.Width,
+		}
+	}
+	sr.Resizes = make([]savedResize, len(r.resizes))
+	for i, e := range r.resizes {
+		sr.Resizes[i] = savedResize{
+			Offset: e.timeOffset,
+			Height: e.size.Height,
+			Width:  e.size.Width,
+		}
+	}
+	if r.exitStatus != nil {
+		sr.ExitStatus = &savedExitStatus{
+			Code:       r.exitStatus.Code,
+			Signal:     r.exitStatus.Signal,
+			CoreDumped: r.exitStatus.CoreDumped,
+			Message:    r.exitStatus.Message,
+		}
+	}
+	r.stateMu.Unlock()
+
+	sr.Output = []savedOutput{}
+	err := r.Sink().Events(func(e Event) error {
+		sr.Output = append(sr.Output, savedOutput{
+			Offset: e.Offset,
+			Stream: e.Source.String(),
+			Data:   e.Data,
+		})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to save recording")
+	}
+
+	r.eventsMu.Lock()
+	sr.SpecialEvents = make([]savedSpecialEvent, len(r.events))
+	for i, e := range r.events {
+		sr.SpecialEvents[i] = savedSpecialEvent{
+			Type:      e.EventType,
+			Timestamp: e.Timestamp,
+			Details:   e.Details,
+		}
+	}
+	r.eventsMu.Unlock()
+
+	return errors.Wrap(json.NewEncoder(w).Encode(&sr), "unable to save recording")
+}
+
+// Load reads a recording that was written with Save. The recording can be
+// replayed, but not recorded to. Its output is kept in memory.
+//
+// The details of special events are decoded as the generic types of
+// encoding/json, such as map[string]interface{} for structs.
+func Load(r io.Reader) (*Recorder, error) {
+	var sr savedRecording
+	if err := json.NewDecoder(r).Decode(&sr); err != nil {
+		return nil, errors.Wrap(err, "unable to load recording")
+	}
+	if sr.Version < 1 || sr.Version > FormatVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "unable to load recording with version %d", sr.Version)
+	}
+
+	rec := NewRecorder()
+	rec.cmd = sr.Command
+	rec.args = sr.Args
+	rec.env = sr.Env
+	rec.recordingStart = sr.Start
+	if sr.Term != nil {
+		rec.term = sr.Term.Name
+		rec.termSize = TermSize{Height: sr.Term.Height, Width: sr.Term.Width}
+	}
+	for _, e := range sr.Resizes {
+		rec.resizes = append(rec.resizes, resizeEvent{
+			timeOffset: e.Offset,
+			size:       TermSize{Height: e.Height, Width: e.Width},
+		})
+	}
+	if sr.ExitStatus != nil {
+		rec.exitStatus = &ExitStatus{
+			Code:       sr.ExitStatus.Code,
+			Signal:     sr.ExitStatus.Signal,
+			CoreDumped: sr.ExitStatus.CoreDumped,
+			Message:    sr.ExitStatus.Message,
+		}
+	}
+
+	for _, o := range sr.Output {
+		var source Source
+		switch o.Stream {
+		case stdoutStream:
+			source = Stdout
+		case stderrStream:
+			source = Stderr
+		case stdinStream:
+			source = Stdin
+		default:
+			return nil, errors.Errorf("unable to load recording with output stream %q", o.Stream)
+		}
+		rec.sink.Append(Event{
+			Offset: o.Offset,
+			Source: source,
+			Data:   o.Data,
+		})
+	}
+
+	for _, e := range sr.SpecialEvents {
+		rec.events = append(rec.events, SpecialEvent{
+			EventType: e.Type,
+			Timestamp: e.Timestamp,
+			Details:   e.Details,
+		})
+	}
+
+	rec.Finish()
+	return rec, nil
+}
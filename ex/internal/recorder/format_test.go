@@ -0,0 +1,91 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderSaveLoad(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	rec.SetCommand("ls", "-l", "/tmp")
+	rec.SetEnv(map[string]string{"LANG": "C"})
+	rec.SetTerm("xterm", 24, 80)
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+	stdoutWriter.Write([]byte("out\x00\xff"))
+	time.Sleep(20 * time.Millisecond)
+	rec.AddResize(40, 120)
+	stderrWriter.Write([]byte("err\n"))
+	_, err := ioutil.ReadAll(rec.RecordInput(strings.NewReader("input\n"), nil))
+	require.NoError(t, err, "unable to read input")
+	stdoutWriter.Write([]byte("more\n"))
+	rec.AddSpecialEvent(EscapeEvent, "~.")
+	rec.SetExitStatus(ExitStatus{Code: 143, Signal: "TERM", Message: "killed"})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.Save(buf), "unable to save recording")
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &raw), "saved recording must be JSON")
+	assert.EqualValues(t, FormatVersion, raw["version"], "unexpected version")
+
+	loaded, err := Load(buf)
+	require.NoError(t, err, "unable to load recording")
+	assert.Equal(t, rec.Command(), loaded.Command(), "unexpected command")
+	assert.Equal(t, rec.Env(), loaded.Env(), "unexpected environment")
+	assert.True(t, rec.recordingStart.Equal(loaded.recordingStart), "unexpected start time")
+	assert.Equal(t, rec.ExitStatus(), loaded.ExitStatus(), "unexpected exit status")
+	term, size := loaded.Term()
+	assert.Equal(t, "xterm", term, "unexpected terminal")
+	assert.Equal(t, TermSize{Height: 24, Width: 80}, size, "unexpected terminal size")
+	assert.Equal(t, rec.resizes, loaded.resizes, "unexpected resizes")
+
+	recorded, loadedEvents := recordedEvents(t, rec), recordedEvents(t, loaded)
+	require.Len(t, loadedEvents, len(recorded), "unexpected number of output events")
+	assert.Equal(t, Stdin, loadedEvents[2].Source, "input must be loaded as input")
+	assert.Equal(t, recorded, loadedEvents, "unexpected output events")
+
+	events := loaded.GetSpecialEvents()
+	require.Len(t, events, 1, "unexpected number of special events")
+	assert.Equal(t, EscapeEvent, events[0].EventType)
+	assert.Equal(t, "~.", events[0].Details)
+	assert.True(t, rec.GetSpecialEvents()[0].Timestamp.Equal(events[0].Timestamp), "unexpected event time")
+
+	var origOut, origErr, loadedOut, loadedErr bytes.Buffer
+	require.NoError(t, rec.Replay(&origOut, &origErr, 0))
+	require.NoError(t, loaded.Replay(&loadedOut, &loadedErr, 0))
+	assert.Equal(t, origOut.String(), loadedOut.String(), "unexpected replayed stdout")
+	assert.Equal(t, origErr.String(), loadedErr.String(), "unexpected replayed stderr")
+
+	// Saving the loaded recording must give the same result.
+	resaved := &bytes.Buffer{}
+	require.NoError(t, loaded.Save(resaved), "unable to save loaded recording")
+	buf.Reset()
+	require.NoError(t, rec.Save(buf))
+	assert.JSONEq(t, buf.String(), resaved.String(), "recording changed by loading")
+}
+
+func TestRecorderLoadInvalid(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	_, err := Load(strings.NewReader(`{"version": 2}`))
+	assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err), "newer version must not be loaded")
+	_, err = Load(strings.NewReader(`{}`))
+	assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err), "missing version must not be loaded")
+	_, err = Load(strings.NewReader(`{"version": 1, "output": [{"stream": "stdio"}]}`))
+	assert.Error(t, err, "unknown stream must not be loaded")
+	_, err = Load(strings.NewReader(`{"version": 1`))
+	assert.Error(t, err, "truncated recording must not be loaded")
+}
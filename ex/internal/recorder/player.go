@@ -0,0 +1,369 @@
+package recorder
+
+import (
+	"context"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PlayerOptions contains the settings of a Player.
+type PlayerOptions struct {
+	// ReplayOptions are the outputs that the recording is played to, and the
+	// initial speed multiplier.
+	ReplayOptions
+	// MaxIdle, if greater than 0, is the longest pause between events that is
+	// kept. Longer pauses are shortened to it, and the offsets of the player
+	// are those of the shortened recording.
+	MaxIdle time.Duration
+}
+
+// playerItem is an event or a change of the terminal size to be played.
+type playerItem struct {
+	offset time.Duration
+	event  Event
+	resize *TermSize
+}
+
+// Player plays a recording interactively. Playback can be paused, moved to a
+// different offset, have its speed changed or be stepped through one event at
+// a time.
+//
+// The methods of a Player may be called concurrently, such as pausing from a
+// different goroutine than the one that is playing.
+type Player struct {
+	opts  ReplayOptions
+	items []playerItem
+
+	// writeMu is held while items are written, so that they are written in
+	// order. It is locked before mu, and mu is not held while writing, so
+	// that a blocked writer does not block the other methods.
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// changed is closed and replaced when playback is changed.
+	changed chan struct{}
+	// next is the index of the next item to be played.
+	next int
+	// pos is the position of playback at the time at, which is only advanced
+	// by the clock while playing.
+	pos     time.Duration
+	at      time.Time
+	playing bool
+	// run identifies the current call to Play.
+	run   int
+	speed float64
+}
+
+// NewPlayer creates a player for the recording. The events of the recording
+// are read into memory, so that playback can be moved to any offset.
+//
+// Events of streams that have no writer are not played, so stepping only
+// moves between the events that are written. ErrInvalidMultiplier is returned
+// for speed multipliers less than 0.
+func (r *Recorder) NewPlayer(opts PlayerOptions) (*Player, error) {
+	if !validSpeed(opts.Speed) {
+		return nil, ErrInvalidMultiplier
+	}
+
+	r.stateMu.Lock()
+	term, termSize := r.term, r.termSize
+	resizes := r.resizes
+	r.stateMu.Unlock()
+
+	var items []playerItem
+	if opts.Resize != nil {
+		if term != "" {
+			size := termSize
+			items = append(items, playerItem{resize: &size})
+		}
+		for i := range resizes {
+			items = append(items, playerItem{
+				offset: resizes[i].timeOffset,
+				resize: &resizes[i].size,
+			})
+		}
+	}
+	err := r.Sink().Events(func(e Event) error {
+		if opts.writer(e.Source) != nil {
+			items = append(items, playerItem{offset: e.Offset, event: e})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read recorded events")
+	}
+	// The changes of the terminal size come first, so they are played before
+	// any events at the same offset.
+	sort.SliceStable(items, func(i, j int) bool { return items[i].offset < items[j].offset })
+
+	if opts.MaxIdle > 0 {
+		var last, removed time.Duration
+		for i := range items {
+			if gap := items[i].offset - last; gap > opts.MaxIdle {
+				removed += gap - opts.MaxIdle
+			}
+			last = items[i].offset
+			items[i].offset -= removed
+		}
+	}
+
+	return &Player{
+		opts:    opts.ReplayOptions,
+		items:   items,
+		changed: make(chan struct{}),
+		speed:   opts.Speed,
+	}, nil
+}
+
+// validSpeed reports whether the speed multiplier can be used for replaying.
+func validSpeed(sm float64) bool {
+	return sm >= 0 && !math.IsInf(sm, 0) && !math.IsNaN(sm)
+}
+
+// Duration gets the offset of the last event of the player.
+func (p *Player) Duration() time.Duration {
+	if len(p.items) == 0 {
+		return 0
+	}
+	return p.items[len(p.items)-1].offset
+}
+
+// Position gets the current offset of playback.
+func (p *Player) Position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.position()
+}
+
+// position gets the current offset of playback. mu must be held.
+func (p *Player) position() time.Duration {
+	pos := p.pos
+	if p.playing && p.speed > 0 {
+		pos += time.Duration(float64(time.Since(p.at)) * p.speed)
+	}
+	// Playback does not move past events that have not been played, or past
+	// the end.
+	limit := p.Duration()
+	if p.next < len(p.items) {
+		limit = p.items[p.next].offset
+	}
+	if pos > limit {
+		pos = limit
+	}
+	return pos
+}
+
+// setPosition sets the current offset of playback. mu must be held.
+func (p *Player) setPosition(pos time.Duration) {
+	p.pos = pos
+	p.at = time.Now()
+}
+
+// notify wakes Play to reconsider playback. mu must be held.
+func (p *Player) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Done reports whether every event has been played.
+func (p *Player) Done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.next >= len(p.items)
+}
+
+// Play plays the recording from the current position. It returns once every
+// event has been played, when playback is paused or when the context is done.
+// Play can be called again to resume playback.
+func (p *Player) Play(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing {
+		return errors.New("already playing")
+	}
+	p.playing = true
+	p.run++
+	run := p.run
+	p.setPosition(p.pos)
+	defer func() {
+		if p.run == run && p.playing {
+			p.setPosition(p.position())
+			p.playing = false
+			p.notify()
+		}
+	}()
+
+	for p.next < len(p.items) {
+		if wait := p.wait(); wait > 0 {
+			changed := p.changed
+			p.mu.Unlock()
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-changed:
+			case <-ctx.Done():
+			}
+			t.Stop()
+			p.mu.Lock()
+
+			if p.run != run || !p.playing {
+				// Paused.
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// The position, speed or clock may have changed.
+			continue
+		}
+
+		p.mu.Unlock()
+		p.writeMu.Lock()
+		p.mu.Lock()
+		if p.run != run || !p.playing {
+			// Paused while waiting for another write.
+			p.writeMu.Unlock()
+			return nil
+		}
+		if p.next >= len(p.items) || p.wait() > 0 {
+			// Moved while waiting for another write.
+			p.writeMu.Unlock()
+			continue
+		}
+		if err := p.play(); err != nil {
+			return err
+		}
+		if p.run != run || !p.playing {
+			// Paused while writing.
+			return nil
+		}
+	}
+	return nil
+}
+
+// wait gets how long it is until the next item is to be played. mu must be
+// held, and there must be an item left to play.
+func (p *Player) wait() time.Duration {
+	if p.speed == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.items[p.next].offset-p.position()) / p.speed)
+}
+
+// play plays the next item and moves playback past it. writeMu and mu must be
+// held. mu is released while the item is written, and writeMu is released
+// once it has been written.
+func (p *Player) play() error {
+	item := p.items[p.next]
+	p.next++
+	if p.position() < item.offset {
+		p.setPosition(item.offset)
+	}
+
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	defer p.writeMu.Unlock()
+
+	if item.resize != nil {
+		p.opts.Resize(*item.resize)
+		return nil
+	}
+	return p.opts.write(item.event)
+}
+
+// Pause pauses playback, causing Play to return.
+func (p *Player) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pause()
+}
+
+// pause pauses playback. mu must be held.
+func (p *Player) pause() {
+	if !p.playing {
+		return
+	}
+	p.setPosition(p.position())
+	p.playing = false
+	p.notify()
+}
+
+// Seek moves playback to the given offset, which is limited to the duration.
+// Events before the offset are not written, and events at or after it are
+// played next.
+//
+// The terminal size in effect at the offset is given to the Resize function,
+// once any event that is being written has been written.
+func (p *Player) Seek(offset time.Duration) {
+	p.mu.Lock()
+	if offset < 0 {
+		offset = 0
+	}
+	if d := p.Duration(); offset > d {
+		offset = d
+	}
+	p.next = sort.Search(len(p.items), func(i int) bool { return p.items[i].offset >= offset })
+	p.setPosition(offset)
+	p.notify()
+
+	// The last change of the terminal size before the offset is the one in
+	// effect, as those at the offset are played next.
+	var size *TermSize
+	for i := p.next - 1; i >= 0; i-- {
+		if p.items[i].resize != nil {
+			size = p.items[i].resize
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if size != nil {
+		p.writeMu.Lock()
+		defer p.writeMu.Unlock()
+		p.opts.Resize(*size)
+	}
+}
+
+// SetSpeed sets the speed multiplier of playback. If it is 0, then events are
+// played as fast as possible. ErrInvalidMultiplier is returned for speed
+// multipliers less than 0.
+func (p *Player) SetSpeed(speedMultiplier float64) error {
+	if !validSpeed(speedMultiplier) {
+		return ErrInvalidMultiplier
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setPosition(p.position())
+	p.speed = speedMultiplier
+	p.notify()
+	return nil
+}
+
+// Step pauses playback and plays the next event immediately, moving playback
+// to its offset. io.EOF is returned if every event has been played.
+func (p *Player) Step() error {
+	p.mu.Lock()
+	p.pause()
+	p.mu.Unlock()
+
+	p.writeMu.Lock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next >= len(p.items) {
+		p.writeMu.Unlock()
+		return io.EOF
+	}
+	return p.play()
+}
@@ -0,0 +1,200 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPlayerRecording creates a recording with the given output at the given
+// offsets.
+func newPlayerRecording(t *testing.T, output map[time.Duration]string) *Recorder {
+	rec := NewRecorder()
+	var offsets []time.Duration
+	for offset := range output {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		require.NoError(t, rec.sink.Append(Event{Offset: offset, Data: []byte(output[offset])}))
+	}
+	return rec
+}
+
+func TestPlayerStep(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newPlayerRecording(t, map[time.Duration]string{
+		0:                       "a",
+		time.Second:             "b",
+		2 * time.Second:         "c",
+		time.Hour:               "d",
+		time.Hour + time.Second: "e",
+	})
+	rec.SetTerm("xterm", 24, 80)
+	rec.resizes = []resizeEvent{{timeOffset: 1500 * time.Millisecond, size: TermSize{Height: 40, Width: 120}}}
+
+	out := &bytes.Buffer{}
+	p, err := rec.NewPlayer(PlayerOptions{
+		ReplayOptions: ReplayOptions{
+			Stdout: out,
+			Resize: func(size TermSize) { fmt.Fprintf(out, "[%dx%d]", size.Width, size.Height) },
+		},
+		MaxIdle: 10 * time.Second,
+	})
+	require.NoError(t, err, "unable to create player")
+	assert.Equal(t, 13*time.Second, p.Duration(), "long pauses must be shortened")
+
+	var positions []time.Duration
+	for {
+		err := p.Step()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		positions = append(positions, p.Position())
+	}
+	assert.Equal(t, "[80x24]ab[120x40]cde", out.String(), "unexpected played output")
+	assert.Equal(t, []time.Duration{0, 0, time.Second, 1500 * time.Millisecond, 2 * time.Second,
+		12 * time.Second, 13 * time.Second}, positions, "unexpected positions")
+	assert.True(t, p.Done(), "player must be done")
+
+	// Seeking goes back to the events at or after the offset.
+	out.Reset()
+	p.Seek(time.Second)
+	require.NoError(t, p.Play(context.Background()), "unable to play")
+	assert.Equal(t, "[80x24]b[120x40]cde", out.String(), "unexpected output after seeking")
+	p.Seek(-time.Second)
+	assert.Equal(t, time.Duration(0), p.Position(), "seeking must be limited to the start")
+	p.Seek(time.Hour)
+	assert.Equal(t, p.Duration(), p.Position(), "seeking must be limited to the duration")
+
+	_, err = rec.NewPlayer(PlayerOptions{ReplayOptions: ReplayOptions{Stdout: out, Speed: -1}})
+	assert.Equal(t, ErrInvalidMultiplier, err, "negative speed must not be used")
+	assert.Equal(t, ErrInvalidMultiplier, p.SetSpeed(-1), "negative speed must not be used")
+}
+
+func TestPlayerPause(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rec := newPlayerRecording(t, map[time.Duration]string{
+		0:         "first",
+		time.Hour: "second",
+	})
+	writes := make(chan string, 2)
+	p, err := rec.NewPlayer(PlayerOptions{ReplayOptions: ReplayOptions{
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			writes <- string(b)
+			return len(b), nil
+		}),
+		Speed: 1,
+	}})
+	require.NoError(t, err, "unable to create player")
+
+	errC := make(chan error)
+	go func() { errC <- p.Play(ctx) }()
+	assert.Equal(t, "first", <-writes, "first event must be played")
+	assert.Error(t, p.Play(ctx), "player must not be played twice at once")
+	p.Pause()
+	require.NoError(t, <-errC, "pausing must stop playing")
+	assert.False(t, p.Done(), "paused player must not be done")
+	assert.True(t, p.Position() < time.Second, "position must not advance while paused")
+
+	// Speeding up while playing must take effect immediately.
+	go func() { errC <- p.Play(ctx) }()
+	require.NoError(t, p.SetSpeed(1e9))
+	require.NoError(t, <-errC, "unable to play")
+	assert.Equal(t, "second", <-writes, "second event must be played")
+	assert.True(t, p.Done(), "player must be done")
+	assert.Equal(t, time.Hour, p.Position(), "unexpected position")
+
+	p.Seek(0)
+	require.NoError(t, p.SetSpeed(1))
+	go func() { errC <- p.Play(ctx) }()
+	<-writes
+	cancelled, cancelPlay := context.WithCancel(ctx)
+	cancelPlay()
+	p.Pause()
+	<-errC
+	assert.Equal(t, context.Canceled, p.Play(cancelled), "cancelled playback must stop")
+}
+
+func TestPlayerSeekResize(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newPlayerRecording(t, map[time.Duration]string{
+		0:               "a",
+		2 * time.Second: "b",
+		4 * time.Second: "c",
+	})
+	rec.SetTerm("xterm", 24, 80)
+	rec.resizes = []resizeEvent{{timeOffset: time.Second, size: TermSize{Height: 40, Width: 120}}}
+
+	out := &bytes.Buffer{}
+	p, err := rec.NewPlayer(PlayerOptions{ReplayOptions: ReplayOptions{
+		Stdout: out,
+		Resize: func(size TermSize) { fmt.Fprintf(out, "[%dx%d]", size.Width, size.Height) },
+	}})
+	require.NoError(t, err, "unable to create player")
+
+	p.Seek(3 * time.Second)
+	assert.Equal(t, "[120x40]", out.String(), "size at the offset must be applied")
+	p.Seek(500 * time.Millisecond)
+	assert.Equal(t, "[120x40][80x24]", out.String(), "initial size must be applied")
+	require.NoError(t, p.Step())
+	assert.Equal(t, "[120x40][80x24][120x40]", out.String(), "resize after the offset must be played")
+
+	// Resizes at the offset are played next rather than applied.
+	out.Reset()
+	p.Seek(time.Second)
+	require.NoError(t, p.Play(context.Background()), "unable to play")
+	assert.Equal(t, "[80x24][120x40]bc", out.String(), "unexpected output after seeking")
+}
+
+func TestPlayerBlockedWriter(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newPlayerRecording(t, map[time.Duration]string{
+		0:           "first",
+		time.Second: "second",
+	})
+	written := make(chan string)
+	unblock := make(chan struct{})
+	p, err := rec.NewPlayer(PlayerOptions{ReplayOptions: ReplayOptions{
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			written <- string(b)
+			<-unblock
+			return len(b), nil
+		}),
+	}})
+	require.NoError(t, err, "unable to create player")
+
+	errC := make(chan error)
+	go func() { errC <- p.Play(context.Background()) }()
+	assert.Equal(t, "first", <-written, "first event must be written")
+
+	// The write is blocked, which must not block the other methods.
+	p.Pause()
+	assert.Equal(t, time.Duration(0), p.Position(), "unexpected position")
+	require.NoError(t, p.SetSpeed(2))
+	p.Seek(time.Second)
+	assert.False(t, p.Done(), "player must not be done")
+
+	close(unblock)
+	require.NoError(t, <-errC, "pausing must stop playing")
+	go func() { errC <- p.Step() }()
+	assert.Equal(t, "second", <-written, "event at the offset must be played next")
+	require.NoError(t, <-errC)
+	assert.True(t, p.Done(), "player must be done")
+}
@@ -1,16 +1,13 @@
 package recorder
 
 import (
-	"bytes"
 	"io"
-	"math"
 	"strings"
 	"sync"
 	"time"
 
 	errors2 "errors"
 
-	"github.com/fatih/color"
 	"github.com/pkg/errors"
 
 	"github.com/kballard/go-shellquote"
@@ -20,6 +17,10 @@ import (
 // speed.
 var ErrInvalidMultiplier = errors2.New("invalid speed multiplier")
 
+// maxResizes is the most changes of the terminal size that are kept, after
+// which the oldest are dropped.
+const maxResizes = 4096
+
 // Events that can be recorded.
 const (
 	EscapeEvent = "Escape"
@@ -32,21 +33,26 @@ type SpecialEvent struct {
 	Details   interface{}
 }
 
-type outputType uint8
-
-const (
-	stdout outputType = iota
-	stderr
-)
+// ExitStatus describes how a command exited.
+type ExitStatus struct {
+	// Code is the exit code of the command. For a command killed by a
+	// signal, it is 128 plus the number of the signal, as with shells. It is
+	// -1 if the command exited without reporting how.
+	Code int
+	// Signal is the name of the signal that killed the command, without the
+	// "SIG" prefix, if any.
+	Signal string
+	// CoreDumped indicates that the command dumped core when it was killed.
+	CoreDumped bool
+	// Message is the error message given for how the command exited, if any.
+	Message string
+}
 
 // eventBuffer handles a single output stream.
 type eventBuffer struct {
-	bytes.Buffer
-	startTime time.Time
-	outBuffer *[]outEvent
-	bufMu     *sync.Mutex
-	oType     outputType
-	scratch   [64]byte
+	rec     *Recorder
+	source  Source
+	scratch [64]byte
 
 	passthrough io.Writer
 }
@@ -71,17 +77,10 @@ func (eb *eventBuffer) ReadFrom(r io.Reader) (int64, error) {
 
 // Write handles the recording of a single write from an output stream.
 func (eb *eventBuffer) Write(p []byte) (int, error) {
-	startOffset := eb.Len()
-	written, _ := eb.Buffer.Write(p)
-	bufBytes := eb.Buffer.Bytes()
-
-	eb.bufMu.Lock()
-	*eb.outBuffer = append(*eb.outBuffer, outEvent{
-		timeOffset: time.Since(eb.startTime),
-		source:     eb.oType,
-		data:       bufBytes[startOffset : startOffset+written],
-	})
-	eb.bufMu.Unlock()
+	if err := eb.rec.record(eb.source, p); err != nil {
+		return 0, err
+	}
+	written := len(p)
 
 	// TODO: Have option to log/store error but not report it here.
 	if eb.passthrough != nil {
@@ -97,16 +96,23 @@ func (eb *eventBuffer) Write(p []byte) (int, error) {
 	return written, nil
 }
 
-type outEvent struct {
+// TermSize is the size of a terminal, in characters.
+type TermSize struct {
+	Height int
+	Width  int
+}
+
+// resizeEvent is a change of the dimensions of the terminal.
+type resizeEvent struct {
 	timeOffset time.Duration
-	source     outputType
-	data       []byte
+	size       TermSize
 }
 
 // Recorder handles the recording of data for a command.
 type Recorder struct {
 	cmd  string
 	args []string
+	env  map[string]string
 
 	out eventBuffer
 	err eventBuffer
@@ -115,12 +121,27 @@ type Recorder struct {
 	eventsMu sync.Mutex
 
 	recordingStart time.Time
-	entries        []outEvent
-	writeMu        sync.Mutex
-	stateMu        sync.Mutex
-
-	eventNotifier  chan struct{}
-	readLiveEvents int
+	// sink stores the output and the input of the command. writeMu is held
+	// while appending to it so that events are appended in the order of their
+	// offsets.
+	sink    Sink
+	writeMu sync.Mutex
+	stateMu sync.Mutex
+
+	// eventNotifier is closed and replaced when there are changes for
+	// subscriptions. It, subscriptions and finished are protected by writeMu.
+	eventNotifier chan struct{}
+	subscriptions map[*Subscription]struct{}
+	finished      bool
+
+	// exitStatus is set once the command has exited.
+	exitStatus *ExitStatus
+
+	// term is the type of the terminal that the command is run in, if any,
+	// and termSize is its initial size.
+	term     string
+	termSize TermSize
+	resizes  []resizeEvent
 }
 
 // Command outputs the escaped command string that is suitable for use with SSH.
@@ -154,18 +175,71 @@ func (r *Recorder) StartTiming() {
 
 	if r.recordingStart.IsZero() {
 		r.recordingStart = time.Now()
-		r.out.startTime = r.recordingStart
-		r.err.startTime = r.recordingStart
 	}
 }
 
-// NewRecorder returns a new Recorder.
+// NewRecorder returns a new Recorder that keeps the recording in memory.
 func NewRecorder() *Recorder {
-	r := &Recorder{}
+	return NewRecorderWithSink(NewMemorySink())
+}
+
+// NewRecorderWithSink returns a new Recorder that stores the output and the
+// input of the command in the given sink.
+func NewRecorderWithSink(sink Sink) *Recorder {
+	if sink == nil {
+		panic("nil sink")
+	}
+	r := &Recorder{sink: sink}
 
 	return r
 }
 
+// SetSink sets the sink that the output and the input of the command are
+// stored in. It must be called before anything is recorded.
+func (r *Recorder) SetSink(sink Sink) {
+	if sink == nil {
+		panic("nil sink")
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.sink = sink
+}
+
+// Sink gets the sink that the output and the input of the command are stored
+// in.
+func (r *Recorder) Sink() Sink {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	return r.sink
+}
+
+// record appends data from the given stream to the sink.
+func (r *Recorder) record(source Source, data []byte) error {
+	r.stateMu.Lock()
+	start := r.recordingStart
+	r.stateMu.Unlock()
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	var offset time.Duration
+	if !start.IsZero() {
+		offset = time.Since(start)
+	}
+	e := Event{
+		Offset: offset,
+		Source: source,
+		Data:   data,
+	}
+	if err := r.sink.Append(e); err != nil {
+		return errors.Wrap(err, "unable to record output")
+	}
+	r.publish(e)
+	return nil
+}
+
 // SetCommand sets the command that is to be executed.
 func (r *Recorder) SetCommand(cmd string, args ...string) {
 	r.stateMu.Lock()
@@ -175,6 +249,100 @@ func (r *Recorder) SetCommand(cmd string, args ...string) {
 	r.args = args
 }
 
+// SetEnv sets the environment variables that the command is run with.
+func (r *Recorder) SetEnv(vars map[string]string) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	r.env = vars
+}
+
+// Env gets the environment variables that the command is run with.
+func (r *Recorder) Env() map[string]string {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	return r.env
+}
+
+// Redactor is given the input that is read by a command, and returns the data
+// to record in its place. This allows secrets, such as passwords, to be left
+// out of recordings. It is called with the data of each read, so secrets that
+// are split across reads are not seen whole.
+type Redactor func(p []byte) []byte
+
+// inputRecorder records the data that is read from an input.
+type inputRecorder struct {
+	r      *Recorder
+	in     io.Reader
+	redact Redactor
+}
+
+func (ir *inputRecorder) Read(p []byte) (int, error) {
+	n, err := ir.in.Read(p)
+	if n > 0 {
+		data := append([]byte(nil), p[:n]...)
+		if ir.redact != nil {
+			data = ir.redact(data)
+		}
+		if len(data) > 0 {
+			if recErr := ir.r.record(Stdin, data); recErr != nil && err == nil {
+				err = recErr
+			}
+		}
+	}
+	return n, err
+}
+
+// RecordInput returns a reader of the given input that records the data that
+// is read as the input of the command, in the same timeline as the output.
+//
+// If redact is not nil, the data that it returns is recorded in place of the
+// data that was read.
+func (r *Recorder) RecordInput(in io.Reader, redact Redactor) io.Reader {
+	return &inputRecorder{r: r, in: in, redact: redact}
+}
+
+// SetTerm sets the type and the initial size of the terminal that the command
+// is run in.
+func (r *Recorder) SetTerm(term string, height, width int) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	r.term = term
+	r.termSize = TermSize{Height: height, Width: width}
+}
+
+// Term gets the type and the initial size of the terminal that the command is
+// run in. The type is empty if the command is not run in a terminal.
+func (r *Recorder) Term() (string, TermSize) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	return r.term, r.termSize
+}
+
+// AddResize records a change of the size of the terminal. Only the latest
+// changes are kept, so a replay of a command with very many changes may begin
+// with an outdated size.
+func (r *Recorder) AddResize(height, width int) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	var offset time.Duration
+	if !r.recordingStart.IsZero() {
+		offset = time.Since(r.recordingStart)
+	}
+	if len(r.resizes) >= maxResizes {
+		// The slice is not changed in place, as replays may be reading it.
+		r.resizes = r.resizes[len(r.resizes)-maxResizes+1:]
+	}
+	r.resizes = append(r.resizes, resizeEvent{
+		timeOffset: offset,
+		size:       TermSize{Height: height, Width: width},
+	})
+}
+
 // SetOutput sets the outputs pointed to to the types that the recorder will use
 // to record the data.
 //
@@ -191,15 +359,13 @@ func (r *Recorder) SetOutput(out *io.Writer, err *io.Writer) {
 	}
 
 	r.out = eventBuffer{
-		outBuffer: &r.entries,
-		bufMu:     &r.writeMu,
-		oType:     stdout,
+		rec:    r,
+		source: Stdout,
 	}
 	*out = &r.out
 	r.err = eventBuffer{
-		outBuffer: &r.entries,
-		bufMu:     &r.writeMu,
-		oType:     stderr,
+		rec:    r,
+		source: Stderr,
 	}
 	*err = &r.err
 }
@@ -210,7 +376,7 @@ func (r *Recorder) SetPassthrough(out io.Writer, err io.Writer) {
 	r.stateMu.Lock()
 	defer r.stateMu.Unlock()
 
-	if r.out.bufMu == nil || r.err.bufMu == nil {
+	if r.out.rec == nil || r.err.rec == nil {
 		panic("output not set yet")
 	}
 
@@ -218,6 +384,27 @@ func (r *Recorder) SetPassthrough(out io.Writer, err io.Writer) {
 	r.err.passthrough = err
 }
 
+// SetExitStatus records how the command exited.
+func (r *Recorder) SetExitStatus(es ExitStatus) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	r.exitStatus = &es
+}
+
+// ExitStatus gets how the command exited, returning nil if it has not exited
+// or could not be run.
+func (r *Recorder) ExitStatus() *ExitStatus {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	if r.exitStatus == nil {
+		return nil
+	}
+	es := *r.exitStatus
+	return &es
+}
+
 // GetSpecialEvents gets all of the special events that have been recorded.
 func (r *Recorder) GetSpecialEvents() []SpecialEvent {
 	r.eventsMu.Lock()
@@ -242,6 +429,9 @@ func (r *Recorder) AddSpecialEvent(eventType string, details interface{}) {
 //
 // If the speed multiplier is 0, then the output will happen as fast as
 // possible. Speed multipliers less than 0 will return ErrInvalidMultiplier.
+//
+// Recorded input and changes of the terminal size are not replayed. Use
+// ReplayWithOptions to replay them.
 func (r *Recorder) Replay(out io.Writer, err io.Writer, speedMultiplier float64) error {
 	if out == nil && err == nil {
 		panic("only given nil writers")
@@ -252,60 +442,113 @@ func (r *Recorder) Replay(out io.Writer, err io.Writer, speedMultiplier float64)
 		out = err
 	}
 
-	sm := speedMultiplier
-	if sm < 0 || math.IsInf(sm, 0) || math.IsNaN(sm) {
+	return r.ReplayWithOptions(ReplayOptions{
+		Stdout: out,
+		Stderr: err,
+		Speed:  speedMultiplier,
+	})
+}
+
+// ReplayOptions contains the settings for replaying a recording.
+type ReplayOptions struct {
+	// Stdout and Stderr are written the output of the streams. The output of
+	// a stream is not replayed if its writer is nil.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Input, if set, is written the recorded input.
+	Input io.Writer
+	// Resize, if set, is called with the initial size of the terminal and with
+	// each change to it.
+	Resize func(TermSize)
+	// Speed is the speed multiplier. If it is 0, then the recording is
+	// replayed as fast as possible.
+	Speed float64
+	// Renderer writes the data to the writers. DefaultRenderer, which colors
+	// the output of stderr green, is used if it is nil.
+	Renderer Renderer
+}
+
+// writer gets the writer for the data of the given stream, which is nil if it
+// is not replayed.
+func (opts *ReplayOptions) writer(source Source) io.Writer {
+	switch source {
+	case Stdout:
+		return opts.Stdout
+	case Stderr:
+		return opts.Stderr
+	case Stdin:
+		return opts.Input
+	default:
+		return nil
+	}
+}
+
+// write renders the data of an event to the writer of its stream.
+func (opts *ReplayOptions) write(e Event) error {
+	w := opts.writer(e.Source)
+	if w == nil {
+		return nil
+	}
+	renderer := opts.Renderer
+	if renderer == nil {
+		renderer = DefaultRenderer
+	}
+	return renderer.Render(w, e)
+}
+
+// ReplayWithOptions replays the recording with the given options.
+//
+// ErrInvalidMultiplier is returned for speed multipliers less than 0.
+func (r *Recorder) ReplayWithOptions(opts ReplayOptions) error {
+	sm := opts.Speed
+	if !validSpeed(sm) {
 		return ErrInvalidMultiplier
 	}
 
+	r.stateMu.Lock()
+	term, termSize := r.term, r.termSize
+	resizes := r.resizes
+	r.stateMu.Unlock()
+	sink := r.Sink()
+
+	if opts.Resize != nil && term != "" {
+		opts.Resize(termSize)
+	}
+
 	replayStart := time.Now()
 	var elapsed time.Duration
-	for i := range r.entries {
-		entry := &r.entries[i]
-
+	sleepUntil := func(offset time.Duration) {
 		if sm == 0 {
 			// Don't sleep.
-		} else if sm == 1 {
-			runTime := r.recordingStart.Add(entry.timeOffset)
-			sleepDuration := runTime.Sub(r.recordingStart) - elapsed
-			time.Sleep(sleepDuration)
-		} else {
-			offset := time.Duration(float64(entry.timeOffset) / sm)
-			runTime := r.recordingStart.Add(offset)
-			sleepDuration := runTime.Sub(r.recordingStart) - elapsed
-			time.Sleep(sleepDuration)
+			return
 		}
+		time.Sleep(time.Duration(float64(offset)/sm) - elapsed)
 		elapsed = time.Since(replayStart)
+	}
 
-		fn := func(w io.Writer, colorize bool) error {
-			offset := 0
-			for {
-				var written int
-				var err error
-				if colorize {
-					written, err = color.New(color.FgGreen).Fprint(w, string(entry.data[offset:]))
-				} else {
-					written, err = w.Write(entry.data[offset:])
-				}
-				if err != nil {
-					return err
-				}
-				if offset+written < len(entry.data) {
-					offset += written
-				} else {
-					break
-				}
+	// The output and the changes of the terminal size are replayed in the
+	// order that they happened in.
+	var ri int
+	err := sink.Events(func(entry Event) error {
+		for ; ri < len(resizes) && resizes[ri].timeOffset <= entry.Offset; ri++ {
+			if opts.Resize != nil {
+				sleepUntil(resizes[ri].timeOffset)
+				opts.Resize(resizes[ri].size)
 			}
-			return nil
 		}
-		if entry.source == stdout {
-			if err := fn(out, false); err != nil {
-				return err
-			}
-		} else {
-			if err := fn(err, true); err != nil {
-				return err
-			}
+
+		if opts.writer(entry.Source) == nil {
+			return nil
 		}
+		sleepUntil(entry.Offset)
+		return opts.write(entry)
+	})
+	if err != nil {
+		return err
+	}
+	for ; ri < len(resizes) && opts.Resize != nil; ri++ {
+		sleepUntil(resizes[ri].timeOffset)
+		opts.Resize(resizes[ri].size)
 	}
 	return nil
 }
@@ -2,7 +2,9 @@ package recorder
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
 	"testing"
 	"time"
@@ -160,3 +162,73 @@ func TestRecorderReplayNilWriters(t *testing.T) {
 		rec.Replay(nil, nil, 0)
 	})
 }
+
+func TestRecorderRecordInput(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	rec.SetTerm("xterm", 24, 80)
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+
+	redact := func(p []byte) []byte {
+		return bytes.Replace(p, []byte("secret"), []byte("******"), -1)
+	}
+	in := rec.RecordInput(bytes.NewBufferString("echo secret\n"), redact)
+	stdoutWriter.Write([]byte("$ "))
+	read, err := ioutil.ReadAll(in)
+	require.NoError(t, err, "unable to read input")
+	assert.Equal(t, "echo secret\n", string(read), "input must not be changed by redaction")
+	rec.AddResize(40, 120)
+	stdoutWriter.Write([]byte("secret\n"))
+
+	// Input is not replayed by default.
+	out := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(out, out, 0))
+	assert.Equal(t, "$ secret\n", out.String(), "unexpected replayed output")
+
+	var timeline []string
+	tw := writerFunc(func(p []byte) (int, error) {
+		timeline = append(timeline, string(p))
+		return len(p), nil
+	})
+	err = rec.ReplayWithOptions(ReplayOptions{
+		Stdout: tw,
+		Input:  writerFunc(func(p []byte) (int, error) { return tw.Write(append([]byte("> "), p...)) }),
+		Resize: func(size TermSize) {
+			timeline = append(timeline, fmt.Sprintf("%dx%d", size.Width, size.Height))
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"80x24", "$ ", "> echo ******\n", "120x40", "secret\n"}, timeline,
+		"unexpected replayed timeline")
+
+	assert.Equal(t, ErrInvalidMultiplier, rec.ReplayWithOptions(ReplayOptions{Speed: -1}))
+}
+
+func TestRecorderResizeLimit(t *testing.T) {
+	rec := NewRecorder()
+	rec.SetTerm("xterm", 24, 80)
+	for i := 0; i < maxResizes+10; i++ {
+		rec.AddResize(24, i)
+	}
+
+	var widths []int
+	err := rec.ReplayWithOptions(ReplayOptions{
+		Resize: func(size TermSize) {
+			widths = append(widths, size.Width)
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, widths, maxResizes+1, "only the latest resizes must be kept")
+	assert.Equal(t, 80, widths[0], "initial size must be kept")
+	assert.Equal(t, 10, widths[1], "oldest resizes must be dropped")
+	assert.Equal(t, maxResizes+9, widths[maxResizes], "latest resize must be kept")
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (wf writerFunc) Write(p []byte) (int, error) {
+	return wf(p)
+}
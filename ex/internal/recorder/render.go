@@ -0,0 +1,451 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Renderer writes the data of recorded events when a recording is replayed.
+type Renderer interface {
+	// Render writes the data of an event to w, the writer of its stream.
+	Render(w io.Writer, e Event) error
+}
+
+// RenderFunc is a function that is used as a Renderer.
+type RenderFunc func(w io.Writer, e Event) error
+
+// Render calls the function.
+func (rf RenderFunc) Render(w io.Writer, e Event) error {
+	return rf(w, e)
+}
+
+// PlainRenderer writes the data of events unchanged.
+var PlainRenderer Renderer = RenderFunc(func(w io.Writer, e Event) error {
+	return writeAll(w, e.Data)
+})
+
+// DefaultRenderer colors the output of stderr green and writes the data of the
+// other streams unchanged. The color is only used if the output of this
+// process is a terminal.
+var DefaultRenderer Renderer = RenderFunc(func(w io.Writer, e Event) error {
+	if e.Source != Stderr {
+		return writeAll(w, e.Data)
+	}
+	_, err := color.New(color.FgGreen).Fprint(w, string(e.Data))
+	return err
+})
+
+// writeAll writes all of the data to the writer.
+func writeAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		written, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if written >= len(data) {
+			return nil
+		}
+		if written <= 0 {
+			return io.ErrShortWrite
+		}
+		data = data[written:]
+	}
+	return nil
+}
+
+// NewColorRenderer returns a renderer that colors the data of each stream with
+// the given SGR parameters, such as "31" for red or "1;33" for bold yellow.
+// The data of streams without parameters is written unchanged.
+//
+// Unlike DefaultRenderer, colors are used whether or not the output of this
+// process is a terminal.
+func NewColorRenderer(colors map[Source]string) Renderer {
+	sgrs := make(map[Source]string, len(colors))
+	for source, sgr := range colors {
+		sgrs[source] = sgr
+	}
+	return RenderFunc(func(w io.Writer, e Event) error {
+		sgr := sgrs[e.Source]
+		if sgr == "" || len(e.Data) == 0 {
+			return writeAll(w, e.Data)
+		}
+		buf := make([]byte, 0, len(e.Data)+len(sgr)+7)
+		buf = append(buf, "\x1b["+sgr+"m"...)
+		buf = append(buf, e.Data...)
+		buf = append(buf, "\x1b[0m"...)
+		return writeAll(w, buf)
+	})
+}
+
+// PrefixRenderer writes the data of events with a prefix at the start of each
+// line, such as to tell the streams apart in a log.
+type PrefixRenderer struct {
+	prefixes   map[Source]string
+	timestamps bool
+
+	mu sync.Mutex
+	// midLine is whether a line of a stream has been started.
+	midLine map[Source]bool
+}
+
+var _ Renderer = &PrefixRenderer{}
+
+// NewPrefixRenderer returns a renderer that starts each line of a stream with
+// its prefix. If timestamps is true, each line is started with the offset of
+// the event it begins in before the prefix, as "[mm:ss.mmm] ".
+func NewPrefixRenderer(prefixes map[Source]string, timestamps bool) *PrefixRenderer {
+	pr := &PrefixRenderer{
+		prefixes:   make(map[Source]string, len(prefixes)),
+		timestamps: timestamps,
+		midLine:    make(map[Source]bool),
+	}
+	for source, prefix := range prefixes {
+		pr.prefixes[source] = prefix
+	}
+	return pr
+}
+
+// Render writes the data of an event with the prefixes of the lines that it
+// begins.
+func (pr *PrefixRenderer) Render(w io.Writer, e Event) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	data := e.Data
+	for len(data) > 0 {
+		if !pr.midLine[e.Source] {
+			if pr.timestamps {
+				buf.WriteString(formatTimestamp(e.Offset))
+			}
+			buf.WriteString(pr.prefixes[e.Source])
+			pr.midLine[e.Source] = true
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			buf.Write(data)
+			break
+		}
+		buf.Write(data[:i+1])
+		data = data[i+1:]
+		pr.midLine[e.Source] = false
+	}
+	return writeAll(w, buf.Bytes())
+}
+
+// formatTimestamp formats an offset as the timestamp of a line.
+func formatTimestamp(offset time.Duration) string {
+	ms := offset / time.Millisecond
+	return fmt.Sprintf("[%02d:%02d.%03d] ", ms/60000, ms/1000%60, ms%1000)
+}
+
+// htmlPalette is the colors of the standard and bright colors of terminals.
+var htmlPalette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// maxEscapeLen is the longest escape sequence that is held back for the next
+// event. Longer unfinished sequences are dropped.
+const maxEscapeLen = 4096
+
+// htmlStyle is the style of text set by SGR escape sequences.
+type htmlStyle struct {
+	fg, bg                                  string
+	bold, faint, italic, underline, inverse bool
+}
+
+// css gets the inline CSS for the style.
+func (hs *htmlStyle) css() string {
+	fg, bg := hs.fg, hs.bg
+	if hs.inverse {
+		if fg == "" {
+			fg = htmlPalette[7]
+		}
+		if bg == "" {
+			bg = htmlPalette[0]
+		}
+		fg, bg = bg, fg
+	}
+	var props []string
+	if fg != "" {
+		props = append(props, "color:"+fg)
+	}
+	if bg != "" {
+		props = append(props, "background-color:"+bg)
+	}
+	if hs.bold {
+		props = append(props, "font-weight:bold")
+	}
+	if hs.faint {
+		props = append(props, "opacity:0.5")
+	}
+	if hs.italic {
+		props = append(props, "font-style:italic")
+	}
+	if hs.underline {
+		props = append(props, "text-decoration:underline")
+	}
+	return strings.Join(props, ";")
+}
+
+// apply applies the parameters of an SGR escape sequence to the style.
+func (hs *htmlStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	num := func(i int) int {
+		if i >= len(codes) {
+			return -1
+		}
+		if codes[i] == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(codes[i])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	// extended gets the color of a 256 color or RGB parameter starting at i,
+	// and the number of parameters that it uses.
+	extended := func(i int) (string, int) {
+		switch num(i) {
+		case 5:
+			if n := num(i + 1); n >= 0 && n < 256 {
+				return color256(n), 2
+			}
+			return "", 2
+		case 2:
+			r, g, b := num(i+1), num(i+2), num(i+3)
+			if r < 0 || r > 255 || g < 0 || g > 255 || b < 0 || b > 255 {
+				return "", 4
+			}
+			return fmt.Sprintf("#%02x%02x%02x", r, g, b), 4
+		default:
+			return "", 0
+		}
+	}
+
+	for i := 0; i < len(codes); i++ {
+		switch n := num(i); {
+		case n == 0:
+			*hs = htmlStyle{}
+		case n == 1:
+			hs.bold = true
+		case n == 2:
+			hs.faint = true
+		case n == 3:
+			hs.italic = true
+		case n == 4:
+			hs.underline = true
+		case n == 7:
+			hs.inverse = true
+		case n == 22:
+			hs.bold, hs.faint = false, false
+		case n == 23:
+			hs.italic = false
+		case n == 24:
+			hs.underline = false
+		case n == 27:
+			hs.inverse = false
+		case n >= 30 && n <= 37:
+			hs.fg = htmlPalette[n-30]
+		case n == 38:
+			c, used := extended(i + 1)
+			hs.fg = c
+			i += used
+		case n == 39:
+			hs.fg = ""
+		case n >= 40 && n <= 47:
+			hs.bg = htmlPalette[n-40]
+		case n == 48:
+			c, used := extended(i + 1)
+			hs.bg = c
+			i += used
+		case n == 49:
+			hs.bg = ""
+		case n >= 90 && n <= 97:
+			hs.fg = htmlPalette[n-90+8]
+		case n >= 100 && n <= 107:
+			hs.bg = htmlPalette[n-100+8]
+		}
+	}
+}
+
+// color256 gets the color of an index of the 256 color palette.
+func color256(n int) string {
+	switch {
+	case n < 16:
+		return htmlPalette[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + 40*v
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	default:
+		gray := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+// escapeLen gets the length of the escape sequence at the start of the data,
+// returning false if the data ends before the sequence does.
+func escapeLen(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+	switch data[1] {
+	case '[':
+		// Control sequence, ended by a byte in the range @ to ~.
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				return i + 1, true
+			}
+		}
+		return 0, false
+	case ']':
+		// Operating system command, ended by BEL or ST.
+		for i := 2; i < len(data); i++ {
+			if data[i] == 0x07 {
+				return i + 1, true
+			}
+			if data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2, true
+			}
+		}
+		return 0, false
+	case '(', ')', '*', '+':
+		// Character set designation.
+		if len(data) < 3 {
+			return 0, false
+		}
+		return 3, true
+	default:
+		return 2, true
+	}
+}
+
+// HTMLRenderer writes the data of events as HTML, with the escape sequences
+// that style terminal output turned into styled spans. The data of each event
+// is written in spans whose class is the name of its stream, such as "stderr".
+//
+// The style of each stream is kept separately, so styles that are left set in
+// one stream do not apply to the others.
+//
+// Other escape sequences and control characters, including carriage returns,
+// are left out, as are escape sequences and characters that are not complete
+// at the end of a replay.
+type HTMLRenderer struct {
+	mu sync.Mutex
+	// styles are the current styles of each stream.
+	styles map[Source]*htmlStyle
+	// pending is the data of each stream that is held back until the next
+	// event, as it ends with an incomplete escape sequence or character.
+	pending map[Source][]byte
+}
+
+var _ Renderer = &HTMLRenderer{}
+
+// NewHTMLRenderer returns a new HTMLRenderer.
+func NewHTMLRenderer() *HTMLRenderer {
+	return &HTMLRenderer{
+		styles:  make(map[Source]*htmlStyle),
+		pending: make(map[Source][]byte),
+	}
+}
+
+// Render writes the data of an event as HTML.
+func (hr *HTMLRenderer) Render(w io.Writer, e Event) error {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	data := append(hr.pending[e.Source], e.Data...)
+	hr.pending[e.Source] = nil
+	style := hr.styles[e.Source]
+	if style == nil {
+		style = &htmlStyle{}
+		hr.styles[e.Source] = style
+	}
+
+	out := &bytes.Buffer{}
+	text := &bytes.Buffer{}
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		fmt.Fprintf(out, `<span class="%s"`, e.Source)
+		if css := style.css(); css != "" {
+			fmt.Fprintf(out, ` style="%s"`, css)
+		}
+		fmt.Fprintf(out, ">%s</span>", html.EscapeString(text.String()))
+		text.Reset()
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+		switch {
+		case b == 0x1b:
+			n, ok := escapeLen(data[i:])
+			if !ok {
+				if len(data)-i <= maxEscapeLen {
+					hr.pending[e.Source] = append([]byte(nil), data[i:]...)
+					i = len(data)
+				} else {
+					i++
+				}
+				continue
+			}
+			if seq := data[i : i+n]; seq[1] == '[' && seq[n-1] == 'm' {
+				flush()
+				style.apply(string(seq[2 : n-1]))
+			}
+			i += n
+		case b == '\n' || b == '\t':
+			text.WriteByte(b)
+			i++
+		case b < 0x20 || b == 0x7f:
+			i++
+		default:
+			text.WriteByte(b)
+			i++
+		}
+	}
+	if hr.pending[e.Source] == nil {
+		// Characters may be split across events.
+		if complete := completeUTF8(text.Bytes()); complete < text.Len() {
+			hr.pending[e.Source] = append([]byte(nil), text.Bytes()[complete:]...)
+			text.Truncate(complete)
+		}
+	}
+	flush()
+	return writeAll(w, out.Bytes())
+}
+
+// WriteHTML writes the output of the recording as a preformatted HTML block,
+// rendered with an HTMLRenderer.
+func (r *Recorder) WriteHTML(w io.Writer) error {
+	if _, err := io.WriteString(w, `<pre class="recording">`); err != nil {
+		return err
+	}
+	err := r.ReplayWithOptions(ReplayOptions{
+		Stdout:   w,
+		Stderr:   w,
+		Renderer: NewHTMLRenderer(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "</pre>\n")
+	return err
+}
@@ -0,0 +1,100 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// render renders events with a renderer, giving the output of each stream.
+func render(t *testing.T, r Renderer, events ...Event) (string, string) {
+	var out, errOut bytes.Buffer
+	opts := ReplayOptions{Stdout: &out, Stderr: &errOut, Renderer: r}
+	for _, e := range events {
+		require.NoError(t, opts.write(e), "unable to render event")
+	}
+	return out.String(), errOut.String()
+}
+
+func TestColorRenderer(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	out, errOut := render(t, NewColorRenderer(map[Source]string{Stderr: "1;31"}),
+		Event{Source: Stdout, Data: []byte("out\n")},
+		Event{Source: Stderr, Data: []byte("err\n")},
+		Event{Source: Stderr})
+	assert.Equal(t, "out\n", out, "stream without color must be unchanged")
+	assert.Equal(t, "\x1b[1;31merr\n\x1b[0m", errOut, "unexpected colored output")
+
+	out, errOut = render(t, PlainRenderer,
+		Event{Source: Stdout, Data: []byte("out\n")},
+		Event{Source: Stderr, Data: []byte("err\n")})
+	assert.Equal(t, "out\n", out)
+	assert.Equal(t, "err\n", errOut, "plain output must not be colored")
+}
+
+func TestPrefixRenderer(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	out, errOut := render(t, NewPrefixRenderer(map[Source]string{Stdout: "out| ", Stderr: "err| "}, true),
+		Event{Offset: 1500 * time.Millisecond, Source: Stdout, Data: []byte("a\nb")},
+		Event{Offset: 2 * time.Second, Source: Stderr, Data: []byte("x\n\n")},
+		Event{Offset: 61*time.Second + 5*time.Millisecond, Source: Stdout, Data: []byte("c\nd\n")})
+	assert.Equal(t, "[00:01.500] out| a\n[00:01.500] out| bc\n[01:01.005] out| d\n", out,
+		"unexpected prefixed output")
+	assert.Equal(t, "[00:02.000] err| x\n[00:02.000] err| \n", errOut, "unexpected prefixed output")
+}
+
+func TestHTMLRenderer(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	euro := []byte("€")
+	out, errOut := render(t, NewHTMLRenderer(),
+		Event{Source: Stdout, Data: []byte("\x1b]0;title\x07<b> & \x1b[1;3")},
+		Event{Source: Stdout, Data: []byte("1mred\x1b[0m\r\n\x1b[38;5;196;48;2;1;2;3m")},
+		Event{Source: Stdout, Data: append([]byte("x\x1b[7m"), euro[:2]...)},
+		Event{Source: Stderr, Data: []byte("\x1b[Kerr\n")},
+		Event{Source: Stdout, Data: append(euro[2:], "\x1b[22;39;49;27mplain"...)})
+	assert.Equal(t, `<span class="stdout">&lt;b&gt; &amp; </span>`+
+		`<span class="stdout" style="color:#cd0000;font-weight:bold">red</span>`+
+		`<span class="stdout">`+"\n"+`</span>`+
+		`<span class="stdout" style="color:#ff0000;background-color:#010203">x</span>`+
+		`<span class="stdout" style="color:#010203;background-color:#ff0000">€</span>`+
+		`<span class="stdout">plain</span>`, out, "unexpected HTML output")
+	assert.Equal(t, `<span class="stderr">err`+"\n"+`</span>`, errOut, "styles must not be shared between streams")
+
+	// Styles left set in interleaved streams apply only to their own stream.
+	out, errOut = render(t, NewHTMLRenderer(),
+		Event{Source: Stdout, Data: []byte("\x1b[32mout")},
+		Event{Source: Stderr, Data: []byte("err\x1b[1m")},
+		Event{Source: Stdout, Data: []byte("more")},
+		Event{Source: Stderr, Data: []byte("bold\x1b[0m")},
+		Event{Source: Stdout, Data: []byte("\x1b[0mplain")})
+	assert.Equal(t, `<span class="stdout" style="color:#00cd00">out</span>`+
+		`<span class="stdout" style="color:#00cd00">more</span>`+
+		`<span class="stdout">plain</span>`, out, "unexpected interleaved stdout")
+	assert.Equal(t, `<span class="stderr">err</span>`+
+		`<span class="stderr" style="font-weight:bold">bold</span>`, errOut, "unexpected interleaved stderr")
+}
+
+func TestRecorderWriteHTML(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+	stdoutWriter.Write([]byte("\x1b[32mok\x1b[m\n"))
+	stderrWriter.Write([]byte("permission denied\n"))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.WriteHTML(buf), "unable to write HTML")
+	assert.Equal(t, `<pre class="recording">`+
+		`<span class="stdout" style="color:#00cd00">ok</span><span class="stdout">`+"\n</span>"+
+		`<span class="stderr">permission denied`+"\n</span></pre>\n", buf.String())
+}
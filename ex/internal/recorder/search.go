@@ -0,0 +1,301 @@
+package recorder
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// SearchOptions contains the settings of a search of recordings.
+type SearchOptions struct {
+	// Context is the number of lines before and after a matching line that
+	// are included with the match.
+	Context int
+	// Sources are the streams that are searched. The output of stdout and
+	// stderr is searched if none are given.
+	Sources []Source
+}
+
+// Match is a match of a search in a line of a recording.
+type Match struct {
+	// Recorder is the recording that the match is in.
+	Recorder *Recorder
+	// Source is the stream that the line is from.
+	Source Source
+	// Offset is the offset of the event that the line began in, and Time is
+	// the time that it was recorded, if the start of the recording is known.
+	Offset time.Duration
+	Time   time.Time
+	// Line is the number of the line in its stream, starting from 1.
+	Line int
+	// Text is the text of the line, and Start and End are the positions of
+	// the match in it.
+	Text       string
+	Start, End int
+	// Before and After are the lines around the line, up to the number of
+	// lines of context that were requested.
+	Before, After []string
+}
+
+// Search finds the matches of the regular expression in the lines of the
+// recording. Full-text searches can be made with regexp.QuoteMeta.
+//
+// Lines are searched as a terminal would have shown them, so escape sequences
+// are left out, and text that was overwritten, such as after a carriage
+// return, is replaced. Matches are ordered by their offsets.
+func (r *Recorder) Search(re *regexp.Regexp, opts *SearchOptions) ([]Match, error) {
+	if re == nil {
+		panic("nil regular expression")
+	}
+	var o SearchOptions
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Sources) == 0 {
+		o.Sources = []Source{Stdout, Stderr}
+	}
+
+	r.stateMu.Lock()
+	start := r.recordingStart
+	r.stateMu.Unlock()
+
+	var matches []*Match
+	scanners := make(map[Source]*lineScanner)
+	for _, source := range o.Sources {
+		source := source
+		// recent are the lines before the current line, and pending are the
+		// matches that are still given the lines after them.
+		var recent []string
+		var pending []*Match
+		scanners[source] = &lineScanner{emit: func(text string, offset time.Duration, line int) {
+			for len(pending) > 0 && len(pending[0].After) >= o.Context {
+				pending = pending[1:]
+			}
+			for _, m := range pending {
+				m.After = append(m.After, text)
+			}
+
+			for _, loc := range re.FindAllStringIndex(text, -1) {
+				m := &Match{
+					Recorder: r,
+					Source:   source,
+					Offset:   offset,
+					Line:     line,
+					Text:     text,
+					Start:    loc[0],
+					End:      loc[1],
+					Before:   append([]string(nil), recent...),
+				}
+				if !start.IsZero() {
+					m.Time = start.Add(offset)
+				}
+				matches = append(matches, m)
+				if o.Context > 0 {
+					pending = append(pending, m)
+				}
+			}
+
+			if o.Context > 0 {
+				if recent = append(recent, text); len(recent) > o.Context {
+					recent = recent[1:]
+				}
+			}
+		}}
+	}
+
+	err := r.Sink().Events(func(e Event) error {
+		if ls, ok := scanners[e.Source]; ok {
+			ls.write(e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to search recording")
+	}
+	for _, ls := range scanners {
+		ls.flush()
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Offset != matches[j].Offset {
+			return matches[i].Offset < matches[j].Offset
+		}
+		return matches[i].Source < matches[j].Source
+	})
+	result := make([]Match, len(matches))
+	for i, m := range matches {
+		result[i] = *m
+	}
+	return result, nil
+}
+
+// Search finds the matches of the regular expression in the lines of each of
+// the recordings, in the order of the recordings.
+func Search(recs []*Recorder, re *regexp.Regexp, opts *SearchOptions) ([]Match, error) {
+	var matches []Match
+	for _, rec := range recs {
+		m, err := rec.Search(re, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to search recording of %s", rec.Command())
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// maxSearchColumn is the furthest column that the cursor is moved to past the
+// end of a line, as the recorded output may move it arbitrarily far.
+const maxSearchColumn = 64 * 1024
+
+// lineScanner splits the data of a stream into lines as a terminal would show
+// them.
+type lineScanner struct {
+	emit func(text string, offset time.Duration, line int)
+
+	// text is the current line, and cursor is the column of the cursor in it.
+	text    []rune
+	cursor  int
+	started bool
+	offset  time.Duration
+	line    int
+	// pending is data that is held back until the next event, as it ends with
+	// an incomplete escape sequence or character.
+	pending []byte
+}
+
+// write adds the data of an event to the lines.
+func (ls *lineScanner) write(e Event) {
+	data := append(ls.pending, e.Data...)
+	ls.pending = nil
+
+	for i := 0; i < len(data); {
+		if !ls.started {
+			ls.started = true
+			ls.offset = e.Offset
+		}
+		switch b := data[i]; {
+		case b == 0x1b:
+			n, ok := escapeLen(data[i:])
+			if !ok {
+				if len(data)-i <= maxEscapeLen {
+					ls.pending = append([]byte(nil), data[i:]...)
+					return
+				}
+				i++
+				continue
+			}
+			if data[i+1] == '[' {
+				ls.control(string(data[i+2:i+n-1]), data[i+n-1])
+			}
+			i += n
+		case b == '\n':
+			ls.endLine()
+			i++
+		case b == '\r':
+			ls.cursor = 0
+			i++
+		case b == '\b':
+			if ls.cursor > 0 {
+				ls.cursor--
+			}
+			i++
+		case b == '\t':
+			ls.put('\t')
+			i++
+		case b < 0x20 || b == 0x7f:
+			i++
+		default:
+			if !utf8.FullRune(data[i:]) {
+				ls.pending = append([]byte(nil), data[i:]...)
+				return
+			}
+			r, size := utf8.DecodeRune(data[i:])
+			ls.put(r)
+			i += size
+		}
+	}
+}
+
+// put writes a character at the cursor.
+func (ls *lineScanner) put(r rune) {
+	for len(ls.text) < ls.cursor {
+		ls.text = append(ls.text, ' ')
+	}
+	if ls.cursor < len(ls.text) {
+		ls.text[ls.cursor] = r
+	} else {
+		ls.text = append(ls.text, r)
+	}
+	ls.cursor++
+}
+
+// control handles the control sequences that move the cursor within a line or
+// erase it.
+func (ls *lineScanner) control(params string, final byte) {
+	n, err := strconv.Atoi(params)
+	if err != nil || n < 0 {
+		n = -1
+	}
+	count := n
+	if count <= 0 {
+		count = 1
+	}
+
+	switch final {
+	case 'C':
+		ls.moveTo(ls.cursor + count)
+	case 'D':
+		if ls.cursor -= count; ls.cursor < 0 {
+			ls.cursor = 0
+		}
+	case 'G':
+		ls.moveTo(count - 1)
+	case 'K':
+		switch {
+		case params == "" || n == 0:
+			if ls.cursor < len(ls.text) {
+				ls.text = ls.text[:ls.cursor]
+			}
+		case n == 1:
+			for i := 0; i < ls.cursor && i < len(ls.text); i++ {
+				ls.text[i] = ' '
+			}
+		case n == 2:
+			ls.text = ls.text[:0]
+		}
+	}
+}
+
+// moveTo moves the cursor to the given column, which is limited to the end of
+// the line or maxSearchColumn, whichever is further.
+func (ls *lineScanner) moveTo(column int) {
+	limit := maxSearchColumn
+	if len(ls.text) > limit {
+		limit = len(ls.text)
+	}
+	if column > limit || column < 0 {
+		// Negative columns are from overflows.
+		column = limit
+	}
+	ls.cursor = column
+}
+
+// endLine emits the current line and begins the next.
+func (ls *lineScanner) endLine() {
+	ls.line++
+	ls.emit(string(ls.text), ls.offset, ls.line)
+	ls.text = ls.text[:0]
+	ls.cursor = 0
+	ls.started = false
+}
+
+// flush emits the last line if it was not ended.
+func (ls *lineScanner) flush() {
+	if ls.started && (len(ls.text) > 0 || len(ls.pending) > 0) {
+		ls.endLine()
+	}
+}
@@ -0,0 +1,125 @@
+package recorder
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSearchRecording creates a recording of the given events.
+func newSearchRecording(t *testing.T, events ...Event) *Recorder {
+	rec := NewRecorder()
+	for _, e := range events {
+		require.NoError(t, rec.sink.Append(e))
+	}
+	return rec
+}
+
+func TestRecorderSearch(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newSearchRecording(t,
+		Event{Offset: time.Second, Source: Stdout, Data: []byte("first\nrm: perm")},
+		Event{Offset: 2 * time.Second, Source: Stderr, Data: []byte("\x1b[31mPermission denied\x1b[0m\n")},
+		Event{Offset: 3 * time.Second, Source: Stdout, Data: []byte("ission denied\nlast\n")},
+		Event{Offset: 4 * time.Second, Source: Stdin, Data: []byte("permission denied\n")},
+	)
+	rec.recordingStart = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	matches, err := rec.Search(regexp.MustCompile(`(?i)permission denied`), &SearchOptions{Context: 1})
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 2, "unexpected number of matches")
+
+	assert.Equal(t, Match{
+		Recorder: rec,
+		Source:   Stdout,
+		Offset:   time.Second,
+		Time:     time.Date(2018, 6, 1, 12, 0, 1, 0, time.UTC),
+		Line:     2,
+		Text:     "rm: permission denied",
+		Start:    4,
+		End:      21,
+		Before:   []string{"first"},
+		After:    []string{"last"},
+	}, matches[0], "match split across events must be found")
+	assert.Equal(t, Stderr, matches[1].Source, "unexpected source")
+	assert.Equal(t, "Permission denied", matches[1].Text, "escape sequences must be left out")
+	assert.Equal(t, 1, matches[1].Line, "lines must be numbered in their stream")
+	assert.Empty(t, matches[1].Before)
+	assert.Empty(t, matches[1].After)
+
+	matches, err = rec.Search(regexp.MustCompile(regexp.QuoteMeta("permission denied")),
+		&SearchOptions{Sources: []Source{Stdin}})
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 1, "input must be searched if requested")
+	assert.Equal(t, Stdin, matches[0].Source)
+}
+
+func TestRecorderSearchTerminal(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newSearchRecording(t,
+		Event{Source: Stdout, Data: []byte("10%\r50%\r100%\n")},
+		Event{Source: Stdout, Data: []byte("abcdef\x1b[3D\x1b[Kxy\b\bz\n")},
+		Event{Source: Stdout, Data: []byte("\x1b[2Kdone\x1b[1G\x1b[CO\x1b[5G\x1b]0;title\x07 \xe2\x82")},
+		Event{Source: Stdout, Data: []byte("\xac")},
+	)
+	var lines []string
+	matches, err := rec.Search(regexp.MustCompile(`.*`), nil)
+	require.NoError(t, err, "unable to search")
+	for _, m := range matches {
+		if m.Start == 0 {
+			lines = append(lines, m.Text)
+		}
+	}
+	assert.Equal(t, []string{"100%", "abczy", "dOne €"}, lines, "lines must be as the terminal showed them")
+
+	matches, err = rec.Search(regexp.MustCompile(`50%`), nil)
+	require.NoError(t, err)
+	assert.Empty(t, matches, "overwritten text must not match")
+}
+
+func TestRecorderSearchCursorLimit(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := newSearchRecording(t,
+		Event{Source: Stdout, Data: []byte("\x1b[300000000Cx\n")},
+		Event{Source: Stdout, Data: []byte("a\x1b[9223372036854775807Cb\x1b[9223372036854775807Gc\n")},
+		Event{Source: Stdout, Data: []byte(strings.Repeat("y", maxSearchColumn+10) + "\x1b[5Cz\n")},
+	)
+	matches, err := rec.Search(regexp.MustCompile(`[xbcz]$`), nil)
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 3, "unexpected number of matches")
+	assert.Equal(t, maxSearchColumn, matches[0].Start, "cursor must be limited")
+	assert.Equal(t, "a"+strings.Repeat(" ", maxSearchColumn-1)+"bc", matches[1].Text,
+		"overflowing moves must be limited")
+	assert.Equal(t, maxSearchColumn+10, matches[2].Start, "moves must be limited to the end of long lines")
+}
+
+func TestSearch(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	a := newSearchRecording(t, Event{Source: Stdout, Data: []byte("ok\nerror: a\n")})
+	a.SetCommand("a")
+	b := newSearchRecording(t, Event{Source: Stderr, Data: []byte("error: b\nerror: c")})
+	b.SetCommand("b")
+
+	matches, err := Search([]*Recorder{a, b}, regexp.MustCompile(`error: (\w)`), &SearchOptions{Context: 2})
+	require.NoError(t, err, "unable to search")
+	require.Len(t, matches, 3, "unexpected number of matches")
+	for i, m := range matches {
+		assert.Equal(t, "error: "+string(rune('a'+i)), m.Text)
+	}
+	assert.Equal(t, a, matches[0].Recorder)
+	assert.Equal(t, []string{"ok"}, matches[0].Before)
+	assert.Empty(t, matches[0].After)
+	assert.Equal(t, b, matches[1].Recorder)
+	assert.Equal(t, []string{"error: c"}, matches[1].After, "matching lines must be context")
+	assert.Equal(t, []string{"error: b"}, matches[2].Before, "matching lines must be context")
+	assert.True(t, matches[0].Time.IsZero(), "time must be unknown without a start")
+}
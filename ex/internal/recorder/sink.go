@@ -0,0 +1,309 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	errors2 "errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source is the stream that recorded data came from.
+type Source uint8
+
+// Streams that data can be recorded from.
+const (
+	Stdout Source = iota
+	Stderr
+	Stdin
+)
+
+func (s Source) String() string {
+	switch s {
+	case Stdout:
+		return stdoutStream
+	case Stderr:
+		return stderrStream
+	case Stdin:
+		return stdinStream
+	default:
+		return "unknown"
+	}
+}
+
+// Event is data that was written to or read from a stream of a command.
+type Event struct {
+	// Offset is the time since the start of the recording.
+	Offset time.Duration
+	// Source is the stream of the data.
+	Source Source
+	// Data is the data that was written or read. It must not be modified.
+	Data []byte
+}
+
+// Sink stores the events of a recording.
+//
+// Sinks must be safe for concurrent use, as events may be read while a command
+// is still being recorded.
+type Sink interface {
+	// Append stores an event. The data of the event must not be retained
+	// after Append returns, so sinks that keep it must copy it.
+	Append(e Event) error
+	// Events calls fn with each stored event, in the order they were appended,
+	// stopping at the first error it returns. Events appended after Events is
+	// called are not included.
+	Events(fn func(Event) error) error
+}
+
+// MemorySink is a Sink that keeps every event in memory. It is the sink used by
+// recorders that are not given one.
+type MemorySink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+var _ Sink = &MemorySink{}
+
+// NewMemorySink returns a new MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Append stores an event.
+func (ms *MemorySink) Append(e Event) error {
+	e.Data = append([]byte(nil), e.Data...)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.events = append(ms.events, e)
+	return nil
+}
+
+// Events calls fn with each stored event.
+func (ms *MemorySink) Events(fn func(Event) error) error {
+	ms.mu.Lock()
+	events := ms.events
+	ms.mu.Unlock()
+
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RingSink is a Sink that keeps only the most recent events, so that the
+// memory used by the recordings of long running commands is bounded.
+type RingSink struct {
+	maxEvents, maxBytes int
+
+	mu      sync.Mutex
+	events  []Event
+	size    int
+	dropped int
+}
+
+var _ Sink = &RingSink{}
+
+// NewRingSink returns a RingSink that keeps at most the given number of events
+// and bytes of data. A limit that is 0 or less is not applied.
+//
+// Older events are dropped to stay within the limits. If the data of a single
+// event is larger than the limit on bytes, only its end is kept.
+func NewRingSink(maxEvents, maxBytes int) *RingSink {
+	return &RingSink{
+		maxEvents: maxEvents,
+		maxBytes:  maxBytes,
+	}
+}
+
+// Append stores an event, dropping older events as needed.
+func (rs *RingSink) Append(e Event) error {
+	if rs.maxBytes > 0 && len(e.Data) > rs.maxBytes {
+		e.Data = e.Data[len(e.Data)-rs.maxBytes:]
+	}
+	e.Data = append([]byte(nil), e.Data...)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.events = append(rs.events, e)
+	rs.size += len(e.Data)
+	for (rs.maxEvents > 0 && len(rs.events) > rs.maxEvents) ||
+		(rs.maxBytes > 0 && rs.size > rs.maxBytes) {
+		rs.size -= len(rs.events[0].Data)
+		// The dropped event is cleared so that its data can be collected
+		// before the slice is reallocated.
+		rs.events[0] = Event{}
+		rs.events = rs.events[1:]
+		rs.dropped++
+	}
+	return nil
+}
+
+// Events calls fn with each event that is kept.
+func (rs *RingSink) Events(fn func(Event) error) error {
+	rs.mu.Lock()
+	events := append([]Event(nil), rs.events...)
+	rs.mu.Unlock()
+
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dropped gets the number of events that have been dropped to stay within the
+// limits.
+func (rs *RingSink) Dropped() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.dropped
+}
+
+// fileSinkHeaderSize is the size of the header of each event in the log of a
+// FileSink: the offset, the source and the length of the data.
+const fileSinkHeaderSize = 8 + 1 + 4
+
+// ErrSinkClosed indicates that a sink was used after being closed.
+var ErrSinkClosed = errors2.New("sink closed")
+
+// FileSink is a Sink that appends events to a log file, so that the output of
+// commands does not need to be kept in memory.
+//
+// Each event is stored as its offset in nanoseconds, as a big-endian int64,
+// its source as a single byte and the length of its data as a big-endian
+// uint32, followed by the data.
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+	// size is the size of the complete events in the file.
+	size int64
+	// err is the error that stopped events from being appended, if any.
+	err error
+}
+
+var _ Sink = &FileSink{}
+
+// NewFileSink creates a FileSink that stores events in a log file at the given
+// path, replacing the file if it exists. The sink must be closed once it is no
+// longer needed.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create recording file")
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Append appends an event to the log file.
+//
+// If appending fails, the log file may be incomplete, so the error is also
+// returned for all later appends.
+func (fs *FileSink) Append(e Event) error {
+	if uint64(len(e.Data)) > 1<<32-1 {
+		return errors.New("event too large to record")
+	}
+	buf := make([]byte, fileSinkHeaderSize+len(e.Data))
+	binary.BigEndian.PutUint64(buf, uint64(e.Offset))
+	buf[8] = byte(e.Source)
+	binary.BigEndian.PutUint32(buf[9:], uint32(len(e.Data)))
+	copy(buf[fileSinkHeaderSize:], e.Data)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.err != nil {
+		return fs.err
+	}
+	if fs.f == nil {
+		return ErrSinkClosed
+	}
+	if _, err := fs.f.WriteAt(buf, fs.size); err != nil {
+		fs.err = errors.Wrap(err, "unable to append to recording file")
+		return fs.err
+	}
+	fs.size += int64(len(buf))
+	return nil
+}
+
+// readAt reads from the log file, which is only done while holding the lock so
+// that the file cannot be closed during the read.
+//
+// ErrSinkClosed is returned if the sink has been closed.
+func (fs *FileSink) readAt(p []byte, off int64) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return 0, ErrSinkClosed
+	}
+	return fs.f.ReadAt(p, off)
+}
+
+// readerAtFunc is a function that implements io.ReaderAt.
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (raf readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return raf(p, off)
+}
+
+// Events reads the events from the log file, calling fn with each of them.
+//
+// The lock is not held while fn is called, so that appending is not held up.
+// ErrSinkClosed is returned if the sink is closed before every event is read.
+func (fs *FileSink) Events(fn func(Event) error) error {
+	fs.mu.Lock()
+	closed, size := fs.f == nil, fs.size
+	fs.mu.Unlock()
+
+	if closed {
+		return ErrSinkClosed
+	}
+	r := bufio.NewReader(io.NewSectionReader(readerAtFunc(fs.readAt), 0, size))
+	var header [fileSinkHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err == ErrSinkClosed {
+			return err
+		} else if err != nil {
+			return errors.Wrap(err, "unable to read recording file")
+		}
+		e := Event{
+			Offset: time.Duration(binary.BigEndian.Uint64(header[:])),
+			Source: Source(header[8]),
+			Data:   make([]byte, binary.BigEndian.Uint32(header[9:])),
+		}
+		if _, err := io.ReadFull(r, e.Data); err == ErrSinkClosed {
+			return err
+		} else if err != nil {
+			return errors.Wrap(err, "unable to read recording file")
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the log file. The file is left in place.
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return ErrSinkClosed
+	}
+	err := fs.f.Close()
+	fs.f = nil
+	return errors.Wrap(err, "unable to close recording file")
+}
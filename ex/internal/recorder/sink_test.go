@@ -0,0 +1,152 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedEvents gets the events stored in the sink of a recorder.
+func recordedEvents(t *testing.T, rec *Recorder) []Event {
+	var events []Event
+	require.NoError(t, rec.Sink().Events(func(e Event) error {
+		events = append(events, e)
+		return nil
+	}), "unable to read events")
+	return events
+}
+
+// sinkEvents gets the events stored in a sink.
+func sinkEvents(t *testing.T, s Sink) []Event {
+	return recordedEvents(t, NewRecorderWithSink(s))
+}
+
+func TestMemorySink(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	s := NewMemorySink()
+	data := []byte("abc")
+	require.NoError(t, s.Append(Event{Offset: time.Second, Source: Stderr, Data: data}))
+	data[0] = 'x'
+	assert.Equal(t, []Event{{Offset: time.Second, Source: Stderr, Data: []byte("abc")}}, sinkEvents(t, s),
+		"appended data must be copied")
+
+	errStop := io.ErrUnexpectedEOF
+	require.NoError(t, s.Append(Event{Data: []byte("def")}))
+	var calls int
+	err := s.Events(func(Event) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err, "error must be returned")
+	assert.Equal(t, 1, calls, "events must stop at the first error")
+}
+
+func TestRingSink(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	s := NewRingSink(3, 0)
+	for _, d := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, s.Append(Event{Data: []byte(d)}))
+	}
+	var kept string
+	for _, e := range sinkEvents(t, s) {
+		kept += string(e.Data)
+	}
+	assert.Equal(t, "cde", kept, "only the last events must be kept")
+	assert.Equal(t, 2, s.Dropped(), "unexpected number of dropped events")
+
+	s = NewRingSink(0, 5)
+	for _, d := range []string{"abc", "de", "fg", "0123456789"} {
+		require.NoError(t, s.Append(Event{Data: []byte(d)}))
+		kept = ""
+		for _, e := range sinkEvents(t, s) {
+			kept += string(e.Data)
+		}
+		assert.True(t, len(kept) <= 5, "too many bytes kept: %q", kept)
+	}
+	assert.Equal(t, "56789", kept, "only the end of a large event must be kept")
+	assert.Equal(t, 3, s.Dropped(), "unexpected number of dropped events")
+}
+
+func TestFileSink(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "sink")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(filepath.Join(dir, "log"))
+	require.NoError(t, err, "unable to create sink")
+
+	rec := NewRecorderWithSink(s)
+	rec.SetTerm("xterm", 24, 80)
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+	buf := []byte("out\n")
+	stdoutWriter.Write(buf)
+	copy(buf, "bad!")
+	stderrWriter.Write([]byte("err\n"))
+	_, err = ioutil.ReadAll(rec.RecordInput(bytes.NewBufferString("in\n"), nil))
+	require.NoError(t, err)
+
+	events := recordedEvents(t, rec)
+	require.Len(t, events, 3, "unexpected number of events")
+	assert.Equal(t, "out\n", string(events[0].Data), "recorded data must not change")
+	assert.Equal(t, Stderr, events[1].Source)
+	assert.Equal(t, Stdin, events[2].Source)
+	for i := 1; i < len(events); i++ {
+		assert.True(t, events[i].Offset >= events[i-1].Offset, "events must be in order")
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(out, out, 0), "unable to replay from file")
+	assert.Equal(t, "out\nerr\n", out.String(), "unexpected replayed output")
+	saved := &bytes.Buffer{}
+	require.NoError(t, rec.Save(saved), "unable to save from file")
+	loaded, err := Load(saved)
+	require.NoError(t, err, "unable to load recording")
+	assert.Equal(t, events, recordedEvents(t, loaded), "unexpected loaded events")
+
+	require.NoError(t, s.Close(), "unable to close sink")
+	assert.Equal(t, ErrSinkClosed, s.Append(Event{}), "closed sink must not be appended to")
+	assert.Equal(t, ErrSinkClosed, rec.Replay(out, out, 0), "closed sink must not be read")
+	fi, err := os.Stat(filepath.Join(dir, "log"))
+	require.NoError(t, err, "log file must be kept")
+	assert.EqualValues(t, 3*fileSinkHeaderSize+4+4+3, fi.Size(), "unexpected log size")
+}
+
+func TestFileSinkCloseWhileReading(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "sink")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(filepath.Join(dir, "log"))
+	require.NoError(t, err, "unable to create sink")
+
+	// The events are larger than the buffer used for reading, so the file is
+	// read again after the first event.
+	data := bytes.Repeat([]byte("x"), 8192)
+	require.NoError(t, s.Append(Event{Source: Stdout, Data: data}))
+	require.NoError(t, s.Append(Event{Source: Stdout, Data: data}))
+
+	var read int
+	err = s.Events(func(e Event) error {
+		read++
+		assert.Equal(t, data, e.Data, "unexpected event data")
+		return s.Close()
+	})
+	assert.Equal(t, ErrSinkClosed, err, "sink closed while reading must not be read")
+	assert.Equal(t, 1, read, "unexpected number of events read")
+}
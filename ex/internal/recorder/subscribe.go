@@ -0,0 +1,184 @@
+package recorder
+
+import (
+	"context"
+	errors2 "errors"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// maxSubscriptionQueue is the most events recorded after subscribing that
+// may be waiting to be read by a subscription.
+const maxSubscriptionQueue = 16 * 1024
+
+// ErrSubscriptionOverflow indicates that a subscription was closed because its
+// events were not read quickly enough.
+var ErrSubscriptionOverflow = errors2.New("subscription overflowed")
+
+// Subscription follows the output and the input of a command as it is
+// recorded.
+//
+// Events are queued for the subscription as they are recorded, so that a slow
+// subscriber does not hold up the command. A subscriber that falls too far
+// behind is closed, with ErrSubscriptionOverflow returned by Next. A
+// subscription must be closed once it is no longer needed.
+type Subscription struct {
+	r *Recorder
+	// queue is the events that have not been read yet, the first backlog of
+	// which were recorded before subscribing. It, closed and err are
+	// protected by the writeMu of the recorder.
+	queue   []Event
+	backlog int
+	closed  bool
+	// err is the error that the subscription was closed with, if any.
+	err error
+}
+
+// Subscribe begins following the events of the recording. If fromStart is
+// true, the events that were recorded before the call are given first, as far
+// as they are kept by the sink. Otherwise, only events recorded after the call
+// are given.
+//
+// Any number of subscriptions may be made, including after the command has
+// finished. An error is only returned if the events could not be read from the
+// sink.
+func (r *Recorder) Subscribe(fromStart bool) (*Subscription, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	sub := &Subscription{r: r}
+	if fromStart {
+		// The sink cannot be appended to while writeMu is held, so no events
+		// are missed or given twice.
+		err := r.sink.Events(func(e Event) error {
+			sub.queue = append(sub.queue, e)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read recorded events")
+		}
+		// The earlier events are kept by the sink regardless, so they do not
+		// count towards the limit of the queue.
+		sub.backlog = len(sub.queue)
+	}
+	if r.subscriptions == nil {
+		r.subscriptions = make(map[*Subscription]struct{})
+	}
+	r.subscriptions[sub] = struct{}{}
+	return sub, nil
+}
+
+// Next gets the next event, waiting for one to be recorded if there is none.
+//
+// io.EOF is returned once the recording has finished and every event has been
+// given, or if the subscription has been closed. ErrSubscriptionOverflow is
+// returned if the subscription was closed for falling too far behind.
+func (s *Subscription) Next(ctx context.Context) (Event, error) {
+	for {
+		s.r.writeMu.Lock()
+		if len(s.queue) > 0 {
+			e := s.queue[0]
+			s.queue[0] = Event{}
+			s.queue = s.queue[1:]
+			if s.backlog > 0 {
+				s.backlog--
+			}
+			s.r.writeMu.Unlock()
+			return e, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.r.writeMu.Unlock()
+			return Event{}, err
+		}
+		if s.closed || s.r.finished {
+			s.r.writeMu.Unlock()
+			return Event{}, io.EOF
+		}
+		notifier := s.r.notifier()
+		s.r.writeMu.Unlock()
+
+		select {
+		case <-notifier:
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		}
+	}
+}
+
+// Close stops following the recording. Waiting calls to Next return io.EOF.
+func (s *Subscription) Close() {
+	s.r.writeMu.Lock()
+	defer s.r.writeMu.Unlock()
+
+	s.close(nil)
+}
+
+// close closes the subscription with the given error, which is nil for
+// subscriptions closed by the subscriber. writeMu must be held.
+func (s *Subscription) close(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	s.queue = nil
+	s.backlog = 0
+	delete(s.r.subscriptions, s)
+	s.r.notify()
+}
+
+// Finish marks the recording as finished, after which subscriptions end once
+// they have given the events that were recorded.
+func (r *Recorder) Finish() {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.finished = true
+	r.notify()
+}
+
+// Finished reports whether the recording has finished.
+func (r *Recorder) Finished() bool {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	return r.finished
+}
+
+// publish queues an event for each subscription. writeMu must be held.
+func (r *Recorder) publish(e Event) {
+	if len(r.subscriptions) == 0 {
+		return
+	}
+	// The data may be reused by the writer, and is shared between the
+	// subscriptions.
+	e.Data = append([]byte(nil), e.Data...)
+	for sub := range r.subscriptions {
+		if len(sub.queue)-sub.backlog >= maxSubscriptionQueue {
+			sub.close(ErrSubscriptionOverflow)
+			continue
+		}
+		sub.queue = append(sub.queue, e)
+	}
+	r.notify()
+}
+
+// notifier gets the channel that is closed when there are changes for
+// subscriptions. writeMu must be held.
+func (r *Recorder) notifier() <-chan struct{} {
+	if r.eventNotifier == nil {
+		r.eventNotifier = make(chan struct{})
+	}
+	return r.eventNotifier
+}
+
+// notify wakes the subscriptions that are waiting for changes. writeMu must be
+// held.
+func (r *Recorder) notify() {
+	if r.eventNotifier != nil {
+		close(r.eventNotifier)
+		r.eventNotifier = nil
+	}
+}
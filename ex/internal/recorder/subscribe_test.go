@@ -0,0 +1,132 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderSubscribe(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rec := NewRecorder()
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+	stdoutWriter.Write([]byte("early\n"))
+
+	fromStart, err := rec.Subscribe(true)
+	require.NoError(t, err, "unable to subscribe")
+	defer fromStart.Close()
+	fromNow, err := rec.Subscribe(false)
+	require.NoError(t, err, "unable to subscribe")
+	defer fromNow.Close()
+
+	e, err := fromStart.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "early\n", string(e.Data), "earlier events must be given from the start")
+
+	// Events written while waiting must wake the subscription.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		buf := []byte("late\n")
+		stderrWriter.Write(buf)
+		copy(buf, "bad!\n")
+		rec.Finish()
+	}()
+	for _, sub := range []*Subscription{fromNow, fromStart} {
+		e, err = sub.Next(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, Stderr, e.Source, "unexpected source")
+		assert.Equal(t, "late\n", string(e.Data), "subscribed data must not change")
+		assert.True(t, e.Offset >= 20*time.Millisecond, "unexpected offset")
+		_, err = sub.Next(ctx)
+		assert.Equal(t, io.EOF, err, "finished recording must end subscriptions")
+	}
+
+	sub, err := rec.Subscribe(true)
+	require.NoError(t, err, "unable to subscribe to finished recording")
+	var replayed bytes.Buffer
+	for {
+		e, err := sub.Next(ctx)
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		replayed.Write(e.Data)
+	}
+	assert.Equal(t, "early\nlate\n", replayed.String(), "unexpected events after finishing")
+	sub.Close()
+}
+
+func TestRecorderSubscriptionClose(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	rec := NewRecorder()
+	sub, err := rec.Subscribe(false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = sub.Next(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "waiting must stop with the context")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sub.Close()
+	}()
+	_, err = sub.Next(context.Background())
+	assert.Equal(t, io.EOF, err, "closed subscription must end")
+	assert.Empty(t, rec.subscriptions, "closed subscription must be removed")
+	sub.Close()
+}
+
+func TestRecorderSubscriptionOverflow(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rec := NewRecorder()
+	var stdoutWriter, stderrWriter io.Writer
+	rec.SetOutput(&stdoutWriter, &stderrWriter)
+	rec.StartTiming()
+	for i := 0; i < maxSubscriptionQueue; i++ {
+		stdoutWriter.Write([]byte("x"))
+	}
+
+	// Earlier events do not count towards the limit.
+	fromStart, err := rec.Subscribe(true)
+	require.NoError(t, err, "unable to subscribe")
+	defer fromStart.Close()
+	fromNow, err := rec.Subscribe(false)
+	require.NoError(t, err, "unable to subscribe")
+	defer fromNow.Close()
+	for i := 0; i < maxSubscriptionQueue; i++ {
+		stdoutWriter.Write([]byte("y"))
+	}
+	_, err = fromStart.Next(ctx)
+	require.NoError(t, err)
+	_, err = fromNow.Next(ctx)
+	require.NoError(t, err)
+
+	// Both subscriptions have room for one more event.
+	stdoutWriter.Write([]byte("z"))
+	stdoutWriter.Write([]byte("z"))
+	for _, sub := range []*Subscription{fromStart, fromNow} {
+		_, err = sub.Next(ctx)
+		assert.Equal(t, ErrSubscriptionOverflow, err, "subscription must overflow")
+		_, err = sub.Next(ctx)
+		assert.Equal(t, ErrSubscriptionOverflow, err, "overflowed subscription must stay closed")
+	}
+	assert.Empty(t, rec.subscriptions, "overflowed subscriptions must be removed")
+}
@@ -227,6 +227,25 @@ func SendSignal(s Signal) {
 	sigC <- s
 }
 
+// RaiseDefault sends the given signal to this process with its default
+// behaviour, as if it were not being handled. For most signals, this ends the
+// process.
+//
+// The signal is no longer handled afterwards, until signal handling is begun
+// again.
+func RaiseDefault(s Signal) error {
+	osSig, ok := sigToOSSig[s]
+	if !ok {
+		return errors.New("unknown signal")
+	}
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	signal.Reset(osSig)
+	return p.Signal(osSig)
+}
+
 // StopSignalHandling will stop handling signals.
 //
 // Will block forever if signals are not being handled.
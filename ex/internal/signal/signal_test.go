@@ -2,6 +2,7 @@ package signal_test
 
 import (
 	"os"
+	"os/exec"
 	"syscall"
 	"testing"
 	"time"
@@ -140,3 +141,24 @@ func TestSignalBeginHandlingTwiceError(t *testing.T) {
 	require.EqualError(t, err, signal.ErrHandlersAlreadySet.Error(),
 		"unexpected error from starting signal handling")
 }
+
+func TestRaiseDefault(t *testing.T) {
+	if os.Getenv("EX_TEST_RAISE_DEFAULT") != "" {
+		// Running as the process that raises the signal.
+		logger, _ := testlogger.NewTestLogger(t, log.Warn)
+		require.NoError(t, signal.BeginSignalHandling(logger, nil))
+		require.NoError(t, signal.RaiseDefault(signal.SIGTERM))
+		time.Sleep(10 * time.Second)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRaiseDefault$")
+	cmd.Env = append(os.Environ(), "EX_TEST_RAISE_DEFAULT=1")
+	err := cmd.Run()
+	ee, ok := err.(*exec.ExitError)
+	require.True(t, ok, "process must not exit successfully: %v", err)
+	status, ok := ee.Sys().(syscall.WaitStatus)
+	require.True(t, ok, "unexpected exit status")
+	assert.True(t, status.Signaled(), "process must be ended by the signal")
+	assert.Equal(t, syscall.SIGTERM, status.Signal(), "unexpected signal")
+}
@@ -0,0 +1,258 @@
+// Package sshconfig provides support for reading OpenSSH client configuration
+// files, as described in ssh_config(5).
+package sshconfig
+
+import (
+	"bufio"
+	errors2 "errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxIncludeDepth is the maximum nesting of Include directives, which is the
+// same as the limit of ssh(1).
+const maxIncludeDepth = 16
+
+// ErrIncludeDepth indicates that Include directives were nested too deeply,
+// which is likely due to a file including itself.
+var ErrIncludeDepth = errors2.New("too many nested Include directives")
+
+// Config is a parsed ssh_config file, including any files that it includes.
+type Config struct {
+	blocks []*block
+}
+
+// block is the options following a Host or Match line, or the options at the
+// start of a file.
+type block struct {
+	// cond is the condition for the options of the block to apply. It is nil
+	// for the options at the start of a file.
+	cond *condition
+	// items are the options and includes of the block, in order.
+	items []item
+}
+
+// item is either a single option or the contents of included files.
+type item struct {
+	opt     *option
+	include []*block
+}
+
+// option is a single keyword and its arguments.
+type option struct {
+	// key is the lower case keyword.
+	key  string
+	args []string
+
+	filename string
+	line     int
+}
+
+// Load reads the ssh_config file at the given path.
+//
+// Relative paths in Include directives are resolved against the directory of
+// the file, which matches the behaviour of ssh(1) for ~/.ssh/config and
+// /etc/ssh/ssh_config.
+func Load(path string) (*Config, error) {
+	p := &parser{baseDir: filepath.Dir(path)}
+	blocks, err := p.parseFile(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{blocks: blocks}, nil
+}
+
+// Parse reads an ssh_config file from the given reader.
+//
+// The name is used in error messages. Relative paths in Include directives are
+// resolved against baseDir.
+func Parse(r io.Reader, name, baseDir string) (*Config, error) {
+	p := &parser{baseDir: baseDir}
+	blocks, err := p.parse(r, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{blocks: blocks}, nil
+}
+
+// parser parses ssh_config files.
+type parser struct {
+	baseDir string
+}
+
+// parseFile parses the file at the given path.
+func (p *parser) parseFile(path string, depth int) ([]*block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open ssh_config file")
+	}
+	defer f.Close()
+
+	return p.parse(f, path, depth)
+}
+
+// parse parses the contents of a single file.
+func (p *parser) parse(r io.Reader, name string, depth int) ([]*block, error) {
+	current := &block{}
+	blocks := []*block{current}
+
+	s := bufio.NewScanner(r)
+	var lineNum int
+	for s.Scan() {
+		lineNum++
+		key, args, err := splitLine(s.Text())
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", name, lineNum)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			if len(args) == 0 {
+				return nil, errors.Errorf("%s:%d: Host requires at least one pattern", name, lineNum)
+			}
+			current = &block{cond: &condition{hosts: args}}
+			blocks = append(blocks, current)
+		case "match":
+			criteria, err := parseCriteria(args)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", name, lineNum)
+			}
+			current = &block{cond: &condition{criteria: criteria}}
+			blocks = append(blocks, current)
+		case "include":
+			if len(args) == 0 {
+				return nil, errors.Errorf("%s:%d: Include requires at least one path", name, lineNum)
+			}
+			included, err := p.include(args, depth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", name, lineNum)
+			}
+			current.items = append(current.items, item{include: included})
+		default:
+			if len(args) == 0 {
+				return nil, errors.Errorf("%s:%d: missing argument for %s", name, lineNum, key)
+			}
+			current.items = append(current.items, item{opt: &option{
+				key:      key,
+				args:     args,
+				filename: name,
+				line:     lineNum,
+			}})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read ssh_config file")
+	}
+
+	return blocks, nil
+}
+
+// include parses the files matching the given Include arguments.
+//
+// Patterns that do not match any files are ignored, as with ssh(1).
+func (p *parser) include(patterns []string, depth int) ([]*block, error) {
+	if depth+1 > maxIncludeDepth {
+		return nil, ErrIncludeDepth
+	}
+
+	var blocks []*block
+	for _, pattern := range patterns {
+		pattern = expandHome(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(p.baseDir, pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid Include pattern")
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			included, err := p.parseFile(path, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, included...)
+		}
+	}
+	return blocks, nil
+}
+
+// splitLine splits a line into its lower case keyword and its arguments.
+//
+// The keyword may be separated from the arguments by whitespace or a single
+// "=". Arguments may be quoted with double quotes to include whitespace.
+// An empty keyword is returned for blank lines and comments.
+func splitLine(line string) (key string, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	key = strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+
+	args, err = splitArgs(rest)
+	return key, args, err
+}
+
+// splitArgs splits whitespace separated arguments, which may be quoted.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var inArg, inQuotes bool
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case !inQuotes && r == '#' && !inArg:
+			// The rest of the line is a comment.
+			return args, nil
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quoted argument")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// expandHome replaces a leading "~" with the home directory of the current
+// user.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	u, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(u.HomeDir, path[1:])
+}
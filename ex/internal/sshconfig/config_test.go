@@ -0,0 +1,110 @@
+package sshconfig_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolve parses the given configuration and resolves the alias with it.
+func resolve(t *testing.T, config, alias string) *sshconfig.Host {
+	c, err := sshconfig.Parse(strings.NewReader(config), "config", "")
+	require.NoError(t, err, "unable to parse config")
+	h, err := sshconfig.Resolve(alias, c)
+	require.NoError(t, err, "unable to resolve host")
+	return h
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	config := `
+# Comment
+User = "first user"
+port 2222 # Trailing comment
+
+Host web
+	HostName=web.example.com
+`
+	h := resolve(t, config, "web")
+	assert.Equal(t, "first user", h.User(), "unexpected quoted user")
+	port, err := h.Port()
+	require.NoError(t, err, "unexpected error for port")
+	assert.EqualValues(t, 2222, port, "unexpected port")
+	assert.Equal(t, "web.example.com", h.Hostname(), "unexpected host name")
+
+	tcs := []struct {
+		Name   string
+		Config string
+	}{
+		{Name: "Unterminated Quote", Config: `User "test`},
+		{Name: "Missing Argument", Config: "User"},
+		{Name: "Empty Host", Config: "Host"},
+		{Name: "Empty Match", Config: "Match"},
+		{Name: "Missing Match Argument", Config: "Match host"},
+		{Name: "Empty Include", Config: "Include"},
+	}
+	for _, tCase := range tcs {
+		tc := tCase
+		t.Run(tc.Name, func(t2 *testing.T) {
+			t2.Parallel()
+			_, err := sshconfig.Parse(strings.NewReader(tc.Config), "config", "")
+			assert.Error(t2, err, "expected parse error")
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh_config")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		return path
+	}
+
+	write("config.d/10-web", "Host web\n\tHostName web.example.com\n")
+	write("config.d/20-db", "Host db\n\tHostName db.example.com\n")
+	write("work", "User worker\nIdentityFile ~/.ssh/work\n")
+	write("loop", "Include loop\n")
+	config := write("config", strings.Join([]string{
+		"Include config.d/*",
+		"Host *.corp",
+		"\tInclude " + filepath.Join(dir, "work"),
+		"Host *",
+		"\tUser default",
+	}, "\n"))
+
+	c, err := sshconfig.Load(config)
+	require.NoError(t, err, "unable to load config")
+
+	h, err := sshconfig.Resolve("web", c)
+	require.NoError(t, err, "unable to resolve host")
+	assert.Equal(t, "web.example.com", h.Hostname(), "unexpected host name from included file")
+	assert.Equal(t, "default", h.User(), "unexpected user")
+
+	h, err = sshconfig.Resolve("db", c)
+	require.NoError(t, err, "unable to resolve host")
+	assert.Equal(t, "db.example.com", h.Hostname(), "unexpected host name from included file")
+
+	// Includes within Host blocks only apply when the block matches.
+	h, err = sshconfig.Resolve("build.corp", c)
+	require.NoError(t, err, "unable to resolve host")
+	assert.Equal(t, "worker", h.User(), "unexpected user from included file")
+	assert.Equal(t, []string{"~/.ssh/work"}, h.GetAll("IdentityFile"), "unexpected identity files")
+
+	_, err = sshconfig.Load(filepath.Join(dir, "loop"))
+	assert.Equal(t, sshconfig.ErrIncludeDepth, errors.Cause(err), "unexpected error for recursive include")
+}
@@ -0,0 +1,301 @@
+package sshconfig
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+)
+
+// accumulatingKeys are the keywords for which every directive is used, rather
+// than only the first.
+var accumulatingKeys = map[string]bool{
+	"certificatefile": true,
+	"dynamicforward":  true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"sendenv":         true,
+}
+
+// condition is the condition of a Host or Match block.
+type condition struct {
+	// hosts are the patterns of a Host line.
+	hosts []string
+	// criteria are the criteria of a Match line.
+	criteria []criterion
+}
+
+// criterion is a single criterion of a Match line.
+type criterion struct {
+	negated  bool
+	keyword  string
+	patterns []string
+}
+
+// parseCriteria parses the arguments of a Match line.
+func parseCriteria(args []string) ([]criterion, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Match requires at least one criterion")
+	}
+
+	var criteria []criterion
+	for i := 0; i < len(args); i++ {
+		c := criterion{keyword: strings.ToLower(args[i])}
+		if strings.HasPrefix(c.keyword, "!") {
+			c.negated = true
+			c.keyword = c.keyword[1:]
+		}
+
+		switch c.keyword {
+		case "all", "canonical", "final":
+		default:
+			if i+1 == len(args) {
+				return nil, errors.Errorf("missing argument for Match %s", c.keyword)
+			}
+			i++
+			c.patterns = strings.Split(args[i], ",")
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria, nil
+}
+
+// Host is the resolved configuration for a host.
+type Host struct {
+	// Alias is the name of the host as given to Resolve.
+	Alias string
+
+	localUser string
+	homeDir   string
+
+	// options are the arguments of each of the applied directives, by lower
+	// case keyword.
+	options map[string][][]string
+}
+
+// Resolve resolves the configuration for the given host alias, applying the
+// configuration files in order.
+//
+// As with ssh(1), the first value obtained for each option is used, apart from
+// options such as IdentityFile that may be given multiple times.
+//
+// "Match exec", and other Match criteria that depend on the local system,
+// are not supported. An error is returned if one of them needs to be
+// evaluated to resolve the host.
+func Resolve(alias string, configs ...*Config) (*Host, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get local user")
+	}
+
+	r := &resolver{host: &Host{
+		Alias:     alias,
+		localUser: u.Username,
+		homeDir:   u.HomeDir,
+		options:   make(map[string][][]string),
+	}}
+	for _, c := range configs {
+		if err = r.apply(c.blocks); err != nil {
+			return nil, err
+		}
+	}
+
+	// As with ssh(1), the configuration is applied a second time if any block
+	// depends on it being the final pass.
+	if r.sawFinal {
+		r.final = true
+		for _, c := range configs {
+			if err = r.apply(c.blocks); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return r.host, nil
+}
+
+// resolver applies configuration blocks to a host.
+type resolver struct {
+	host *Host
+
+	// final indicates that this is the final pass over the configuration.
+	final bool
+	// sawFinal indicates that a "Match final" or "Match canonical" block was
+	// seen.
+	sawFinal bool
+}
+
+// apply applies the options of the matching blocks.
+func (r *resolver) apply(blocks []*block) error {
+	for _, b := range blocks {
+		ok, err := r.matches(b.cond)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		for _, it := range b.items {
+			if it.include != nil {
+				if err = r.apply(it.include); err != nil {
+					return err
+				}
+				continue
+			}
+			r.set(it.opt)
+		}
+	}
+	return nil
+}
+
+// set applies a single option.
+func (r *resolver) set(opt *option) {
+	existing := r.host.options[opt.key]
+	if !accumulatingKeys[opt.key] {
+		if existing == nil {
+			r.host.options[opt.key] = [][]string{opt.args}
+		}
+		return
+	}
+
+	// The same directive may be applied again in the final pass.
+	for _, v := range existing {
+		if strings.Join(v, " ") == strings.Join(opt.args, " ") {
+			return
+		}
+	}
+	r.host.options[opt.key] = append(existing, opt.args)
+}
+
+// matches reports whether the condition applies to the host.
+func (r *resolver) matches(cond *condition) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+	if cond.criteria == nil {
+		return sshtarget.MatchHostPatterns(cond.hosts, r.host.Alias), nil
+	}
+
+	for _, c := range cond.criteria {
+		var matched bool
+		switch c.keyword {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			r.sawFinal = true
+			matched = r.final
+		case "host":
+			matched = sshtarget.MatchHostPatterns(c.patterns, r.host.Hostname())
+		case "originalhost":
+			matched = sshtarget.MatchHostPatterns(c.patterns, r.host.Alias)
+		case "user":
+			matched = sshtarget.MatchHostPatterns(c.patterns, r.host.User())
+		case "localuser":
+			matched = sshtarget.MatchHostPatterns(c.patterns, r.host.localUser)
+		default:
+			return false, errors.Errorf("Match %s is not supported", c.keyword)
+		}
+		if matched == c.negated {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Get returns the first argument of the option with the given keyword, or an
+// empty string if it is not set.
+func (h *Host) Get(key string) string {
+	if v := h.options[strings.ToLower(key)]; len(v) > 0 {
+		return v[0][0]
+	}
+	return ""
+}
+
+// Args returns all of the arguments of the option with the given keyword.
+func (h *Host) Args(key string) []string {
+	if v := h.options[strings.ToLower(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return nil
+}
+
+// GetAll returns the first argument of every directive for the option with the
+// given keyword, for options such as IdentityFile that may be given multiple
+// times.
+func (h *Host) GetAll(key string) []string {
+	var values []string
+	for _, v := range h.options[strings.ToLower(key)] {
+		values = append(values, v[0])
+	}
+	return values
+}
+
+// Hostname returns the host name to connect to, which is the alias if
+// HostName is not set.
+func (h *Host) Hostname() string {
+	hostname := h.Get("hostname")
+	if hostname == "" {
+		return h.Alias
+	}
+	return strings.Replace(hostname, "%h", h.Alias, -1)
+}
+
+// Port returns the port to connect to, which is 22 if Port is not set.
+func (h *Host) Port() (uint16, error) {
+	port := h.Get("port")
+	if port == "" {
+		return 22, nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid port %q", port)
+	}
+	return uint16(p), nil
+}
+
+// User returns the user to log in as, which is the local user if User is not
+// set.
+func (h *Host) User() string {
+	if u := h.Get("user"); u != "" {
+		return u
+	}
+	return h.localUser
+}
+
+// ExpandPath expands a leading "~" and the tokens described in the TOKENS
+// section of ssh_config(5) in a path.
+//
+// The supported tokens are %%, %d, %h, %n, %p, %r, and %u.
+func (h *Host) ExpandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = filepath.Join(h.homeDir, path[1:])
+	}
+
+	port, err := h.Port()
+	if err != nil {
+		port = 22
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", h.homeDir,
+		"%h", h.Hostname(),
+		"%n", h.Alias,
+		"%p", strconv.Itoa(int(port)),
+		"%r", h.User(),
+		"%u", h.localUser,
+	).Replace(path)
+}
+
+// ExpandPaths expands all of the paths with ExpandPath.
+func (h *Host) ExpandPaths(paths []string) []string {
+	expanded := make([]string, len(paths))
+	for i, p := range paths {
+		expanded[i] = h.ExpandPath(p)
+	}
+	return expanded
+}
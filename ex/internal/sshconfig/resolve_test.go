@@ -0,0 +1,127 @@
+package sshconfig_test
+
+import (
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rwool/ex/ex/internal/sshconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	config := `
+Host bastion
+	HostName bastion.example.com
+	User jump
+
+Host *.example.com !secret.example.com
+	User ops
+	IdentityFile ~/.ssh/ops
+
+Host web*
+	HostName %h.example.com
+	Port 2200
+	IdentityFile ~/.ssh/web
+
+Host *
+	User fallback
+	Port 22
+	IdentityFile ~/.ssh/id_ed25519
+	UserKnownHostsFile ~/.ssh/known_hosts /tmp/%n_%r@%h:%p
+`
+
+	t.Run("First Value Wins", func(t2 *testing.T) {
+		h := resolve(t2, config, "bastion")
+		assert.Equal(t2, "bastion.example.com", h.Hostname(), "unexpected host name")
+		assert.Equal(t2, "jump", h.User(), "unexpected user")
+		assert.Equal(t2, []string{"~/.ssh/id_ed25519"}, h.GetAll("identityfile"), "unexpected identity files")
+	})
+
+	t.Run("Host Name Token", func(t2 *testing.T) {
+		h := resolve(t2, config, "web1")
+		assert.Equal(t2, "web1.example.com", h.Hostname(), "unexpected host name")
+		port, err := h.Port()
+		require.NoError(t2, err, "unexpected error for port")
+		assert.EqualValues(t2, 2200, port, "unexpected port")
+		assert.Equal(t2, "fallback", h.User(), "unexpected user")
+		assert.Equal(t2, []string{"~/.ssh/web", "~/.ssh/id_ed25519"}, h.GetAll("IdentityFile"),
+			"identity files must accumulate")
+	})
+
+	t.Run("Negated Pattern", func(t2 *testing.T) {
+		assert.Equal(t2, "ops", resolve(t2, config, "db.example.com").User(), "unexpected user")
+		assert.Equal(t2, "fallback", resolve(t2, config, "secret.example.com").User(),
+			"negated pattern must not match")
+	})
+
+	t.Run("Expand Path", func(t2 *testing.T) {
+		u, err := user.Current()
+		require.NoError(t2, err, "unable to get current user")
+
+		h := resolve(t2, config, "web1")
+		paths := h.ExpandPaths(h.Args("UserKnownHostsFile"))
+		assert.Equal(t2, []string{
+			filepath.Join(u.HomeDir, ".ssh", "known_hosts"),
+			"/tmp/web1_fallback@web1.example.com:2200",
+		}, paths, "unexpected expanded paths")
+		assert.Equal(t2, "100%", h.ExpandPath("100%%"), "unexpected escaped percent")
+	})
+
+	t.Run("Unset", func(t2 *testing.T) {
+		h := resolve(t2, "", "host")
+		assert.Equal(t2, "host", h.Hostname(), "alias must be used as the host name")
+		port, err := h.Port()
+		require.NoError(t2, err, "unexpected error for port")
+		assert.EqualValues(t2, 22, port, "unexpected default port")
+		assert.Empty(t2, h.Get("IdentityFile"), "unexpected identity file")
+		assert.Nil(t2, h.Args("UserKnownHostsFile"), "unexpected known_hosts files")
+	})
+}
+
+func TestResolveMatch(t *testing.T) {
+	t.Parallel()
+
+	u, err := user.Current()
+	require.NoError(t, err, "unable to get current user")
+
+	config := strings.Join([]string{
+		"Host db",
+		"\tHostName db.internal",
+		"Match host *.internal !user root",
+		"\tPort 2022",
+		"Match originalhost db",
+		"\tUser dba",
+		"Match localuser " + u.Username,
+		"\tIdentityFile ~/.ssh/local",
+		"Match final host db.internal",
+		"\tHashKnownHosts yes",
+		"Match all",
+		"\tCompression yes",
+	}, "\n")
+
+	h := resolve(t, config, "db")
+	port, err := h.Port()
+	require.NoError(t, err, "unexpected error for port")
+	assert.EqualValues(t, 2022, port, "Match host must use the host name")
+	assert.Equal(t, "dba", h.User(), "Match originalhost must use the alias")
+	assert.Equal(t, []string{"~/.ssh/local"}, h.GetAll("IdentityFile"),
+		"identity files must not be duplicated by the final pass")
+	assert.Equal(t, "yes", h.Get("HashKnownHosts"), "Match final must apply on the final pass")
+	assert.Equal(t, "yes", h.Get("Compression"), "Match all must apply")
+
+	h = resolve(t, config, "other")
+	assert.Empty(t, h.Get("Port"), "unexpected port for other host")
+	assert.Empty(t, h.Get("HashKnownHosts"), "unexpected final pass option")
+
+	c, err := sshconfig.Parse(strings.NewReader("Match host db exec \"true\"\n\tUser x"), "config", "")
+	require.NoError(t, err, "unable to parse config")
+	_, err = sshconfig.Resolve("db", c)
+	assert.Error(t, err, "Match exec must not be supported")
+	_, err = sshconfig.Resolve("web", c)
+	assert.NoError(t, err, "unsupported criteria must only be evaluated when needed")
+}
@@ -0,0 +1,52 @@
+package sshtarget
+
+import (
+	errors2 "errors"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoAgent indicates that no SSH agent socket was given and SSH_AUTH_SOCK is
+// not set.
+var ErrNoAgent = errors2.New("SSH_AUTH_SOCK not set")
+
+// DialAgent connects to the SSH agent listening on the given Unix socket.
+//
+// If the socket path is empty, then the path in SSH_AUTH_SOCK is used.
+// The returned connection should be closed when the agent is no longer needed.
+func DialAgent(socketPath string) (net.Conn, error) {
+	if socketPath == "" {
+		socketPath = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socketPath == "" {
+		return nil, ErrNoAgent
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to SSH agent")
+	}
+	return conn, nil
+}
+
+// agentForwarding is the option for forwarding an agent to the sessions of an
+// SSHTarget.
+type agentForwarding struct {
+	agent agent.Agent
+}
+
+// AgentForwardingOption returns an option to forward the given agent to all of
+// the sessions created with an SSHTarget.
+//
+// Forwarding gives the remote system the ability to use the keys in the agent
+// for as long as a session is open, so it should only be enabled for trusted
+// systems.
+func AgentForwardingOption(a agent.Agent) Option {
+	if a == nil {
+		panic("nil agent")
+	}
+	return agentForwarding{agent: a}
+}
@@ -0,0 +1,139 @@
+package sshtarget_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves the given agent on a Unix socket in a temporary directory,
+// returning the path of the socket.
+func serveAgent(t *testing.T, a agent.Agent) (socketPath string, stop func()) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err, "unable to create temporary directory")
+	socketPath = filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", socketPath)
+	require.NoError(t, err, "unable to listen on agent socket")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.Close()
+				agent.ServeAgent(a, c)
+			}()
+		}
+	}()
+
+	return socketPath, func() {
+		l.Close()
+		wg.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	key := newPrivateKey(t, "ed25519")
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}), "unable to add key to agent")
+	pubKey, err := ssh.NewPublicKey(key.Public())
+	require.NoError(t, err, "unable to create public key")
+
+	socketPath, stopAgent := serveAgent(t, keyring)
+	defer stopAgent()
+
+	conn, err := sshtarget.DialAgent(socketPath)
+	require.NoError(t, err, "unable to connect to agent")
+	defer conn.Close()
+
+	err = runWhoami(t, pubKey, sshtarget.NewAgentAuth(agent.NewClient(conn)))
+	assert.NoError(t, err, "unexpected error authenticating with agent")
+}
+
+func TestDialAgentNoSocket(t *testing.T) {
+	orig, isSet := os.LookupEnv("SSH_AUTH_SOCK")
+	require.NoError(t, os.Unsetenv("SSH_AUTH_SOCK"))
+	defer func() {
+		if isSet {
+			os.Setenv("SSH_AUTH_SOCK", orig)
+		}
+	}()
+
+	_, err := sshtarget.DialAgent("")
+	assert.Equal(t, sshtarget.ErrNoAgent, err, "unexpected error without agent socket")
+}
+
+func TestAgentForwarding(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	key := newPrivateKey(t, "ecdsa")
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "forwarded"}),
+		"unable to add key to agent")
+
+	logger, _ := testlogger.NewTestLogger(t, log.Warn)
+	dialer, hostKey, stopServer := sshtarget.NewSSHServerWithConfig(logger, nil)
+	defer func() {
+		stopServer()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	if v, ok := dialer.(io.Closer); ok {
+		defer v.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	newTarget := func(forward bool) *sshtarget.SSHTarget {
+		opts := []sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(hostKey))}
+		if forward {
+			opts = append(opts, sshtarget.AgentForwardingOption(keyring))
+		}
+		target, err := sshtarget.New(ctx, logger, dialer, "127.0.0.1", 22, opts,
+			"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+		require.NoError(t, err, "unable to create SSH target")
+		return target
+	}
+
+	// With forwarding.
+	target := newTarget(true)
+	rec, err := target.Command("ssh-add", "-L").Run(ctx)
+	require.NoError(t, err, "unexpected error listing forwarded keys")
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(buf, buf, 0))
+	assert.Contains(t, buf.String(), "forwarded", "forwarded key not listed")
+	require.NoError(t, target.Close())
+
+	// Without forwarding.
+	target = newTarget(false)
+	_, err = target.Command("ssh-add", "-L").Run(ctx)
+	assert.Error(t, err, "agent must not be reachable without forwarding")
+	require.NoError(t, target.Close())
+}
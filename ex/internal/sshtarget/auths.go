@@ -1,6 +1,22 @@
 package sshtarget
 
-import "golang.org/x/crypto/ssh"
+import (
+	"bufio"
+	"bytes"
+	errors2 "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
 
 // Authorizer is a method of authorizing with an SSH server.
 type Authorizer interface {
@@ -20,3 +36,330 @@ func (pa PasswordAuth) GetAuthMethod() ssh.AuthMethod { return pa.AuthMethod }
 func NewPasswordAuth(password string) PasswordAuth {
 	return PasswordAuth{AuthMethod: ssh.Password(password)}
 }
+
+// PublicKeyAuth is a public key authentication.
+type PublicKeyAuth struct {
+	ssh.AuthMethod
+}
+
+// GetAuthMethod returns the underlying authentication method.
+func (pka PublicKeyAuth) GetAuthMethod() ssh.AuthMethod { return pka.AuthMethod }
+
+// NewPublicKeyAuth uses public key authentication with the given signers for
+// connecting to an SSH server.
+//
+// The signers are tried in the order that they are given.
+func NewPublicKeyAuth(signers ...ssh.Signer) PublicKeyAuth {
+	return PublicKeyAuth{AuthMethod: ssh.PublicKeys(signers...)}
+}
+
+// NewPrivateKeyAuth uses public key authentication with the given PEM or
+// OpenSSH encoded private key.
+//
+// The passphrase is only used if it is not empty. RSA, ECDSA and Ed25519 keys
+// are supported.
+func NewPrivateKeyAuth(pemBytes, passphrase []byte) (PublicKeyAuth, error) {
+	signer, err := parsePrivateKey(pemBytes, passphrase)
+	if err != nil {
+		return PublicKeyAuth{}, err
+	}
+	return NewPublicKeyAuth(signer), nil
+}
+
+// NewPrivateKeyFileAuth uses public key authentication with the private key
+// stored in the file at the given path.
+//
+// See NewPrivateKeyAuth for the supported keys.
+func NewPrivateKeyFileAuth(path string, passphrase []byte) (PublicKeyAuth, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrap(err, "unable to read private key file")
+	}
+	signer, err := parsePrivateKey(pemBytes, passphrase)
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrapf(err, "unable to use private key file %s", path)
+	}
+	return NewPublicKeyAuth(signer), nil
+}
+
+// NewCertificateAuth uses public key authentication with the given OpenSSH
+// user certificate, signing with the private key of the certificate.
+func NewCertificateAuth(signer ssh.Signer, cert *ssh.Certificate) (PublicKeyAuth, error) {
+	if cert.CertType != ssh.UserCert {
+		return PublicKeyAuth{}, errors.New("not a user certificate")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrap(err, "unable to use certificate")
+	}
+	return NewPublicKeyAuth(certSigner), nil
+}
+
+// NewCertificateFileAuth uses public key authentication with the OpenSSH user
+// certificate at certPath and its private key at keyPath.
+//
+// If the certificate path is empty, then the certificate is read from the
+// private key path with "-cert.pub" appended, as is done by ssh(1).
+func NewCertificateFileAuth(keyPath, certPath string, passphrase []byte) (PublicKeyAuth, error) {
+	if certPath == "" {
+		certPath = keyPath + "-cert.pub"
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrap(err, "unable to read private key file")
+	}
+	signer, err := parsePrivateKey(pemBytes, passphrase)
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrapf(err, "unable to use private key file %s", keyPath)
+	}
+
+	cert, err := readCertificateFile(certPath)
+	if err != nil {
+		return PublicKeyAuth{}, err
+	}
+
+	return NewCertificateAuth(signer, cert)
+}
+
+// AgentAuth is a public key authentication using the keys held by an SSH
+// agent.
+type AgentAuth struct {
+	ssh.AuthMethod
+}
+
+// GetAuthMethod returns the underlying authentication method.
+func (aa AgentAuth) GetAuthMethod() ssh.AuthMethod { return aa.AuthMethod }
+
+// NewAgentAuth uses public key authentication with the keys held by the given
+// agent for connecting to an SSH server.
+//
+// The keys are requested from the agent each time a connection is made.
+func NewAgentAuth(a agent.Agent) AgentAuth {
+	return AgentAuth{AuthMethod: ssh.PublicKeysCallback(a.Signers)}
+}
+
+// KeyboardInteractiveResponder answers the questions asked by the server
+// during keyboard-interactive authentication.
+//
+// The echos slice indicates, for each question, whether the answer may be
+// shown while it is being entered. One answer must be returned per question.
+type KeyboardInteractiveResponder = ssh.KeyboardInteractiveChallenge
+
+// KeyboardInteractiveAuth is a keyboard-interactive authentication.
+type KeyboardInteractiveAuth struct {
+	ssh.AuthMethod
+}
+
+// GetAuthMethod returns the underlying authentication method.
+func (kia KeyboardInteractiveAuth) GetAuthMethod() ssh.AuthMethod { return kia.AuthMethod }
+
+// NewKeyboardInteractiveAuth uses keyboard-interactive authentication for
+// connecting to an SSH server, with the challenges being answered by the given
+// responder.
+func NewKeyboardInteractiveAuth(responder KeyboardInteractiveResponder) KeyboardInteractiveAuth {
+	if responder == nil {
+		panic("nil responder")
+	}
+	return KeyboardInteractiveAuth{AuthMethod: ssh.KeyboardInteractive(responder)}
+}
+
+// NewTerminalResponder creates a responder that writes the questions to out
+// and reads one line per answer from in.
+//
+// If in is a terminal, then answers that should not be echoed are read with
+// echoing disabled.
+func NewTerminalResponder(in io.Reader, out io.Writer) KeyboardInteractiveResponder {
+	// Buffered reader shared across all challenges so that no input is lost.
+	br := bufio.NewReader(in)
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			if _, err := fmt.Fprintln(out, instruction); err != nil {
+				return nil, errors.Wrap(err, "unable to write instruction")
+			}
+		}
+
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if _, err := fmt.Fprint(out, q); err != nil {
+				return nil, errors.Wrap(err, "unable to write question")
+			}
+
+			if f, ok := in.(*os.File); ok && !echos[i] && terminal.IsTerminal(int(f.Fd())) {
+				answer, err := terminal.ReadPassword(int(f.Fd()))
+				if err != nil {
+					return nil, errors.Wrap(err, "unable to read answer")
+				}
+				fmt.Fprintln(out)
+				answers[i] = string(answer)
+				continue
+			}
+
+			line, err := br.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return nil, errors.Wrap(err, "unable to read answer")
+			}
+			answers[i] = strings.TrimRight(line, "\r\n")
+		}
+		return answers, nil
+	}
+}
+
+// NewStaticResponder creates a responder that answers questions with the
+// answers in the given map, keyed by the question with surrounding whitespace
+// removed.
+//
+// This is useful for answering challenges non-interactively. An error is
+// returned for any question that has no answer.
+func NewStaticResponder(answers map[string]string) KeyboardInteractiveResponder {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		out := make([]string, len(questions))
+		for i, q := range questions {
+			a, ok := answers[strings.TrimSpace(q)]
+			if !ok {
+				return nil, errors.Errorf("no answer for question %q", q)
+			}
+			out[i] = a
+		}
+		return out, nil
+	}
+}
+
+// ErrNoDefaultKeys indicates that none of the default private key files could
+// be used.
+var ErrNoDefaultKeys = errors2.New("no usable default private keys")
+
+// defaultIdentityFiles are the names of the private key files in ~/.ssh that
+// are tried, in the same order as ssh(1) tries them.
+var defaultIdentityFiles = []string{"id_rsa", "id_ecdsa", "id_ed25519", "id_dsa"}
+
+// NewDefaultKeysAuth uses public key authentication with the private keys
+// found in the default locations in ~/.ssh.
+//
+// Keys are tried in the same order as ssh(1) tries them. Missing keys and keys
+// that are protected with a passphrase are skipped. If no key could be loaded,
+// ErrNoDefaultKeys is returned.
+func NewDefaultKeysAuth() (PublicKeyAuth, error) {
+	u, err := user.Current()
+	if err != nil {
+		return PublicKeyAuth{}, errors.Wrap(err, "unable to get user for default private keys")
+	}
+	signers, err := loadDefaultKeys(filepath.Join(u.HomeDir, ".ssh"))
+	if err != nil {
+		return PublicKeyAuth{}, err
+	}
+	return NewPublicKeyAuth(signers...), nil
+}
+
+// DefaultIdentityFiles returns the paths of the private key files in the given
+// directory that ssh(1) uses when no identity files are configured, in the
+// order that they are tried.
+func DefaultIdentityFiles(dir string) []string {
+	paths := make([]string, len(defaultIdentityFiles))
+	for i, name := range defaultIdentityFiles {
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths
+}
+
+// loadDefaultKeys loads the default private keys from the given directory.
+func loadDefaultKeys(dir string) ([]ssh.Signer, error) {
+	signers, err := LoadIdentityFiles(DefaultIdentityFiles(dir), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(signers) == 0 {
+		return nil, ErrNoDefaultKeys
+	}
+	return signers, nil
+}
+
+// LoadIdentityFiles loads the private keys at the given paths, in the same way
+// as ssh(1) loads identity files.
+//
+// Missing keys and keys that are protected with a passphrase are skipped.
+// Certificates are loaded from the given certificate paths, as well as from
+// the file next to each key with "-cert.pub" added to its name. Signers for
+// certificates come before the signer for the plain key. Certificates that do
+// not match any loaded key are skipped.
+func LoadIdentityFiles(keyPaths, certPaths []string) ([]ssh.Signer, error) {
+	var certs []*ssh.Certificate
+	for _, path := range certPaths {
+		cert, err := readCertificateFile(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var signers []ssh.Signer
+	for _, path := range keyPaths {
+		pemBytes, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "unable to read private key file")
+		}
+
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to use private key file %s", path)
+		}
+
+		keyCerts := certs
+		cert, err := readCertificateFile(path + "-cert.pub")
+		if err == nil {
+			keyCerts = append([]*ssh.Certificate{cert}, certs...)
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+		pub := signer.PublicKey().Marshal()
+		for _, c := range keyCerts {
+			if c.CertType != ssh.UserCert || !bytes.Equal(c.Key.Marshal(), pub) {
+				continue
+			}
+			certSigner, err := ssh.NewCertSigner(c, signer)
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to create certificate signer")
+			}
+			signers = append(signers, certSigner)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// readCertificateFile reads the certificate at the given path.
+func readCertificateFile(path string) (*ssh.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read certificate file")
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse certificate file %s", path)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.Errorf("%s does not contain a certificate", path)
+	}
+	return cert, nil
+}
+
+// parsePrivateKey parses a private key, only using the passphrase if one is
+// given.
+func parsePrivateKey(pemBytes, passphrase []byte) (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+	if len(passphrase) == 0 {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
+	return signer, errors.Wrap(err, "unable to parse private key")
+}
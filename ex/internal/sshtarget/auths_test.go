@@ -0,0 +1,325 @@
+package sshtarget_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newPrivateKey generates a private key of the given type ("rsa", "ecdsa" or
+// "ed25519").
+func newPrivateKey(t *testing.T, keyType string) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		panic("unsupported key type")
+	}
+	require.NoError(t, err, "unable to generate private key")
+	return key
+}
+
+// authorizedKeyCallback accepts only the given public key.
+func authorizedKeyCallback(authorized ssh.PublicKey) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if c.User() == "test" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+			return nil, nil
+		}
+		return nil, errors.New("unauthorized key")
+	}
+}
+
+// runWhoami connects to a server that only accepts the given public key with
+// the given authorizer and runs a command.
+func runWhoami(t *testing.T, authorized ssh.PublicKey, auth sshtarget.Authorizer) error {
+	return runWhoamiWithConfig(t, &sshtarget.ServerConfig{
+		PublicKeyCallback: authorizedKeyCallback(authorized),
+	}, auth)
+}
+
+// runWhoamiWithConfig connects to a server with the given config using the
+// given authorizer and runs a command.
+func runWhoamiWithConfig(t *testing.T, conf *sshtarget.ServerConfig, auth sshtarget.Authorizer) error {
+	logger, _ := testlogger.NewTestLogger(t, log.Warn)
+	dialer, hostKey, stopServer := sshtarget.NewSSHServerWithConfig(logger, conf)
+	defer func() {
+		stopServer()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	if v, ok := dialer.(io.Closer); ok {
+		defer v.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	target, err := sshtarget.New(ctx, logger, dialer, "127.0.0.1", 22,
+		[]sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(hostKey))},
+		"test", []sshtarget.Authorizer{auth})
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	rec, err := target.Command("whoami").Run(ctx)
+	require.NoError(t, err, "unable to run command")
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(buf, buf, 0), "unable to replay recording")
+	assert.Equal(t, "test\n", buf.String(), "unexpected command output")
+	return nil
+}
+
+func TestPublicKeyAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keyType, func(t2 *testing.T) {
+			signer, err := ssh.NewSignerFromSigner(newPrivateKey(t2, keyType))
+			require.NoError(t2, err, "unable to create signer")
+
+			err = runWhoami(t2, signer.PublicKey(), sshtarget.NewPublicKeyAuth(signer))
+			assert.NoError(t2, err, "unexpected error authenticating with key")
+		})
+	}
+
+	t.Run("Unauthorized Key", func(t2 *testing.T) {
+		signer, err := ssh.NewSignerFromSigner(newPrivateKey(t2, "ed25519"))
+		require.NoError(t2, err, "unable to create signer")
+		other, err := ssh.NewSignerFromSigner(newPrivateKey(t2, "ed25519"))
+		require.NoError(t2, err, "unable to create signer")
+
+		err = runWhoami(t2, other.PublicKey(), sshtarget.NewPublicKeyAuth(signer))
+		assert.Error(t2, err, "expected authentication failure")
+	})
+}
+
+func TestPrivateKeyAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	pkcs8 := func(key crypto.Signer) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err, "unable to marshal PKCS #8 key")
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	openSSH := func(key crypto.Signer, passphrase []byte) []byte {
+		var block *pem.Block
+		var err error
+		if passphrase == nil {
+			block, err = ssh.MarshalPrivateKey(key, "")
+		} else {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+		}
+		require.NoError(t, err, "unable to marshal OpenSSH key")
+		return pem.EncodeToMemory(block)
+	}
+
+	rsaKey := newPrivateKey(t, "rsa")
+	ecdsaKey := newPrivateKey(t, "ecdsa")
+	edKey := newPrivateKey(t, "ed25519")
+
+	tcs := []struct {
+		Name          string
+		Key           crypto.Signer
+		PEM           []byte
+		Passphrase    []byte
+		ExpectedError bool
+	}{
+		{
+			Name: "PKCS1 RSA",
+			Key:  rsaKey,
+			PEM: pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey)),
+			}),
+		},
+		{
+			Name: "PKCS8 ECDSA",
+			Key:  ecdsaKey,
+			PEM:  pkcs8(ecdsaKey),
+		},
+		{
+			Name: "OpenSSH Ed25519",
+			Key:  edKey,
+			PEM:  openSSH(edKey, nil),
+		},
+		{
+			Name:       "OpenSSH Ed25519 With Passphrase",
+			Key:        edKey,
+			PEM:        openSSH(edKey, []byte("secret")),
+			Passphrase: []byte("secret"),
+		},
+		{
+			Name:          "OpenSSH RSA Missing Passphrase",
+			Key:           rsaKey,
+			PEM:           openSSH(rsaKey, []byte("secret")),
+			ExpectedError: true,
+		},
+		{
+			Name:          "OpenSSH ECDSA Wrong Passphrase",
+			Key:           ecdsaKey,
+			PEM:           openSSH(ecdsaKey, []byte("secret")),
+			Passphrase:    []byte("wrong"),
+			ExpectedError: true,
+		},
+		{
+			Name:          "Garbage",
+			PEM:           []byte("not a key"),
+			ExpectedError: true,
+		},
+	}
+
+	for _, tCase := range tcs {
+		tc := tCase
+		t.Run(tc.Name, func(t2 *testing.T) {
+			auth, err := sshtarget.NewPrivateKeyAuth(tc.PEM, tc.Passphrase)
+			if tc.ExpectedError {
+				assert.Error(t2, err, "expected error parsing private key")
+				return
+			}
+			require.NoError(t2, err, "unexpected error parsing private key")
+
+			pubKey, err := ssh.NewPublicKey(tc.Key.Public())
+			require.NoError(t2, err, "unable to create public key")
+			assert.NoError(t2, runWhoami(t2, pubKey, auth), "unexpected error authenticating with key")
+		})
+	}
+}
+
+func TestPrivateKeyFileAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "private_keys")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	key := newPrivateKey(t, "ed25519")
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	require.NoError(t, err, "unable to marshal private key")
+	path := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	auth, err := sshtarget.NewPrivateKeyFileAuth(path, []byte("secret"))
+	require.NoError(t, err, "unexpected error loading private key file")
+	pubKey, err := ssh.NewPublicKey(key.Public())
+	require.NoError(t, err, "unable to create public key")
+	assert.NoError(t, runWhoami(t, pubKey, auth), "unexpected error authenticating with key")
+
+	_, err = sshtarget.NewPrivateKeyFileAuth(filepath.Join(dir, "missing"), nil)
+	assert.Error(t, err, "expected error for missing private key file")
+}
+
+func TestLoadDefaultKeys(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "default_keys")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	_, err = sshtarget.LoadDefaultKeys(dir)
+	assert.Equal(t, sshtarget.ErrNoDefaultKeys, err, "expected no keys to be found")
+
+	write := func(name string, key crypto.Signer, passphrase []byte) ssh.PublicKey {
+		var block *pem.Block
+		var err error
+		if passphrase == nil {
+			block, err = ssh.MarshalPrivateKey(key, "")
+		} else {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+		}
+		require.NoError(t, err, "unable to marshal private key")
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+		pubKey, err := ssh.NewPublicKey(key.Public())
+		require.NoError(t, err, "unable to create public key")
+		return pubKey
+	}
+
+	edPub := write("id_ed25519", newPrivateKey(t, "ed25519"), nil)
+	// Encrypted keys are skipped.
+	write("id_ecdsa", newPrivateKey(t, "ecdsa"), []byte("secret"))
+	rsaPub := write("id_rsa", newPrivateKey(t, "rsa"), nil)
+
+	signers, err := sshtarget.LoadDefaultKeys(dir)
+	require.NoError(t, err, "unexpected error loading default keys")
+	require.Len(t, signers, 2, "unexpected number of default keys")
+	assert.Equal(t, rsaPub.Marshal(), signers[0].PublicKey().Marshal(), "RSA key must be tried first")
+	assert.Equal(t, edPub.Marshal(), signers[1].PublicKey().Marshal(), "Ed25519 key must be tried last")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "id_dsa"), []byte("garbage"), 0600))
+	_, err = sshtarget.LoadDefaultKeys(dir)
+	assert.Error(t, err, "expected error for an invalid default key")
+}
+
+// otpChallenge asks for a password and a one time code.
+func otpChallenge(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := client(c.User(), "Two factor login", []string{"Password: ", "Code: "}, []bool{false, true})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 2 || answers[0] != "Password123" || answers[1] != "123456" {
+		return nil, errors.New("wrong answers")
+	}
+	return nil, nil
+}
+
+func TestKeyboardInteractiveAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	conf := &sshtarget.ServerConfig{KeyboardInteractiveCallback: otpChallenge}
+
+	t.Run("Static", func(t2 *testing.T) {
+		auth := sshtarget.NewKeyboardInteractiveAuth(sshtarget.NewStaticResponder(map[string]string{
+			"Password:": "Password123",
+			"Code:":     "123456",
+		}))
+		assert.NoError(t2, runWhoamiWithConfig(t2, conf, auth), "unexpected authentication error")
+	})
+
+	t.Run("Static Missing Answer", func(t2 *testing.T) {
+		auth := sshtarget.NewKeyboardInteractiveAuth(sshtarget.NewStaticResponder(map[string]string{
+			"Password:": "Password123",
+		}))
+		assert.Error(t2, runWhoamiWithConfig(t2, conf, auth), "expected authentication error")
+	})
+
+	t.Run("Terminal", func(t2 *testing.T) {
+		out := &bytes.Buffer{}
+		in := bytes.NewBufferString("Password123\n123456\n")
+		auth := sshtarget.NewKeyboardInteractiveAuth(sshtarget.NewTerminalResponder(in, out))
+		assert.NoError(t2, runWhoamiWithConfig(t2, conf, auth), "unexpected authentication error")
+		assert.Equal(t2, "Two factor login\nPassword: Code: ", out.String(), "unexpected prompts")
+	})
+
+	t.Run("Terminal Wrong Answer", func(t2 *testing.T) {
+		in := bytes.NewBufferString("Password123\n654321\n")
+		auth := sshtarget.NewKeyboardInteractiveAuth(sshtarget.NewTerminalResponder(in, ioutil.Discard))
+		assert.Error(t2, runWhoamiWithConfig(t2, conf, auth), "expected authentication error")
+	})
+}
@@ -0,0 +1,76 @@
+package sshtarget_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHTargetDialContext(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.Host)
+	}))
+	defer service.Close()
+
+	logger, _ := testlogger.NewTestLogger(t, log.Warn)
+	var requested []string
+	server := newServer(logger, func(host string, port uint32) (net.Conn, error) {
+		address := net.JoinHostPort(host, fmt.Sprint(port))
+		requested = append(requested, address)
+		if host != "internal.service" {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial("tcp", service.Listener.Addr().String())
+	})
+	defer server.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := sshtarget.New(ctx, logger, server.dialer, "127.0.0.1", 22,
+		[]sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(server.hostKey))},
+		"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+	require.NoError(t, err, "unable to create target")
+
+	transport := &http.Transport{DialContext: st.DialContext}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://internal.service:8080/")
+	require.NoError(t, err, "unable to make request through target")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err, "unable to read response")
+	assert.Equal(t, "hello from internal.service:8080", string(body), "unexpected response")
+	transport.CloseIdleConnections()
+
+	_, err = st.DialContext(ctx, "tcp", "other.service:80")
+	assert.Error(t, err, "rejected channel must be an error")
+	assert.Equal(t, []string{"internal.service:8080", "other.service:80"}, requested,
+		"unexpected addresses requested")
+
+	for _, network := range []string{"udp", "unix", ""} {
+		_, err = st.DialContext(ctx, network, "internal.service:8080")
+		assert.Equal(t, sshtarget.ErrUnsupportedNetwork, err, "%q must not be dialed", network)
+	}
+	conn, err := st.DialContext(ctx, "tcp4", "internal.service:8080")
+	require.NoError(t, err, "tcp4 must be dialed")
+	conn.Close()
+	assert.Len(t, requested, 3, "unsupported networks must not be requested")
+
+	require.NoError(t, st.Close(), "unable to close target")
+	_, err = st.DialContext(ctx, "tcp", "internal.service:8080")
+	assert.Equal(t, sshtarget.ErrNoSSHConnection, err, "closed target must not dial")
+}
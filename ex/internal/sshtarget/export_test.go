@@ -4,3 +4,5 @@ package sshtarget
 const GlobalKnownHosts = globalKnownHosts
 
 var GetKnownHostPaths = getKnownHostPaths
+
+var LoadDefaultKeys = loadDefaultKeys
@@ -0,0 +1,291 @@
+package sshtarget
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/log"
+)
+
+// Forward is a port forward made through the SSH connection of an SSHTarget.
+//
+// Connections accepted by the listening side of the forward are each
+// connected to a new connection to the dialed side. For a local forward, the
+// listening side is on the local system and the dialed side is reached through
+// the SSH server. For a remote forward, the SSH server listens and the dialed
+// side is on the local system.
+type Forward struct {
+	// sent and received are the byte counts, which are used atomically. They
+	// come first so that they are 64-bit aligned on 32-bit systems.
+	sent, received uint64
+
+	logger   log.Logger
+	listener net.Listener
+	// dial connects to the dialed side for an accepted connection.
+	dial dialFunc
+	// logFailure logs the failures of dial.
+	logFailure func(string, ...interface{})
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	// onClose is called when the forward is closed with Close.
+	onClose func(*Forward)
+}
+
+// dialFunc connects to the dialed side of a forward for a connection that was
+// accepted by it.
+type dialFunc func(ctx context.Context, accepted net.Conn) (net.Conn, error)
+
+// newForward creates a forward and starts accepting connections from the
+// listener.
+func newForward(logger log.Logger, l net.Listener, dial dialFunc,
+	logFailure func(string, ...interface{}), onClose func(*Forward)) *Forward {
+	f := &Forward{
+		logger:     logger,
+		listener:   l,
+		dial:       dial,
+		logFailure: logFailure,
+		conns:      make(map[net.Conn]struct{}),
+		onClose:    onClose,
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+
+	f.wg.Add(1)
+	go f.acceptLoop()
+	return f
+}
+
+// Addr returns the address that the forward is listening on.
+//
+// This is useful for getting the port chosen for a port of 0.
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// BytesSent returns the number of bytes that have been sent from the
+// connections accepted by the forward to the dialed side.
+func (f *Forward) BytesSent() uint64 {
+	return atomic.LoadUint64(&f.sent)
+}
+
+// BytesReceived returns the number of bytes that have been received from the
+// dialed side for the connections accepted by the forward.
+func (f *Forward) BytesReceived() uint64 {
+	return atomic.LoadUint64(&f.received)
+}
+
+// Close stops the forward, closing all of its connections.
+// Blocks until all of the connections have been closed.
+func (f *Forward) Close() error {
+	err := f.close()
+	if f.onClose != nil {
+		f.onClose(f)
+	}
+	return err
+}
+
+// close stops the forward without removing it from its target.
+func (f *Forward) close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.cancel()
+	err := f.listener.Close()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	return errors.Wrap(err, "unable to close forward listener")
+}
+
+// track adds a connection to be closed when the forward is closed, returning
+// false if the forward is already closed.
+func (f *Forward) track(c net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	return true
+}
+
+// untrack removes a connection added with track.
+func (f *Forward) untrack(c net.Conn) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+}
+
+// acceptLoop handles the connections accepted by the listener until it is
+// closed.
+func (f *Forward) acceptLoop() {
+	defer f.wg.Done()
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if !closed {
+				f.logger.Errorf("Error accepting connection for forward on %s: %+v", f.listener.Addr(), err)
+			}
+			return
+		}
+		f.wg.Add(1)
+		go f.handle(c)
+	}
+}
+
+// handle connects an accepted connection to the dialed side of the forward.
+func (f *Forward) handle(accepted net.Conn) {
+	defer f.wg.Done()
+	if !f.track(accepted) {
+		accepted.Close()
+		return
+	}
+	defer f.untrack(accepted)
+	defer accepted.Close()
+
+	dialed, err := f.dial(f.ctx, accepted)
+	if err != nil {
+		if f.ctx.Err() == nil {
+			f.logFailure("Unable to connect for forward on %s: %+v", f.listener.Addr(), err)
+		}
+		return
+	}
+	if !f.track(dialed) {
+		dialed.Close()
+		return
+	}
+	defer f.untrack(dialed)
+	defer dialed.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyCounted(dialed, accepted, &f.sent)
+	}()
+	go func() {
+		defer wg.Done()
+		copyCounted(accepted, dialed, &f.received)
+	}()
+	wg.Wait()
+}
+
+// countingWriter counts the bytes written to a writer.
+type countingWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddUint64(cw.count, uint64(n))
+	return n, err
+}
+
+// copyCounted copies from src to dst, adding the number of bytes copied to
+// count.
+//
+// When src reaches EOF, the write side of dst is closed so that the EOF is
+// passed on, if possible. Both connections are closed on any other error.
+func copyCounted(dst, src net.Conn, count *uint64) {
+	_, err := io.Copy(&countingWriter{w: dst, count: count}, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+// ForwardLocal listens on the given local address and forwards the
+// connections to it to the remote address, which is dialed by the SSH server,
+// as with the -L option of ssh(1).
+//
+// The networks may be "tcp" or "unix", so that Unix sockets may be forwarded
+// on either side. The remote network "unix" requires the SSH server to support
+// the direct-streamlocal@openssh.com extension.
+//
+// The forward is closed when the target is closed.
+func (st *SSHTarget) ForwardLocal(network, address, remoteNetwork, remoteAddress string) (*Forward, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.isClosed {
+		return nil, ErrNoSSHConnection
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen for local forward")
+	}
+	client := st.client
+	return st.addForward(l, st.logger.Warnf, func(ctx context.Context, _ net.Conn) (net.Conn, error) {
+		return client.DialContext(ctx, remoteNetwork, remoteAddress)
+	}), nil
+}
+
+// ForwardRemote requests that the SSH server listens on the given address and
+// forwards the connections to it to the local address, as with the -R option
+// of ssh(1).
+//
+// The networks may be "tcp" or "unix", so that Unix sockets may be forwarded
+// on either side. A remote TCP address must have an IP address as its host.
+// Addr of the returned forward reports the port chosen by the server for a
+// port of 0. The network "unix" requires the SSH server to support the
+// streamlocal-forward@openssh.com extension.
+//
+// The forward is closed when the target is closed.
+func (st *SSHTarget) ForwardRemote(network, address, localNetwork, localAddress string) (*Forward, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.isClosed {
+		return nil, ErrNoSSHConnection
+	}
+
+	l, err := st.client.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen for remote forward")
+	}
+	d := &net.Dialer{}
+	return st.addForward(l, st.logger.Warnf, func(ctx context.Context, _ net.Conn) (net.Conn, error) {
+		return d.DialContext(ctx, localNetwork, localAddress)
+	}), nil
+}
+
+// addForward creates a forward that is closed with the target, logging the
+// connections that could not be made with logFailure.
+//
+// The lock of the target must be held.
+func (st *SSHTarget) addForward(l net.Listener, logFailure func(string, ...interface{}), dial dialFunc) *Forward {
+	f := newForward(st.logger, l, dial, logFailure, st.removeForward)
+	if st.forwards == nil {
+		st.forwards = make(map[*Forward]struct{})
+	}
+	st.forwards[f] = struct{}{}
+	return f
+}
+
+// removeForward removes a closed forward from the target.
+func (st *SSHTarget) removeForward(f *Forward) {
+	st.mu.Lock()
+	delete(st.forwards, f)
+	st.mu.Unlock()
+}
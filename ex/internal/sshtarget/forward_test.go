@@ -0,0 +1,139 @@
+package sshtarget_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoListener starts a server that echoes back the data sent to it.
+func newEchoListener(t *testing.T, network, address string) net.Listener {
+	l, err := net.Listen(network, address)
+	require.NoError(t, err, "unable to listen for echo server")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// checkEcho checks that data sent to the address is echoed back.
+func checkEcho(t *testing.T, network, address string) {
+	c, err := net.Dial(network, address)
+	require.NoError(t, err, "unable to dial forward")
+	defer c.Close()
+
+	require.NoError(t, c.SetDeadline(time.Now().Add(20*time.Second)))
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err, "unable to write to forward")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err, "unable to read from forward")
+	assert.Equal(t, "hello", string(buf), "unexpected data from forward")
+}
+
+func TestForwards(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "forward")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	tcpEcho := newEchoListener(t, "tcp", "127.0.0.1:0")
+	defer tcpEcho.Close()
+	unixEcho := newEchoListener(t, "unix", filepath.Join(dir, "echo.sock"))
+	defer unixEcho.Close()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	d, hostKey, stop := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{
+		DirectTCPIP: func(host string, port uint32) (net.Conn, error) {
+			return net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		},
+		DirectStreamLocal: func(socketPath string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+		Listen: net.Listen,
+	})
+	server := &testServer{dialer: d, hostKey: hostKey, stop: stop}
+	defer server.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := sshtarget.New(ctx, logger, server.dialer, "127.0.0.1", 22,
+		[]sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(server.hostKey))},
+		"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+	require.NoError(t, err, "unable to create target")
+
+	tests := []struct {
+		name    string
+		forward func() (*sshtarget.Forward, error)
+	}{
+		{"Local TCP", func() (*sshtarget.Forward, error) {
+			return st.ForwardLocal("tcp", "127.0.0.1:0", "tcp", tcpEcho.Addr().String())
+		}},
+		{"Local Unix", func() (*sshtarget.Forward, error) {
+			return st.ForwardLocal("unix", filepath.Join(dir, "local.sock"), "unix", unixEcho.Addr().String())
+		}},
+		{"Local TCP To Unix", func() (*sshtarget.Forward, error) {
+			return st.ForwardLocal("tcp", "127.0.0.1:0", "unix", unixEcho.Addr().String())
+		}},
+		{"Remote TCP", func() (*sshtarget.Forward, error) {
+			return st.ForwardRemote("tcp", "127.0.0.1:0", "tcp", tcpEcho.Addr().String())
+		}},
+		{"Remote Unix", func() (*sshtarget.Forward, error) {
+			return st.ForwardRemote("unix", filepath.Join(dir, "remote.sock"), "unix", unixEcho.Addr().String())
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t2 *testing.T) {
+			f, err := test.forward()
+			require.NoError(t2, err, "unable to create forward")
+
+			checkEcho(t2, f.Addr().Network(), f.Addr().String())
+			checkEcho(t2, f.Addr().Network(), f.Addr().String())
+			require.NoError(t2, f.Close(), "unable to close forward")
+			assert.EqualValues(t2, 10, f.BytesSent(), "unexpected number of bytes sent")
+			assert.EqualValues(t2, 10, f.BytesReceived(), "unexpected number of bytes received")
+
+			_, err = net.Dial(f.Addr().Network(), f.Addr().String())
+			assert.Error(t2, err, "closed forward must not accept connections")
+		})
+	}
+
+	// Closing the target closes its forwards.
+	local, err := st.ForwardLocal("tcp", "127.0.0.1:0", "tcp", tcpEcho.Addr().String())
+	require.NoError(t, err, "unable to create local forward")
+	remote, err := st.ForwardRemote("tcp", "127.0.0.1:0", "tcp", tcpEcho.Addr().String())
+	require.NoError(t, err, "unable to create remote forward")
+	checkEcho(t, "tcp", remote.Addr().String())
+	require.NoError(t, st.Close(), "unable to close target")
+	for _, f := range []*sshtarget.Forward{local, remote} {
+		_, err = net.Dial("tcp", f.Addr().String())
+		assert.Error(t, err, "forward must be closed with the target")
+	}
+
+	_, err = st.ForwardLocal("tcp", "127.0.0.1:0", "tcp", tcpEcho.Addr().String())
+	assert.Equal(t, sshtarget.ErrNoSSHConnection, err, "closed target must not forward")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
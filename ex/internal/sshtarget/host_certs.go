@@ -0,0 +1,40 @@
+package sshtarget
+
+import (
+	"bytes"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// CertAuthorityCallback creates a host key callback that accepts host
+// certificates signed by any of the given certificate authority keys.
+//
+// This is the equivalent of a "@cert-authority" line in a known_hosts file.
+// The certificate authorities are only trusted for hosts that match the given
+// patterns, which use the same syntax as known_hosts files. The certificate
+// must be valid at the time of the check and the host name being connected to
+// must be one of its principals.
+//
+// Host keys that are not certificates are passed to the fallback callback. If
+// the fallback is nil, then such host keys are rejected.
+func CertAuthorityCallback(caKeys []ssh.PublicKey, hostPatterns []string, fallback HostKeyCallback) HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			if !MatchHostPatterns(hostPatterns, knownhosts.Normalize(address)) {
+				return false
+			}
+			for _, k := range caKeys {
+				if bytes.Equal(k.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: fallback,
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return checker.CheckHostKey(hostname, remote, key)
+	}
+}
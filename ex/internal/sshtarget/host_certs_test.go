@@ -0,0 +1,265 @@
+package sshtarget_test
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner generates a new Ed25519 signer.
+func newSigner(t *testing.T) ssh.Signer {
+	signer, err := ssh.NewSignerFromSigner(newPrivateKey(t, "ed25519"))
+	require.NoError(t, err, "unable to create signer")
+	return signer
+}
+
+// signCert creates a certificate for the public key, signed by the given
+// certificate authority.
+func signCert(t *testing.T, ca ssh.Signer, pub ssh.PublicKey, certType uint32, principals []string, validAfter, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca), "unable to sign certificate")
+	return cert
+}
+
+// userCAConfig creates a server config that accepts user certificates signed
+// by the given certificate authority.
+func userCAConfig(ca ssh.PublicKey) *sshtarget.ServerConfig {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.Marshal())
+		},
+	}
+	return &sshtarget.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := key.(*ssh.Certificate); !ok {
+				return nil, errors.New("certificate required")
+			}
+			return checker.Authenticate(c, key)
+		},
+	}
+}
+
+func TestCertificateAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	ca := newSigner(t)
+	conf := userCAConfig(ca.PublicKey())
+	now := time.Now()
+
+	t.Run("Valid", func(t2 *testing.T) {
+		user := newSigner(t2)
+		cert := signCert(t2, ca, user.PublicKey(), ssh.UserCert, []string{"test"}, now.Add(-time.Hour), now.Add(time.Hour))
+		auth, err := sshtarget.NewCertificateAuth(user, cert)
+		require.NoError(t2, err, "unexpected error creating certificate authorizer")
+		assert.NoError(t2, runWhoamiWithConfig(t2, conf, auth), "unexpected authentication error")
+	})
+
+	t.Run("Wrong Principal", func(t2 *testing.T) {
+		user := newSigner(t2)
+		cert := signCert(t2, ca, user.PublicKey(), ssh.UserCert, []string{"root"}, now.Add(-time.Hour), now.Add(time.Hour))
+		auth, err := sshtarget.NewCertificateAuth(user, cert)
+		require.NoError(t2, err, "unexpected error creating certificate authorizer")
+		assert.Error(t2, runWhoamiWithConfig(t2, conf, auth), "expected authentication error")
+	})
+
+	t.Run("Expired", func(t2 *testing.T) {
+		user := newSigner(t2)
+		cert := signCert(t2, ca, user.PublicKey(), ssh.UserCert, []string{"test"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		auth, err := sshtarget.NewCertificateAuth(user, cert)
+		require.NoError(t2, err, "unexpected error creating certificate authorizer")
+		assert.Error(t2, runWhoamiWithConfig(t2, conf, auth), "expected authentication error")
+	})
+
+	t.Run("Untrusted Authority", func(t2 *testing.T) {
+		user := newSigner(t2)
+		cert := signCert(t2, newSigner(t2), user.PublicKey(), ssh.UserCert, []string{"test"}, now.Add(-time.Hour), now.Add(time.Hour))
+		auth, err := sshtarget.NewCertificateAuth(user, cert)
+		require.NoError(t2, err, "unexpected error creating certificate authorizer")
+		assert.Error(t2, runWhoamiWithConfig(t2, conf, auth), "expected authentication error")
+	})
+
+	t.Run("Host Certificate", func(t2 *testing.T) {
+		user := newSigner(t2)
+		cert := signCert(t2, ca, user.PublicKey(), ssh.HostCert, []string{"test"}, now.Add(-time.Hour), now.Add(time.Hour))
+		_, err := sshtarget.NewCertificateAuth(user, cert)
+		assert.Error(t2, err, "host certificates must not be usable for user authentication")
+	})
+
+	t.Run("Mismatched Key", func(t2 *testing.T) {
+		cert := signCert(t2, ca, newSigner(t2).PublicKey(), ssh.UserCert, []string{"test"}, now.Add(-time.Hour), now.Add(time.Hour))
+		_, err := sshtarget.NewCertificateAuth(newSigner(t2), cert)
+		assert.Error(t2, err, "certificate must match the private key")
+	})
+}
+
+func TestCertificateFileAuth(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	ca := newSigner(t)
+	key := newPrivateKey(t, "ecdsa")
+	user, err := ssh.NewSignerFromSigner(key)
+	require.NoError(t, err, "unable to create signer")
+	now := time.Now()
+	cert := signCert(t, ca, user.PublicKey(), ssh.UserCert, []string{"test"}, now.Add(-time.Hour), now.Add(time.Hour))
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err, "unable to marshal private key")
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644))
+
+	auth, err := sshtarget.NewCertificateFileAuth(keyPath, "", nil)
+	require.NoError(t, err, "unexpected error loading certificate")
+	assert.NoError(t, runWhoamiWithConfig(t, userCAConfig(ca.PublicKey()), auth),
+		"unexpected authentication error")
+
+	// A plain public key in place of the certificate.
+	pubPath := filepath.Join(dir, "id_ecdsa.pub")
+	require.NoError(t, ioutil.WriteFile(pubPath, ssh.MarshalAuthorizedKey(user.PublicKey()), 0644))
+	_, err = sshtarget.NewCertificateFileAuth(keyPath, pubPath, nil)
+	assert.Error(t, err, "expected error for a public key that is not a certificate")
+}
+
+func TestCertAuthorityCallback(t *testing.T) {
+	t.Parallel()
+
+	ca := newSigner(t)
+	host := newSigner(t)
+	now := time.Now()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	tcs := []struct {
+		Name     string
+		Hostname string
+		Key      ssh.PublicKey
+		Fallback sshtarget.HostKeyCallback
+		Valid    bool
+	}{
+		{
+			Name:     "Valid",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(-time.Hour), now.Add(time.Hour)),
+			Valid:    true,
+		},
+		{
+			Name:     "Wrong Principal",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"web.example.com"}, now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			Name:     "Expired",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(-2*time.Hour), now.Add(-time.Hour)),
+		},
+		{
+			Name:     "Not Yet Valid",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(time.Hour), now.Add(2*time.Hour)),
+		},
+		{
+			Name:     "Host Outside Patterns",
+			Hostname: "db.example.org:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.org"}, now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			Name:     "Untrusted Authority",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, newSigner(t), host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			Name:     "User Certificate",
+			Hostname: "db.example.com:22",
+			Key:      signCert(t, ca, host.PublicKey(), ssh.UserCert, []string{"db.example.com"}, now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			Name:     "Plain Key Without Fallback",
+			Hostname: "db.example.com:22",
+			Key:      host.PublicKey(),
+		},
+		{
+			Name:     "Plain Key With Fallback",
+			Hostname: "db.example.com:22",
+			Key:      host.PublicKey(),
+			Fallback: sshtarget.FixedHostKey(host.PublicKey()),
+			Valid:    true,
+		},
+	}
+
+	for _, tCase := range tcs {
+		tc := tCase
+		t.Run(tc.Name, func(t2 *testing.T) {
+			t2.Parallel()
+			cb := sshtarget.CertAuthorityCallback([]ssh.PublicKey{ca.PublicKey()}, []string{"*.example.com"}, tc.Fallback)
+			err := cb(tc.Hostname, remote, tc.Key)
+			if tc.Valid {
+				assert.NoError(t2, err, "host key must be accepted")
+			} else {
+				assert.Error(t2, err, "host key must be rejected")
+			}
+		})
+	}
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "known_hosts")
+	require.NoError(t, err, "unable to create temporary file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ca := newSigner(t)
+	host := newSigner(t)
+	now := time.Now()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	err = sshtarget.AddToKnownHosts(f, []string{"*.example.com"}, ca.PublicKey(), true, sshtarget.MarkerCertAuthority)
+	require.NoError(t, err, "unable to add certificate authority")
+
+	cb, err := sshtarget.KnownHostsFilesCallback(f.Name())
+	require.NoError(t, err, "unable to create known_hosts callback")
+
+	valid := signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, cb("db.example.com:22", remote, valid), "certificate from trusted authority rejected")
+
+	expired := signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"db.example.com"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	assert.Error(t, cb("db.example.com:22", remote, expired), "expired certificate accepted")
+
+	wrongPrincipal := signCert(t, ca, host.PublicKey(), ssh.HostCert, []string{"web.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.Error(t, cb("db.example.com:22", remote, wrongPrincipal), "certificate for another host accepted")
+
+	err = cb("db.example.com:22", remote, host.PublicKey())
+	assert.True(t, sshtarget.IsUnknownHost(err), "plain host key must be unknown")
+
+	// A hashed plain entry of the same key type after the authority.
+	err = sshtarget.AddToKnownHosts(f, []string{"db.example.com"}, host.PublicKey(), false, sshtarget.MarkerNone)
+	require.NoError(t, err, "unable to add host key")
+	cb, err = sshtarget.KnownHostsFilesCallback(f.Name())
+	require.NoError(t, err, "unable to create known_hosts callback")
+	assert.NoError(t, cb("db.example.com:22", remote, host.PublicKey()), "known plain host key rejected")
+	err = cb("db.example.com:22", remote, newSigner(t).PublicKey())
+	assert.True(t, sshtarget.IsKeyChange(err), "changed plain host key must be detected")
+}
@@ -0,0 +1,59 @@
+package sshtarget
+
+import "strings"
+
+// MatchHostPatterns reports whether the host matches the given patterns, using
+// the same rules as ssh(1).
+//
+// Patterns may contain the "*" and "?" wildcards and may be negated by
+// prefixing them with "!". A matching negated pattern causes the host to not
+// match, regardless of any other matching patterns. Matching is case
+// insensitive.
+func MatchHostPatterns(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+
+	var matched bool
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if !wildcardMatch(strings.ToLower(p), host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// wildcardMatch reports whether s matches the pattern, where "*" matches any
+// number of characters and "?" matches exactly one character.
+func wildcardMatch(pattern, s string) bool {
+	var p, i int
+	// Position of the last star and the position in s that it was matched
+	// against, for backtracking.
+	star, starI := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starI = p, i
+			p++
+		case star != -1:
+			p = star + 1
+			starI++
+			i = starI
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
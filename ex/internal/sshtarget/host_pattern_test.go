@@ -0,0 +1,42 @@
+package sshtarget
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchHostPatterns(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		Name     string
+		Patterns []string
+		Host     string
+		Expected bool
+	}{
+		{Name: "Exact", Patterns: []string{"example.com"}, Host: "example.com", Expected: true},
+		{Name: "Case Insensitive", Patterns: []string{"Example.COM"}, Host: "example.com", Expected: true},
+		{Name: "No Match", Patterns: []string{"example.org"}, Host: "example.com"},
+		{Name: "Star", Patterns: []string{"*.example.com"}, Host: "db.example.com", Expected: true},
+		{Name: "Star Only", Patterns: []string{"*"}, Host: "anything", Expected: true},
+		{Name: "Star Suffix Mismatch", Patterns: []string{"*.example.com"}, Host: "example.com"},
+		{Name: "Question Mark", Patterns: []string{"db?"}, Host: "db1", Expected: true},
+		{Name: "Question Mark Too Short", Patterns: []string{"db?"}, Host: "db"},
+		{Name: "Backtracking", Patterns: []string{"*a*b"}, Host: "xaxxab", Expected: true},
+		{Name: "Bracketed Port", Patterns: []string{"[*.example.com]:2222"}, Host: "[db.example.com]:2222", Expected: true},
+		{Name: "Multiple", Patterns: []string{"a", "b"}, Host: "b", Expected: true},
+		{Name: "Negated", Patterns: []string{"*.example.com", "!db.example.com"}, Host: "db.example.com"},
+		{Name: "Negated Before Match", Patterns: []string{"!db.example.com", "*.example.com"}, Host: "db.example.com"},
+		{Name: "Negated Other", Patterns: []string{"*.example.com", "!db.example.com"}, Host: "web.example.com", Expected: true},
+		{Name: "Only Negated", Patterns: []string{"!db.example.com"}, Host: "web.example.com"},
+	}
+
+	for _, tCase := range tcs {
+		tc := tCase
+		t.Run(tc.Name, func(t2 *testing.T) {
+			t2.Parallel()
+			assert.Equal(t2, tc.Expected, MatchHostPatterns(tc.Patterns, tc.Host))
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package sshtarget
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// JumpHost is an SSH server that is connected through to reach a target, as
+// with the ProxyJump option of ssh(1).
+type JumpHost struct {
+	Host string
+	Port uint16
+	User string
+
+	// Auths are the authorization methods used with the jump host.
+	Auths []Authorizer
+	// HostKeyCallback verifies the host key of the jump host.
+	HostKeyCallback HostKeyCallback
+}
+
+// jumpHosts is the option for connecting through jump hosts.
+type jumpHosts []JumpHost
+
+// JumpHostsOption returns an option to connect to the target through the given
+// jump hosts, in order.
+//
+// The first jump host is dialed with the dialer of the target. Each of the
+// following jump hosts, and then the target, are connected to through
+// direct-tcpip channels of the previous jump host. Each jump host is
+// authenticated and has its host key verified separately.
+func JumpHostsOption(hops ...JumpHost) Option {
+	for i, hop := range hops {
+		if len(hop.Auths) == 0 {
+			panic(fmt.Sprintf("no authorizers given for jump host at index %d", i))
+		}
+		if hop.HostKeyCallback == nil {
+			panic(fmt.Sprintf("no host key callback given for jump host at index %d", i))
+		}
+	}
+	return jumpHosts(hops)
+}
+
+// dialJumpHosts connects to each of the jump hosts in turn, returning the
+// connections to them.
+//
+// The returned dial function dials through the last jump host, or is the dial
+// function of the given dialer if there are no jump hosts.
+func dialJumpHosts(ctx context.Context, st *SSHTarget) (
+	dial func(ctx context.Context, network, address string) (net.Conn, error), clients []*SSH, err error) {
+	dial = st.dialer.DialContext
+	for _, hop := range st.jumpHosts {
+		address := net.JoinHostPort(hop.Host, strconv.Itoa(int(hop.Port)))
+		conn, err := dial(ctx, "tcp", address)
+		if err != nil {
+			closeClients(clients)
+			return nil, nil, errors.Wrapf(err, "unable to dial jump host %s", address)
+		}
+
+		client, err := NewSSH(ctx, st.logger, conn, address, hop.HostKeyCallback, hop.User, hop.Auths)
+		if err != nil {
+			closeClients(clients)
+			return nil, nil, errors.Wrapf(err, "unable to connect to jump host %s", address)
+		}
+		clients = append(clients, client)
+		dial = client.DialContext
+	}
+	return dial, clients, nil
+}
+
+// closeClients closes the SSH connections in reverse order.
+func closeClients(clients []*SSH) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
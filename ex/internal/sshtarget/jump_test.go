@@ -0,0 +1,138 @@
+package sshtarget_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/clientserverpair"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server.
+type testServer struct {
+	dialer  clientserverpair.Dialer
+	hostKey ssh.PublicKey
+	stop    func()
+}
+
+// newServer creates a server that handles direct-tcpip channels with the
+// given function.
+func newServer(logger log.Logger, directTCPIP func(host string, port uint32) (net.Conn, error)) *testServer {
+	d, hostKey, stop := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{
+		DirectTCPIP: directTCPIP,
+	})
+	return &testServer{dialer: d, hostKey: hostKey, stop: stop}
+}
+
+// newJumpServer creates a server that forwards direct-tcpip channels to the
+// next server, recording the addresses that were requested.
+func newJumpServer(logger log.Logger, next clientserverpair.Dialer, requested *[]string) *testServer {
+	var mu sync.Mutex
+	return newServer(logger, func(host string, port uint32) (net.Conn, error) {
+		address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		mu.Lock()
+		*requested = append(*requested, address)
+		mu.Unlock()
+		return next.DialContext(context.Background(), "tcp", address)
+	})
+}
+
+// close stops the server.
+func (ts *testServer) close() {
+	ts.stop()
+	if v, ok := ts.dialer.(io.Closer); ok {
+		v.Close()
+	}
+}
+
+func TestJumpHosts(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, _ := testlogger.NewTestLogger(t, log.Warn)
+	targetDialer, targetKey, stopTarget := sshtarget.NewSSHServerWithConfig(logger, nil)
+	target := &testServer{dialer: targetDialer, hostKey: targetKey, stop: stopTarget}
+	var requested2, requested1 []string
+	bastion2 := newJumpServer(logger, target.dialer, &requested2)
+	bastion1 := newJumpServer(logger, bastion2.dialer, &requested1)
+	defer func() {
+		bastion1.close()
+		bastion2.close()
+		target.close()
+		time.Sleep(50 * time.Millisecond)
+	}()
+
+	password := []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")}
+	hop := func(host string, hostKey ssh.PublicKey, auths []sshtarget.Authorizer) sshtarget.JumpHost {
+		return sshtarget.JumpHost{
+			Host:            host,
+			Port:            22,
+			User:            "test",
+			Auths:           auths,
+			HostKeyCallback: sshtarget.FixedHostKey(hostKey),
+		}
+	}
+	connect := func(targetKey ssh.PublicKey, hops ...sshtarget.JumpHost) (*sshtarget.SSHTarget, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return sshtarget.New(ctx, logger, bastion1.dialer, "db.internal", 2222,
+			[]sshtarget.Option{
+				sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(targetKey)),
+				sshtarget.JumpHostsOption(hops...),
+			},
+			"test", password)
+	}
+
+	t.Run("Two Hops", func(t2 *testing.T) {
+		st, err := connect(target.hostKey,
+			hop("bastion1.example.com", bastion1.hostKey, password),
+			hop("bastion2.internal", bastion2.hostKey, password))
+		require.NoError(t2, err, "unable to connect through jump hosts")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		rec, err := st.Command("whoami").Run(ctx)
+		require.NoError(t2, err, "unable to run command")
+		buf := &bytes.Buffer{}
+		require.NoError(t2, rec.Replay(buf, buf, 0))
+		assert.Equal(t2, "test\n", buf.String(), "unexpected command output")
+		require.NoError(t2, st.Close(), "unable to close target")
+
+		assert.Equal(t2, []string{"bastion2.internal:22"}, requested1, "unexpected address requested from first hop")
+		assert.Equal(t2, []string{"db.internal:2222"}, requested2, "unexpected address requested from second hop")
+	})
+
+	t.Run("Wrong Jump Host Key", func(t2 *testing.T) {
+		_, err := connect(target.hostKey,
+			hop("bastion1.example.com", generateKey(ecdsa.PublicKey{}), password),
+			hop("bastion2.internal", bastion2.hostKey, password))
+		require.Error(t2, err, "wrong jump host key must be rejected")
+		assert.Contains(t2, err.Error(), "bastion1.example.com:22", "error must name the jump host")
+	})
+
+	t.Run("Wrong Target Key", func(t2 *testing.T) {
+		_, err := connect(generateKey(ecdsa.PublicKey{}),
+			hop("bastion1.example.com", bastion1.hostKey, password),
+			hop("bastion2.internal", bastion2.hostKey, password))
+		assert.Error(t2, err, "wrong target key must be rejected")
+	})
+
+	t.Run("Jump Host Authentication", func(t2 *testing.T) {
+		_, err := connect(target.hostKey,
+			hop("bastion1.example.com", bastion1.hostKey, []sshtarget.Authorizer{sshtarget.NewPasswordAuth("wrong")}),
+			hop("bastion2.internal", bastion2.hostKey, password))
+		assert.Error(t2, err, "jump host authentication must be separate")
+	})
+}
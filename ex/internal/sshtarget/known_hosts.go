@@ -121,7 +121,7 @@ func AddToKnownHosts(f io.WriteSeeker, hosts []string, pubKey ssh.PublicKey, dis
 		m = mRevoked + " "
 	}
 
-	_, err = fmt.Fprint(f, m, newLine)
+	_, err = fmt.Fprintln(f, m+newLine)
 	return errors.Wrap(err, "unable to write new known_hosts line")
 }
 
@@ -136,16 +136,40 @@ func DefaultKnownHosts() ([]string, error) {
 // KnownHostsFilesCallback creates a host key callback using the hosts
 // specified in the given known_hosts files.
 //
+// Lines marked with "@cert-authority" are honoured, so a host presenting a
+// host certificate signed by one of those authorities is accepted, as long as
+// the certificate is currently valid and lists the host as a principal.
+// Keys on lines marked with "@revoked" are always rejected.
+//
 // To support adding host keys dynamically, the returned HostKeyCallback may
 // be wrapped in a function to support handling the returned errors from the
 // callback.
 func KnownHostsFilesCallback(knownHostsPaths ...string) (ssh.HostKeyCallback, error) {
-	return knownhosts.New(knownHostsPaths...)
+	db := &knownHostsDB{}
+	for _, p := range knownHostsPaths {
+		if err := db.readFile(p); err != nil {
+			return nil, err
+		}
+	}
+	return db.checkHostKey, nil
+}
+
+// hostKeyCause returns the error from the host key callback if the given error
+// was caused by a rejected host key, or the cause of the error otherwise.
+func hostKeyCause(e error) error {
+	e = errors.Cause(e)
+	if hke, ok := e.(*HostKeyError); ok {
+		return errors.Cause(hke.Err)
+	}
+	return e
 }
 
 // IsUnknownHost indicates if the given error was due to an unknown host.
+//
+// Errors wrapping a *HostKeyError, such as those returned from New, are
+// supported.
 func IsUnknownHost(e error) bool {
-	if ke, ok := e.(*knownhosts.KeyError); ok {
+	if ke, ok := hostKeyCause(e).(*knownhosts.KeyError); ok {
 		return len(ke.Want) == 0
 	}
 	return false
@@ -157,7 +181,7 @@ func IsUnknownHost(e error) bool {
 // If this returns true, then it may be an indication of a
 // man-in-the-middle attack.
 func IsKeyChange(e error) bool {
-	if ke, ok := e.(*knownhosts.KeyError); ok {
+	if ke, ok := hostKeyCause(e).(*knownhosts.KeyError); ok {
 		return len(ke.Want) > 0
 	}
 	return false
@@ -166,6 +190,6 @@ func IsKeyChange(e error) bool {
 // IsRevoked indicates if the given error was due to a revoked host key
 // being given.
 func IsRevoked(e error) bool {
-	_, ok := e.(*knownhosts.RevokedError)
+	_, ok := hostKeyCause(e).(*knownhosts.RevokedError)
 	return ok
 }
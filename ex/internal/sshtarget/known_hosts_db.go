@@ -0,0 +1,258 @@
+package sshtarget
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsLine is a single host key line of a known_hosts file.
+type knownHostsLine struct {
+	marker   KnownHostsMarker
+	patterns []string
+	key      ssh.PublicKey
+	filename string
+	line     int
+}
+
+// knownKey returns the line in the form used by the knownhosts errors.
+func (khl *knownHostsLine) knownKey() knownhosts.KnownKey {
+	return knownhosts.KnownKey{
+		Key:      khl.key,
+		Filename: khl.filename,
+		Line:     khl.line,
+	}
+}
+
+// knownHostsDB is a set of host keys read from known_hosts files.
+//
+// The knownhosts package is not used directly as it treats keys of
+// "@cert-authority" lines as regular host keys, causing hosts that present a
+// plain host key to be reported as having changed keys.
+type knownHostsDB struct {
+	lines []knownHostsLine
+}
+
+// readFile reads all of the host keys from the known_hosts file at the given
+// path.
+func (db *knownHostsDB) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to open known_hosts file")
+	}
+	defer f.Close()
+
+	return db.read(f, path)
+}
+
+// read reads all of the host keys from the given known_hosts contents.
+func (db *knownHostsDB) read(r io.Reader, filename string) error {
+	s := bufio.NewScanner(r)
+	var lineNum int
+	for s.Scan() {
+		lineNum++
+		entry, err := parseKnownHostsLine(s.Text())
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", filename, lineNum)
+		}
+		if entry == nil {
+			continue
+		}
+		db.lines = append(db.lines, knownHostsLine{
+			marker:   entry.Marker,
+			patterns: entry.Hosts,
+			key:      entry.Key,
+			filename: filename,
+			line:     lineNum,
+		})
+	}
+	return errors.Wrap(s.Err(), "unable to read known_hosts file")
+}
+
+// parseKnownHostsLine parses a single line of a known_hosts file.
+//
+// A nil entry is returned for blank lines and comments.
+func parseKnownHostsLine(line string) (*KnownHostsEntry, error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+
+	m, hosts, key, comment, _, err := ssh.ParseKnownHosts([]byte(line))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid known_hosts line")
+	}
+	entry := &KnownHostsEntry{
+		Hosts:   hosts,
+		Key:     key,
+		Comment: comment,
+	}
+	switch m {
+	case "":
+		entry.Marker = MarkerNone
+	case mCertAuthority[1:]:
+		entry.Marker = MarkerCertAuthority
+	case mRevoked[1:]:
+		entry.Marker = MarkerRevoked
+	default:
+		return nil, errors.Errorf("unknown known_hosts marker %q", m)
+	}
+	return entry, nil
+}
+
+// isRevoked reports whether the key has been revoked.
+func (db *knownHostsDB) isRevoked(key ssh.PublicKey) *knownHostsLine {
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.marker == MarkerRevoked && keysEqual(l.key, key) {
+			return l
+		}
+	}
+	return nil
+}
+
+// hasAuthority reports whether any certificate authority is trusted for the
+// given address.
+func (db *knownHostsDB) hasAuthority(address string) bool {
+	host := knownhosts.Normalize(address)
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.marker == MarkerCertAuthority && matchKnownHostsPatterns(l.patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostAuthority reports whether the key is a certificate authority that is
+// trusted for the given address.
+func (db *knownHostsDB) isHostAuthority(auth ssh.PublicKey, address string) bool {
+	host := knownhosts.Normalize(address)
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.marker == MarkerCertAuthority && keysEqual(l.key, auth) && matchKnownHostsPatterns(l.patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostKey is an ssh.HostKeyCallback that verifies host keys and host
+// certificates against the known hosts.
+//
+// Certificates for hosts without a trusted certificate authority are checked
+// as plain host keys, in the same way as ssh(1).
+func (db *knownHostsDB) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if db.hasAuthority(hostname) {
+			checker := &ssh.CertChecker{
+				IsHostAuthority: db.isHostAuthority,
+				IsRevoked: func(cert *ssh.Certificate) bool {
+					return db.isRevoked(cert.Key) != nil || db.isRevoked(cert.SignatureKey) != nil
+				},
+			}
+			return checker.CheckHostKey(hostname, remote, key)
+		}
+		key = cert.Key
+	}
+	return db.check(hostname, remote, key)
+}
+
+// check verifies a plain host key.
+//
+// Only keys listed for the host name are accepted, as with knownhosts.New, so
+// that a key listed for the remote address does not hide a changed key. The
+// remote address is used only if there is no host name.
+func (db *knownHostsDB) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if l := db.isRevoked(key); l != nil {
+		return &knownhosts.RevokedError{Revoked: l.knownKey()}
+	}
+
+	address := hostname
+	if address == "" && remote != nil {
+		address = remote.String()
+	}
+	host := knownhosts.Normalize(address)
+
+	keyErr := &knownhosts.KeyError{}
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.marker != MarkerNone {
+			continue
+		}
+		if !matchKnownHostsPatterns(l.patterns, host) {
+			continue
+		}
+		if keysEqual(l.key, key) {
+			return nil
+		}
+		keyErr.Want = append(keyErr.Want, l.knownKey())
+	}
+	return keyErr
+}
+
+// matchKnownHostsPatterns reports whether the normalized host matches the
+// patterns of a known_hosts line, which may include hashed host names.
+func matchKnownHostsPatterns(patterns []string, host string) bool {
+	var plain []string
+	var hashMatched bool
+	for _, p := range patterns {
+		if strings.HasPrefix(p, hashMagic) {
+			if matchHashedHost(p, host) {
+				hashMatched = true
+			}
+			continue
+		}
+		plain = append(plain, p)
+	}
+
+	if hashMatched {
+		// Negated patterns still take precedence.
+		for _, p := range plain {
+			if strings.HasPrefix(p, "!") && wildcardMatch(strings.ToLower(p[1:]), strings.ToLower(host)) {
+				return false
+			}
+		}
+		return true
+	}
+	return MatchHostPatterns(plain, host)
+}
+
+// hashMagic is the prefix of hashed host names.
+const hashMagic = "|1|"
+
+// matchHashedHost reports whether the hashed host name is a hash of the given
+// host.
+func matchHashedHost(hashed, host string) bool {
+	parts := strings.Split(hashed[len(hashMagic):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// keysEqual reports whether the two keys are the same.
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
@@ -0,0 +1,325 @@
+package sshtarget
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsEntry is a host key line of a known_hosts file.
+type KnownHostsEntry struct {
+	// Marker is the marker of the line, if any.
+	Marker KnownHostsMarker
+	// Hosts are the host patterns of the line, which may be hashed.
+	Hosts []string
+	// Key is the host key, or certificate authority key, of the line.
+	Key ssh.PublicKey
+	// Comment is the comment following the key, if any.
+	Comment string
+	// Line is the line number of the entry in the file, starting from 1.
+	Line int
+}
+
+// String returns the entry formatted as a known_hosts line, without a trailing
+// newline.
+func (khe *KnownHostsEntry) String() string {
+	var sb strings.Builder
+	if khe.Marker != MarkerNone {
+		sb.WriteString(khe.Marker.String())
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(strings.Join(khe.Hosts, ","))
+	sb.WriteByte(' ')
+	sb.WriteString(strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(khe.Key)), "\n"))
+	if khe.Comment != "" {
+		sb.WriteByte(' ')
+		sb.WriteString(khe.Comment)
+	}
+	return sb.String()
+}
+
+// knownHostsFileLine is a line of a known_hosts file.
+type knownHostsFileLine struct {
+	// raw is the text of the line as it was read. It is written out as is,
+	// unless the entry has been modified.
+	raw string
+	// entry is the parsed line. It is nil for blank lines, comments, and lines
+	// that could not be parsed.
+	entry *KnownHostsEntry
+	// modified indicates that the line needs to be written from the entry.
+	modified bool
+}
+
+// KnownHostsFile is a parsed known_hosts file that may be modified and saved.
+//
+// Comments, blank lines, and lines that cannot be parsed are preserved as they
+// are. Unmodified entries are also written out unchanged.
+//
+// KnownHostsFile is not safe for concurrent use.
+type KnownHostsFile struct {
+	path  string
+	lines []*knownHostsFileLine
+}
+
+// LoadKnownHostsFile reads the known_hosts file at the given path.
+//
+// A missing file is treated as being empty, and is created when saved.
+func LoadKnownHostsFile(path string) (*KnownHostsFile, error) {
+	khf := &KnownHostsFile{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return khf, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open known_hosts file")
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Unparseable lines are kept as is.
+		entry, _ := parseKnownHostsLine(s.Text())
+		khf.lines = append(khf.lines, &knownHostsFileLine{
+			raw:   s.Text(),
+			entry: entry,
+		})
+	}
+	if err = s.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read known_hosts file")
+	}
+
+	return khf, nil
+}
+
+// Path returns the path of the file.
+func (khf *KnownHostsFile) Path() string {
+	return khf.path
+}
+
+// entries returns the entries for which the filter returns true.
+func (khf *KnownHostsFile) entries(filter func(*KnownHostsEntry) bool) []KnownHostsEntry {
+	var entries []KnownHostsEntry
+	for i, l := range khf.lines {
+		if l.entry == nil || !filter(l.entry) {
+			continue
+		}
+		entry := *l.entry
+		entry.Hosts = append([]string(nil), l.entry.Hosts...)
+		entry.Line = i + 1
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Entries returns all of the entries of the file, in order.
+func (khf *KnownHostsFile) Entries() []KnownHostsEntry {
+	return khf.entries(func(*KnownHostsEntry) bool { return true })
+}
+
+// Lookup returns the entries that apply to the given host, including entries
+// with hashed host names.
+//
+// The host may include a port, in which case only entries for that port match.
+func (khf *KnownHostsFile) Lookup(host string) []KnownHostsEntry {
+	norm := knownhosts.Normalize(host)
+	return khf.entries(func(e *KnownHostsEntry) bool {
+		return e.Marker == MarkerRevoked || matchKnownHostsPatterns(e.Hosts, norm)
+	})
+}
+
+// Add adds a line for the given hosts and key to the end of the file.
+//
+// The hosts are hashed unless hashing is disabled.
+func (khf *KnownHostsFile) Add(hosts []string, key ssh.PublicKey, disableHashing bool, marker KnownHostsMarker) {
+	addrs := make([]string, len(hosts))
+	for i, v := range hosts {
+		norm := knownhosts.Normalize(v)
+		if disableHashing {
+			addrs[i] = norm
+		} else {
+			addrs[i] = knownhosts.HashHostname(norm)
+		}
+	}
+	khf.lines = append(khf.lines, &knownHostsFileLine{
+		entry: &KnownHostsEntry{
+			Marker: marker,
+			Hosts:  addrs,
+			Key:    key,
+		},
+		modified: true,
+	})
+}
+
+// Remove removes the host key lines that apply to the given host, in the same
+// way as "ssh-keygen -R". Certificate authority and revocation lines are kept.
+//
+// The number of removed lines is returned.
+func (khf *KnownHostsFile) Remove(host string) int {
+	norm := knownhosts.Normalize(host)
+	return khf.removeLines(func(e *KnownHostsEntry) bool {
+		return e.Marker == MarkerNone && matchKnownHostsPatterns(e.Hosts, norm)
+	})
+}
+
+// RemoveKey removes the host key lines with the given key, regardless of the
+// hosts they apply to. Certificate authority and revocation lines are kept.
+//
+// The number of removed lines is returned.
+func (khf *KnownHostsFile) RemoveKey(key ssh.PublicKey) int {
+	return khf.removeLines(func(e *KnownHostsEntry) bool {
+		return e.Marker == MarkerNone && keysEqual(e.Key, key)
+	})
+}
+
+// removeLines removes the entries for which the filter returns true.
+func (khf *KnownHostsFile) removeLines(filter func(*KnownHostsEntry) bool) int {
+	kept := khf.lines[:0]
+	for _, l := range khf.lines {
+		if l.entry != nil && filter(l.entry) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	removed := len(khf.lines) - len(kept)
+	for i := len(kept); i < len(khf.lines); i++ {
+		khf.lines[i] = nil
+	}
+	khf.lines = kept
+	return removed
+}
+
+// Hash replaces the plaintext host names of host key lines with hashed host
+// names, in the same way as "ssh-keygen -H".
+//
+// A hashed host field holds a single host, so lines for multiple hosts are
+// replaced with a line for each host, with the same marker, key and comment.
+//
+// Patterns containing wildcards or negations cannot be hashed, so lines with
+// them are left unchanged, as are certificate authority and revocation lines.
+//
+// The number of changed lines is returned.
+func (khf *KnownHostsFile) Hash() int {
+	var changed int
+	lines := make([]*knownHostsFileLine, 0, len(khf.lines))
+	for _, l := range khf.lines {
+		if l.entry == nil || l.entry.Marker != MarkerNone || !canHashPatterns(l.entry.Hosts) ||
+			(len(l.entry.Hosts) == 1 && strings.HasPrefix(l.entry.Hosts[0], hashMagic)) {
+			lines = append(lines, l)
+			continue
+		}
+
+		for _, h := range l.entry.Hosts {
+			if !strings.HasPrefix(h, hashMagic) {
+				h = knownhosts.HashHostname(h)
+			}
+			entry := *l.entry
+			entry.Hosts = []string{h}
+			lines = append(lines, &knownHostsFileLine{
+				entry:    &entry,
+				modified: true,
+			})
+		}
+		changed++
+	}
+	khf.lines = lines
+	return changed
+}
+
+// canHashPatterns reports whether all of the patterns are plain host names.
+func canHashPatterns(patterns []string) bool {
+	for _, p := range patterns {
+		if strings.ContainsAny(p, "*?!") {
+			return false
+		}
+	}
+	return true
+}
+
+// Revoke marks the given key as revoked by adding a "@revoked" line for it.
+//
+// Nothing is added if the key is already revoked. Existing lines with the key
+// are left as is, as revoked keys are rejected for all hosts.
+//
+// Returns true if a line was added.
+func (khf *KnownHostsFile) Revoke(key ssh.PublicKey) bool {
+	for _, l := range khf.lines {
+		if l.entry != nil && l.entry.Marker == MarkerRevoked && keysEqual(l.entry.Key, key) {
+			return false
+		}
+	}
+	khf.Add([]string{"*"}, key, true, MarkerRevoked)
+	return true
+}
+
+// WriteTo writes the contents of the file to the given writer.
+func (khf *KnownHostsFile) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, l := range khf.lines {
+		line := l.raw
+		if l.modified {
+			line = l.entry.String()
+		}
+		written, err := bw.WriteString(line + "\n")
+		n += int64(written)
+		if err != nil {
+			return n, errors.Wrap(err, "unable to write known_hosts line")
+		}
+	}
+	return n, errors.Wrap(bw.Flush(), "unable to write known_hosts file")
+}
+
+// Save writes the file back to its path.
+//
+// The file is replaced atomically, so readers never see partially written
+// contents. The permissions of an existing file are kept.
+//
+// Changes made to the file on disk since it was loaded are overwritten.
+func (khf *KnownHostsFile) Save() (err error) {
+	mu := knownHostsLock(khf.path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	mode := os.FileMode(0600)
+	if fi, statErr := os.Stat(khf.path); statErr == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	dir := filepath.Dir(khf.path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "unable to create known_hosts directory")
+	}
+	tmp, err := ioutil.TempFile(dir, ".known_hosts")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary known_hosts file")
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = khf.WriteTo(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return errors.Wrap(err, "unable to set known_hosts permissions")
+	}
+	if err = tmp.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync known_hosts file")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to close known_hosts file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), khf.path), "unable to replace known_hosts file")
+}
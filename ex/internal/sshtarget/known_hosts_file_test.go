@@ -0,0 +1,194 @@
+package sshtarget_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// authorizedKey returns the key in the format used in known_hosts files.
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestKnownHostsFileModel(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	webKey := generateKey(ecdsa.PublicKey{})
+	dbKey := generateKey(ecdsa.PublicKey{})
+	caKey := generateKey(ecdsa.PublicKey{})
+	gitKey := generateKey(rsa.PublicKey{})
+
+	contents := strings.Join([]string{
+		"# Managed by hand.",
+		"web.example.com,192.0.2.10 " + authorizedKey(webKey) + " web server",
+		"",
+		knownhosts.HashHostname("db.example.com") + " " + authorizedKey(dbKey),
+		"@cert-authority *.example.com " + authorizedKey(caKey),
+		"[git.example.com]:2222 " + authorizedKey(gitKey),
+		"@unknown-marker host.example.com " + authorizedKey(gitKey),
+		"",
+	}, "\n")
+	path := filepath.Join(dir, "known_hosts")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644), "unable to write known_hosts file")
+
+	khf, err := sshtarget.LoadKnownHostsFile(path)
+	require.NoError(t, err, "unable to load known_hosts file")
+
+	// Entries.
+	entries := khf.Entries()
+	require.Len(t, entries, 4, "unexpected number of entries")
+	assert.Equal(t, []string{"web.example.com", "192.0.2.10"}, entries[0].Hosts, "unexpected hosts")
+	assert.Equal(t, "web server", entries[0].Comment, "unexpected comment")
+	assert.Equal(t, 2, entries[0].Line, "unexpected line number")
+	assert.Equal(t, sshtarget.MarkerCertAuthority, entries[2].Marker, "unexpected marker")
+
+	// Lookup.
+	found := khf.Lookup("db.example.com:22")
+	require.Len(t, found, 2, "hashed entry and certificate authority must be found")
+	assert.Equal(t, authorizedKey(dbKey), authorizedKey(found[0].Key), "unexpected key for hashed entry")
+	assert.Equal(t, sshtarget.MarkerCertAuthority, found[1].Marker, "unexpected marker")
+	found = khf.Lookup("git.example.com:2222")
+	require.Len(t, found, 1, "unexpected entries for host with port")
+	assert.Equal(t, authorizedKey(gitKey), authorizedKey(found[0].Key), "unexpected key for host with port")
+	found = khf.Lookup("git.example.com")
+	require.Len(t, found, 1, "port must be matched")
+	assert.Equal(t, sshtarget.MarkerCertAuthority, found[0].Marker, "unexpected marker")
+	assert.Empty(t, khf.Lookup("example.org"), "unexpected entries for unknown host")
+
+	// Unmodified files are written out unchanged.
+	require.NoError(t, khf.Save(), "unable to save known_hosts file")
+	saved, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "unable to read known_hosts file")
+	assert.Equal(t, contents, string(saved), "unmodified file changed")
+	fi, err := os.Stat(path)
+	require.NoError(t, err, "unable to stat known_hosts file")
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm(), "file permissions must be kept")
+
+	// Remove.
+	assert.Equal(t, 1, khf.Remove("db.example.com"), "unexpected number of removed lines")
+	assert.Empty(t, khf.Remove("db.example.com"), "lines removed twice")
+	assert.Equal(t, 1, khf.RemoveKey(gitKey), "unexpected number of removed lines")
+	assert.Len(t, khf.Entries(), 2, "unexpected number of entries after removal")
+
+	// Hash.
+	assert.Equal(t, 1, khf.Hash(), "unexpected number of hashed lines")
+	assert.Empty(t, khf.Hash(), "lines hashed twice")
+	found = khf.Lookup("192.0.2.10")
+	require.Len(t, found, 1, "hashed entry must be found")
+	assert.True(t, strings.HasPrefix(found[0].Hosts[0], "|1|"), "host name not hashed")
+	assert.Equal(t, "web server", found[0].Comment, "comment must be kept")
+	assert.Equal(t, []string{"*.example.com"}, khf.Lookup("web.example.com")[1].Hosts,
+		"certificate authority patterns must not be hashed")
+
+	// Revoke.
+	assert.True(t, khf.Revoke(webKey), "key must be revoked")
+	assert.False(t, khf.Revoke(webKey), "key revoked twice")
+
+	require.NoError(t, khf.Save(), "unable to save known_hosts file")
+	saved, err = ioutil.ReadFile(path)
+	require.NoError(t, err, "unable to read known_hosts file")
+	assert.True(t, strings.HasPrefix(string(saved), "# Managed by hand.\n"), "comment must be kept")
+	assert.Contains(t, string(saved), "@unknown-marker host.example.com", "unknown line must be kept")
+	assert.Contains(t, string(saved), "\n\n", "blank line must be kept")
+
+	// The saved file is usable for host key verification, apart from the
+	// unknown line.
+	clean := strings.Replace(string(saved), "@unknown-marker", "#", 1)
+	require.NoError(t, ioutil.WriteFile(path, []byte(clean), 0644), "unable to write known_hosts file")
+	cb, err := sshtarget.KnownHostsFilesCallback(path)
+	require.NoError(t, err, "unable to create known_hosts callback")
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	assert.True(t, sshtarget.IsRevoked(cb("web.example.com:22", remote, webKey)), "revoked key accepted")
+	remote = &net.TCPAddr{IP: net.ParseIP("192.0.2.20"), Port: 22}
+	assert.True(t, sshtarget.IsUnknownHost(cb("db.example.com:22", remote, dbKey)), "removed key accepted")
+}
+
+func TestKnownHostsFileMissing(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".ssh", "known_hosts")
+	khf, err := sshtarget.LoadKnownHostsFile(path)
+	require.NoError(t, err, "missing file must be treated as empty")
+	assert.Empty(t, khf.Entries(), "unexpected entries")
+
+	key := generateKey(ecdsa.PublicKey{})
+	khf.Add([]string{"db.example.com:2222"}, key, true, sshtarget.MarkerNone)
+	require.NoError(t, khf.Save(), "unable to save known_hosts file")
+
+	saved, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "unable to read known_hosts file")
+	assert.Equal(t, fmt.Sprintf("[db.example.com]:2222 %s\n", authorizedKey(key)), string(saved),
+		"unexpected file contents")
+	fi, err := os.Stat(path)
+	require.NoError(t, err, "unable to stat known_hosts file")
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "unexpected permissions for new file")
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err, "unable to read directory")
+	assert.Len(t, files, 1, "temporary files must not be left behind")
+}
+
+func TestKnownHostsFileHashMultipleHosts(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	key := generateKey(ecdsa.PublicKey{})
+	path := filepath.Join(dir, "known_hosts")
+	contents := "a,b " + authorizedKey(key) + " shared\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644), "unable to write known_hosts file")
+
+	khf, err := sshtarget.LoadKnownHostsFile(path)
+	require.NoError(t, err, "unable to load known_hosts file")
+	assert.Equal(t, 1, khf.Hash(), "unexpected number of hashed lines")
+
+	entries := khf.Entries()
+	require.Len(t, entries, 2, "each host must be given its own line")
+	for i, host := range []string{"a", "b"} {
+		require.Len(t, entries[i].Hosts, 1, "hashed line must have a single host")
+		assert.True(t, strings.HasPrefix(entries[i].Hosts[0], "|1|"), "host name not hashed")
+		assert.Equal(t, authorizedKey(key), authorizedKey(entries[i].Key), "key must be kept")
+		assert.Equal(t, "shared", entries[i].Comment, "comment must be kept")
+		found := khf.Lookup(host)
+		require.Len(t, found, 1, "hashed host must be found")
+		assert.Equal(t, i+1, found[0].Line, "unexpected line for host")
+	}
+	assert.Empty(t, khf.Hash(), "lines hashed twice")
+
+	// Each saved line is a single hashed host, as OpenSSH expects.
+	require.NoError(t, khf.Save(), "unable to save known_hosts file")
+	saved, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "unable to read known_hosts file")
+	lines := strings.Split(strings.TrimSuffix(string(saved), "\n"), "\n")
+	require.Len(t, lines, 2, "unexpected number of saved lines")
+	for _, line := range lines {
+		assert.NotContains(t, strings.Fields(line)[0], ",", "hashed hosts must not be joined")
+	}
+	cb, err := sshtarget.KnownHostsFilesCallback(path)
+	require.NoError(t, err, "unable to create known_hosts callback")
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.30"), Port: 22}
+	assert.NoError(t, cb("b:22", remote, key), "hashed host must be accepted")
+}
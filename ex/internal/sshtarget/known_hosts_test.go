@@ -2,6 +2,7 @@ package sshtarget_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,10 +15,14 @@ import (
 	"os"
 	"os/user"
 	"testing"
+	"time"
 
 	errors2 "github.com/pkg/errors"
 	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
 	"github.com/rwool/ex/test/helpers/comperr"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
@@ -318,7 +323,7 @@ func TestKnownHostsFile(t *testing.T) {
 	require.True(t, sshtarget.IsUnknownHost(err), "Host must be unknown")
 
 	// Known host.
-	err = sshtarget.AddToKnownHosts(f, []string{hostIP}, sshPubKey, true, sshtarget.MarkerNone)
+	err = sshtarget.AddToKnownHosts(f, []string{hostname, hostIP}, sshPubKey, true, sshtarget.MarkerNone)
 	require.NoError(t, err, "known_hosts host addition does not fail.")
 	_, err = f.Seek(0, io.SeekStart)
 	require.NoError(t, err, "Seek to file beginning does not fail.")
@@ -336,7 +341,7 @@ func TestKnownHostsFile(t *testing.T) {
 	rsaPrivKey2, err := rsa.GenerateKey(rand.Reader, 1024)
 	require.NoError(t, err, "Private key generation does not fail.")
 	sshPubKey2, err := ssh.NewPublicKey(rsaPrivKey2.Public())
-	err = sshtarget.AddToKnownHosts(f, []string{hostIP}, sshPubKey2, true, sshtarget.MarkerNone)
+	err = sshtarget.AddToKnownHosts(f, []string{hostname, hostIP}, sshPubKey2, true, sshtarget.MarkerNone)
 	require.NoError(t, err, "known_hosts host addition does not fail.")
 	cb, err = sshtarget.KnownHostsFilesCallback(f.Name())
 	require.NoError(t, err, "Known host file callback creation does not fail.")
@@ -363,3 +368,128 @@ func TestKnownHostsFile(t *testing.T) {
 	}, sshPubKey)
 	require.True(t, sshtarget.IsRevoked(err), "Key revocation detected.")
 }
+
+func TestKnownHostsFileHostNamePreferred(t *testing.T) {
+	t.Parallel()
+	f, err := ioutil.TempFile("", "my_temp")
+	require.NoError(t, err, "Temp file creation does not fail.")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	nameKey := generateKey(ecdsa.PublicKey{})
+	ipKey := generateKey(ecdsa.PublicKey{})
+	require.NoError(t, sshtarget.AddToKnownHosts(f, []string{"server.example.com"}, nameKey, true, sshtarget.MarkerNone))
+	require.NoError(t, sshtarget.AddToKnownHosts(f, []string{"192.0.2.10"}, ipKey, true, sshtarget.MarkerNone))
+	cb, err := sshtarget.KnownHostsFilesCallback(f.Name())
+	require.NoError(t, err, "Known host file callback creation does not fail.")
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	assert.NoError(t, cb("server.example.com:22", remote, nameKey), "Key for host name must be accepted.")
+	assert.True(t, sshtarget.IsKeyChange(cb("server.example.com:22", remote, ipKey)),
+		"Key for remote address must not hide a changed key.")
+	assert.NoError(t, cb("", remote, ipKey), "Remote address must be used without a host name.")
+	assert.True(t, sshtarget.IsUnknownHost(cb("other.example.com:22", remote, ipKey)),
+		"Key for remote address must not be used for other host names.")
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	otherKey := generateKey(ecdsa.PublicKey{})
+
+	// knownHosts creates a callback from a known_hosts file with the given
+	// key added for the server.
+	knownHosts := func(t *testing.T, key ssh.PublicKey, marker sshtarget.KnownHostsMarker) sshtarget.HostKeyCallback {
+		f, err := ioutil.TempFile("", "known_hosts")
+		require.NoError(t, err, "unable to create temporary file")
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		if key != nil {
+			err = sshtarget.AddToKnownHosts(f, []string{"127.0.0.1:22"}, key, false, marker)
+			require.NoError(t, err, "unable to add host key")
+		}
+		cb, err := sshtarget.KnownHostsFilesCallback(f.Name())
+		require.NoError(t, err, "unable to create known_hosts callback")
+		return cb
+	}
+
+	tcs := []struct {
+		Name     string
+		Callback func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback
+		Check    func(error) bool
+	}{
+		{
+			Name: "Fixed Key",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return sshtarget.FixedHostKey(hostKey)
+			},
+		},
+		{
+			Name: "Wrong Fixed Key",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return sshtarget.FixedHostKey(otherKey)
+			},
+			Check: func(err error) bool {
+				_, ok := errors2.Cause(err).(*sshtarget.HostKeyError)
+				return ok
+			},
+		},
+		{
+			Name: "Known Host",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return knownHosts(t, hostKey, sshtarget.MarkerNone)
+			},
+		},
+		{
+			Name: "Unknown Host",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return knownHosts(t, nil, sshtarget.MarkerNone)
+			},
+			Check: sshtarget.IsUnknownHost,
+		},
+		{
+			Name: "Changed Key",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return knownHosts(t, otherKey, sshtarget.MarkerNone)
+			},
+			Check: sshtarget.IsKeyChange,
+		},
+		{
+			Name: "Revoked Key",
+			Callback: func(t *testing.T, hostKey ssh.PublicKey) sshtarget.HostKeyCallback {
+				return knownHosts(t, hostKey, sshtarget.MarkerRevoked)
+			},
+			Check: sshtarget.IsRevoked,
+		},
+	}
+
+	for _, tCase := range tcs {
+		tc := tCase
+		t.Run(tc.Name, func(t2 *testing.T) {
+			logger, _ := testlogger.NewTestLogger(t2, log.Warn)
+			dialer, hostKey, stopServer := sshtarget.NewSSHServerWithConfig(logger, nil)
+			defer func() {
+				stopServer()
+				time.Sleep(50 * time.Millisecond)
+			}()
+			if v, ok := dialer.(io.Closer); ok {
+				defer v.Close()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			target, err := sshtarget.New(ctx, logger, dialer, "127.0.0.1", 22,
+				[]sshtarget.Option{sshtarget.HostKeyValidationOption(tc.Callback(t2, hostKey))},
+				"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+			if tc.Check == nil {
+				require.NoError(t2, err, "host key must be accepted")
+				assert.NoError(t2, target.Close(), "unexpected error closing target")
+				return
+			}
+			require.Error(t2, err, "host key must be rejected")
+			assert.True(t2, tc.Check(err), "unexpected host key error: %+v", err)
+		})
+	}
+}
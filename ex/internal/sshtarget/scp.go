@@ -0,0 +1,551 @@
+package sshtarget
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// scpFileInfo is the information about a file that is sent with the scp
+// protocol.
+type scpFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	// hasTime indicates that the modification time was sent.
+	hasTime bool
+}
+
+func (fi *scpFileInfo) Name() string       { return fi.name }
+func (fi *scpFileInfo) Size() int64        { return fi.size }
+func (fi *scpFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *scpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *scpFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *scpFileInfo) Sys() interface{}   { return nil }
+
+// scpConn is one side of an exchange of the scp protocol, as spoken by
+// "scp -t", the sink, and "scp -f", the source.
+//
+// The same implementation is used for both the local and the remote side, so
+// that the test server can stand in for scp on the remote system.
+type scpConn struct {
+	ctx  context.Context
+	r    *bufio.Reader
+	w    io.Writer
+	opts *TransferOptions
+}
+
+// readLine reads a protocol line, without its trailing newline. Error messages
+// from the other side are returned as errors.
+func (c *scpConn) readLine() (string, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(noEOF(err), "unable to read scp message")
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if b == 1 || b == 2 {
+		return "", errors.New(line)
+	}
+	return string(b) + line, nil
+}
+
+// readAck reads the response of the other side to a message.
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return errors.Wrap(noEOF(err), "unable to read scp response")
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := c.r.ReadString('\n')
+		return errors.New(strings.TrimSuffix(msg, "\n"))
+	default:
+		return errors.Errorf("unexpected scp response %q", b)
+	}
+}
+
+// ack sends a successful response.
+func (c *scpConn) ack() error {
+	_, err := c.w.Write([]byte{0})
+	return errors.Wrap(err, "unable to write scp response")
+}
+
+// sendError sends an error to the other side.
+func (c *scpConn) sendError(err error) {
+	msg := strings.Replace(errors.Cause(err).Error(), "\n", " ", -1)
+	fmt.Fprintf(c.w, "\x02scp: %s\n", msg)
+}
+
+// sendLine sends a protocol line and reads the response to it.
+func (c *scpConn) sendLine(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.w, format+"\n", args...); err != nil {
+		return errors.Wrap(err, "unable to write scp message")
+	}
+	return c.readAck()
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// send sends the local file or directory at the given path, with the given
+// name, as the source side. The destination is the path that it is being
+// copied to, which is only used for reporting progress.
+//
+// Anything that is not a regular file or directory is skipped.
+func (c *scpConn) send(localPath, name, dest string, fi os.FileInfo) error {
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		return nil
+	}
+	if strings.Contains(name, "\n") {
+		return errors.Errorf("unable to send file name with newline: %q", name)
+	}
+	if err := c.ctx.Err(); err != nil {
+		return errors.Wrap(err, "transfer cancelled")
+	}
+
+	mtime := fi.ModTime().Unix()
+	if err := c.sendLine("T%d 0 %d 0", mtime, mtime); err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		if err := c.sendLine("D%04o 0 %s", fi.Mode().Perm(), name); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			return errors.Wrap(err, "unable to read local directory")
+		}
+		for _, e := range entries {
+			err = c.send(filepath.Join(localPath, e.Name()), e.Name(), path.Join(dest, e.Name()), e)
+			if err != nil {
+				return err
+			}
+		}
+		return c.sendLine("E")
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to open local file")
+	}
+	defer f.Close()
+
+	if err = c.sendLine("C%04o %d %s", fi.Mode().Perm(), fi.Size(), name); err != nil {
+		return err
+	}
+	n, err := copyWithProgress(c.ctx, c.w, io.LimitReader(f, fi.Size()), TransferProgress{
+		Source:      localPath,
+		Destination: dest,
+		Size:        fi.Size(),
+	}, c.opts)
+	if err != nil {
+		return err
+	}
+	if n != fi.Size() {
+		return errors.Errorf("%s changed size while being sent", localPath)
+	}
+	if err = c.ack(); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+// parseSCPTimes parses a "T" line, returning the modification time.
+func parseSCPTimes(line string) (time.Time, error) {
+	fields := strings.Fields(line[1:])
+	if len(fields) != 4 {
+		return time.Time{}, errors.Errorf("invalid scp times %q", line)
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid scp times %q", line)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// parseSCPEntry parses a "C" or "D" line.
+func parseSCPEntry(line string) (*scpFileInfo, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return nil, errors.Errorf("invalid scp entry %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return nil, errors.Errorf("invalid scp mode %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.Errorf("invalid scp size %q", line)
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, errors.Errorf("invalid scp file name %q", name)
+	}
+
+	fi := &scpFileInfo{
+		name: name,
+		size: size,
+		mode: os.FileMode(mode).Perm(),
+	}
+	if line[0] == 'D' {
+		fi.mode |= os.ModeDir
+	}
+	return fi, nil
+}
+
+// scpDir is a directory that is being received.
+type scpDir struct {
+	local, remote string
+	fi            *scpFileInfo
+}
+
+// receive receives files as the sink side, until the other side stops
+// sending.
+//
+// If intoDir is set, the files and directories sent are created in the target
+// directory. Otherwise, the first file or directory that is sent is created as
+// the target. The source is the path of the files on the other side, which is
+// only used for reporting progress.
+func (c *scpConn) receive(target string, intoDir bool, source string) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	var dirs []scpDir
+	var modTime *time.Time
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return errors.Wrap(err, "transfer cancelled")
+		}
+
+		line, err := c.readLine()
+		if err == io.EOF && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(noEOF(err), "scp failed")
+		}
+
+		switch line[0] {
+		case 'T':
+			t, err := parseSCPTimes(line)
+			if err != nil {
+				return err
+			}
+			modTime = &t
+		case 'C', 'D':
+			fi, err := parseSCPEntry(line)
+			if err != nil {
+				return err
+			}
+			if modTime != nil {
+				fi.modTime, fi.hasTime = *modTime, true
+				modTime = nil
+			}
+
+			local, remote := target, source
+			if len(dirs) > 0 {
+				parent := dirs[len(dirs)-1]
+				local, remote = filepath.Join(parent.local, fi.name), path.Join(parent.remote, fi.name)
+			} else if intoDir {
+				local, remote = filepath.Join(target, fi.name), path.Join(source, fi.name)
+			}
+
+			if fi.IsDir() {
+				if err = makeLocalDir(local); err != nil {
+					return err
+				}
+				dirs = append(dirs, scpDir{local: local, remote: remote, fi: fi})
+				break
+			}
+			if err = c.ack(); err != nil {
+				return err
+			}
+			if err = c.receiveFile(local, remote, fi); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unexpected end of scp directory")
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err = setLocalAttributes(d.local, d.fi); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("unexpected scp message %q", line)
+		}
+
+		if err = c.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveFile receives the contents of a file.
+func (c *scpConn) receiveFile(local, remote string, fi *scpFileInfo) error {
+	f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to create local file")
+	}
+	n, err := copyWithProgress(c.ctx, f, io.LimitReader(c.r, fi.size), TransferProgress{
+		Source:      remote,
+		Destination: local,
+		Size:        fi.size,
+	}, c.opts)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "unable to close local file")
+	}
+	if err != nil {
+		return err
+	}
+	if n != fi.size {
+		return errors.Wrap(io.ErrUnexpectedEOF, "unable to receive file")
+	}
+	if err = c.readAck(); err != nil {
+		return err
+	}
+	if err = setLocalAttributes(local, fi); err != nil {
+		return err
+	}
+	return c.ack()
+}
+
+// makeLocalDir creates a directory if it does not already exist.
+func makeLocalDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		err = os.Mkdir(dir, 0700)
+	} else if !fi.IsDir() {
+		err = errors.Errorf("%s is not a directory", dir)
+	}
+	return errors.Wrap(err, "unable to create local directory")
+}
+
+// setLocalAttributes sets the mode, and the modification time if it was sent,
+// of a received file or directory.
+func setLocalAttributes(local string, fi *scpFileInfo) error {
+	if err := os.Chmod(local, fi.mode.Perm()); err != nil {
+		return errors.Wrap(err, "unable to set local mode")
+	}
+	if !fi.hasTime {
+		return nil
+	}
+	return errors.Wrap(os.Chtimes(local, fi.modTime, fi.modTime), "unable to set local modification time")
+}
+
+// scpBackend transfers files by running scp on the remote system, for SSH
+// servers without the SFTP subsystem.
+//
+// The scp protocol has no way of listing directories or removing files, so
+// readDir and remove are not supported.
+type scpBackend struct {
+	client *SSH
+}
+
+// scpSession is a session that runs scp on the remote system.
+type scpSession struct {
+	*scpConn
+	s      *ssh.Session
+	in     io.WriteCloser
+	stderr *bytes.Buffer
+	stop   chan struct{}
+}
+
+// start runs scp on the remote system with the given arguments. The session is
+// closed if the context is done.
+func (sb *scpBackend) start(ctx context.Context, opts *TransferOptions, args ...string) (*scpSession, error) {
+	s, err := sb.client.sshClient.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create session for scp")
+	}
+	in, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to get scp input")
+	}
+	out, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to get scp output")
+	}
+	stderr := &bytes.Buffer{}
+	s.Stderr = stderr
+	if err = s.Start("scp " + shellquote.Join(args...)); err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to start scp")
+	}
+
+	ss := &scpSession{
+		scpConn: &scpConn{
+			ctx:  ctx,
+			r:    bufio.NewReader(out),
+			w:    in,
+			opts: opts,
+		},
+		s:      s,
+		in:     in,
+		stderr: stderr,
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-ss.stop:
+		}
+	}()
+	return ss, nil
+}
+
+// wait ends the input to scp and waits for it to exit.
+func (ss *scpSession) wait() error {
+	defer close(ss.stop)
+	ss.in.Close()
+	if err := ss.s.Wait(); err != nil {
+		return errors.Wrapf(err, "scp failed: %s", strings.TrimSpace(ss.stderr.String()))
+	}
+	return nil
+}
+
+// abort ends the session without waiting for scp to exit.
+func (ss *scpSession) abort() {
+	close(ss.stop)
+	ss.s.Close()
+}
+
+// finish waits for scp to exit if the exchange succeeded, or aborts it if not.
+func (ss *scpSession) finish(err error) error {
+	if err != nil {
+		ss.abort()
+		return err
+	}
+	return ss.wait()
+}
+
+func (sb *scpBackend) upload(ctx context.Context, localPath, remotePath string, opts *TransferOptions) error {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	// The sink is run in the parent directory so that the copy is created with
+	// the name of the remote path. Without -d, a missing parent directory would
+	// be taken as the path of the copy instead.
+	ss, err := sb.start(ctx, opts, "-r", "-p", "-d", "-t", path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+	err = ss.readAck()
+	if err == nil {
+		err = ss.send(localPath, path.Base(remotePath), remotePath, fi)
+	}
+	return ss.finish(err)
+}
+
+func (sb *scpBackend) download(ctx context.Context, remotePath, localPath string, opts *TransferOptions) error {
+	ss, err := sb.start(ctx, opts, "-r", "-p", "-f", remotePath)
+	if err != nil {
+		return err
+	}
+	return ss.finish(ss.receive(localPath, false, remotePath))
+}
+
+// stat gets the information about a file by starting to download it, and
+// stopping once its information has been sent.
+func (sb *scpBackend) stat(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	ss, err := sb.start(ctx, nil, "-r", "-p", "-f", remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer ss.abort()
+
+	if err = ss.ack(); err != nil {
+		return nil, err
+	}
+	var modTime *time.Time
+	for {
+		line, err := ss.readLine()
+		if err != nil {
+			return nil, errors.Wrap(noEOF(err), "scp failed")
+		}
+		switch line[0] {
+		case 'T':
+			t, err := parseSCPTimes(line)
+			if err != nil {
+				return nil, err
+			}
+			modTime = &t
+			if err = ss.ack(); err != nil {
+				return nil, err
+			}
+		case 'C', 'D':
+			fi, err := parseSCPEntry(line)
+			if err != nil {
+				return nil, err
+			}
+			if modTime != nil {
+				fi.modTime, fi.hasTime = *modTime, true
+			}
+			return fi, nil
+		default:
+			return nil, errors.Errorf("unexpected scp message %q", line)
+		}
+	}
+}
+
+func (sb *scpBackend) readDir(context.Context, string) ([]os.FileInfo, error) {
+	return nil, ErrTransferUnsupported
+}
+
+func (sb *scpBackend) remove(context.Context, string) error {
+	return ErrTransferUnsupported
+}
+
+// mkdir creates a directory by sending it without any contents.
+func (sb *scpBackend) mkdir(ctx context.Context, remotePath string, perm os.FileMode) error {
+	ss, err := sb.start(ctx, nil, "-r", "-p", "-d", "-t", path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+	err = ss.readAck()
+	if err == nil {
+		err = ss.sendLine("D%04o 0 %s", perm.Perm(), path.Base(remotePath))
+	}
+	if err == nil {
+		err = ss.sendLine("E")
+	}
+	return ss.finish(err)
+}
+
+func (sb *scpBackend) close() error {
+	return nil
+}
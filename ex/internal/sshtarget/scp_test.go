@@ -0,0 +1,103 @@
+package sshtarget_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCP(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "scp")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestTree(t, src)
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{SCP: true})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var progress []sshtarget.TransferProgress
+	remote := filepath.Join(dir, "remote")
+	err = st.Upload(ctx, src, remote, &sshtarget.TransferOptions{
+		Progress: func(p sshtarget.TransferProgress) { progress = append(progress, p) },
+	})
+	require.NoError(t, err, "unable to upload directory")
+	checkTestTree(t, remote)
+	require.NotEmpty(t, progress, "progress must be reported")
+	last := progress[len(progress)-1]
+	assert.Equal(t, filepath.Join(src, "sub", "empty"), last.Source, "unexpected last file")
+	assert.Equal(t, filepath.Join(remote, "sub", "empty"), last.Destination, "unexpected last destination")
+
+	fi, err := st.Stat(filepath.Join(remote, "a.txt"))
+	require.NoError(t, err, "unable to stat remote file")
+	assert.Equal(t, "a.txt", fi.Name(), "unexpected name")
+	assert.EqualValues(t, 6, fi.Size(), "unexpected size")
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm(), "unexpected mode")
+	assert.True(t, testTree[0].mtime.Equal(fi.ModTime()), "unexpected modification time")
+	fi, err = st.Stat(filepath.Join(remote, "sub"))
+	require.NoError(t, err, "unable to stat remote directory")
+	assert.True(t, fi.IsDir(), "must be a directory")
+
+	_, err = st.Stat(filepath.Join(dir, "missing"))
+	assert.Error(t, err, "missing file must not exist")
+	_, err = st.ReadDir(remote)
+	assert.Equal(t, sshtarget.ErrTransferUnsupported, errors.Cause(err), "unexpected error reading directory")
+	err = st.Remove(filepath.Join(remote, "a.txt"))
+	assert.Equal(t, sshtarget.ErrTransferUnsupported, errors.Cause(err), "unexpected error removing file")
+
+	downloaded := filepath.Join(dir, "downloaded")
+	require.NoError(t, st.Download(ctx, remote, downloaded, nil), "unable to download directory")
+	checkTestTree(t, downloaded)
+
+	single := filepath.Join(dir, "single.bin")
+	require.NoError(t, st.Download(ctx, filepath.Join(remote, "sub", "b.bin"), single, nil),
+		"unable to download file")
+	content, err := ioutil.ReadFile(single)
+	require.NoError(t, err)
+	assert.Equal(t, testTree[1].content, content, "unexpected downloaded content")
+
+	assert.Error(t, st.Download(ctx, filepath.Join(dir, "missing"), filepath.Join(dir, "missing"), nil),
+		"downloading missing file must fail")
+	assert.Error(t, st.Upload(ctx, src, filepath.Join(dir, "missing", "remote"), nil),
+		"uploading into missing directory must fail")
+
+	made := filepath.Join(dir, "made")
+	require.NoError(t, st.Mkdir(made, 0750), "unable to make directory")
+	fi, err = os.Stat(made)
+	require.NoError(t, err, "directory must exist")
+	assert.True(t, fi.IsDir(), "must be a directory")
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm(), "unexpected directory mode")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestTransferPrefersSFTP(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, _ := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{SFTP: true, SCP: true})
+	defer closeTarget()
+
+	dir, err := ioutil.TempDir("", "transfer")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	_, err = st.ReadDir(dir)
+	assert.NoError(t, err, "SFTP must be used when available")
+}
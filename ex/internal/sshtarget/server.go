@@ -1,16 +1,27 @@
 package sshtarget
 
 import (
+	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	errors2 "errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/kballard/go-shellquote"
+	"github.com/pkg/sftp"
 	"github.com/rwool/ex/log"
 	"github.com/rwool/ex/test/helpers/clientserverpair"
 	"github.com/rwool/ex/test/helpers/recursivelistener"
 	ssh2 "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // SSH server for testing only. Exported due to use in multiple packages.
@@ -100,3 +111,514 @@ func NewSSHServer(logger log.Logger) (d clientserverpair.Dialer, pubKey ssh2.Pub
 
 	return d, signer.PublicKey(), func() { close(cancelC); l.Close() }
 }
+
+// ServerConfig contains the optional settings for the SSH server created with
+// NewSSHServerWithConfig.
+type ServerConfig struct {
+	// PublicKeyCallback, if set, enables public key authentication.
+	PublicKeyCallback func(conn ssh2.ConnMetadata, key ssh2.PublicKey) (*ssh2.Permissions, error)
+	// KeyboardInteractiveCallback, if set, enables keyboard-interactive
+	// authentication.
+	KeyboardInteractiveCallback func(conn ssh2.ConnMetadata, client ssh2.KeyboardInteractiveChallenge) (*ssh2.Permissions, error)
+	// DirectTCPIP, if set, enables direct-tcpip channels, which are connected
+	// to the connection that it returns for the requested address.
+	DirectTCPIP func(host string, port uint32) (net.Conn, error)
+	// DirectStreamLocal, if set, enables direct-streamlocal@openssh.com
+	// channels, which are connected to the connection that it returns for the
+	// requested socket path.
+	DirectStreamLocal func(socketPath string) (net.Conn, error)
+	// Listen, if set, enables remote forwarding with the "tcpip-forward" and
+	// "streamlocal-forward@openssh.com" requests. The connections accepted by
+	// the returned listener are forwarded to the client. The network is either
+	// "tcp" or "unix".
+	Listen func(network, address string) (net.Listener, error)
+	// SFTP, if set, enables the "sftp" subsystem, which serves the local file
+	// system.
+	SFTP bool
+	// SCP, if set, makes "scp -t" and "scp -f" commands copy files to and from
+	// the local file system.
+	SCP bool
+	// RejectSessions, if set, makes session channels be rejected, so that no
+	// commands can be run.
+	RejectSessions bool
+}
+
+// NewSSHServerWithConfig creates an SSH server for testing against that
+// supports the additional features enabled with the given config.
+//
+// Unlike NewSSHServer, the server is built directly on top of the SSH library
+// to be able to support features that gliderlabs/ssh does not expose.
+// Password authentication with the same credentials is always enabled.
+func NewSSHServerWithConfig(logger log.Logger, conf *ServerConfig) (d clientserverpair.Dialer, pubKey ssh2.PublicKey, stop func()) {
+	if conf == nil {
+		conf = &ServerConfig{}
+	}
+
+	d, l := clientserverpair.New(&clientserverpair.PipeCSPairConfig{
+		Logger: logger,
+	})
+	li := recursivelistener.New(l)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh2.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	sc := &ssh2.ServerConfig{
+		PasswordCallback: func(c ssh2.ConnMetadata, password []byte) (*ssh2.Permissions, error) {
+			if c.User() == "test" && string(password) == "Password123" {
+				return nil, nil
+			}
+			return nil, errors2.New("bad password")
+		},
+		PublicKeyCallback:           conf.PublicKeyCallback,
+		KeyboardInteractiveCallback: conf.KeyboardInteractiveCallback,
+	}
+	sc.AddHostKey(signer)
+
+	go func() {
+		for {
+			c, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestConn(logger, sc, conf, c)
+		}
+	}()
+
+	// The underlying listener must be closed first to unblock the call to
+	// Accept before the accepted connections can be closed.
+	return d, signer.PublicKey(), func() { l.Close(); li.Close() }
+}
+
+// serveTestConn handles a single connection to the server created with
+// NewSSHServerWithConfig.
+func serveTestConn(logger log.Logger, sc *ssh2.ServerConfig, conf *ServerConfig, c net.Conn) {
+	conn, chans, reqs, err := ssh2.NewServerConn(c, sc)
+	if err != nil {
+		logger.Debugf("test SSH server handshake failed: %+v", err)
+		return
+	}
+	go serveTestGlobalRequests(conn, conf, reqs)
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			if conf.RejectSessions {
+				newCh.Reject(ssh2.Prohibited, "sessions not enabled")
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go serveTestSession(conn, conf, ch, chReqs)
+		case "direct-tcpip":
+			if conf.DirectTCPIP == nil {
+				newCh.Reject(ssh2.Prohibited, "direct-tcpip not enabled")
+				continue
+			}
+			serveDirectTCPIP(conf, newCh)
+		case "direct-streamlocal@openssh.com":
+			if conf.DirectStreamLocal == nil {
+				newCh.Reject(ssh2.Prohibited, "direct-streamlocal not enabled")
+				continue
+			}
+			serveDirectStreamLocal(conf, newCh)
+		default:
+			newCh.Reject(ssh2.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serveDirectTCPIP connects a direct-tcpip channel to the requested address.
+func serveDirectTCPIP(conf *ServerConfig, newCh ssh2.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh2.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ssh2.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	c, err := conf.DirectTCPIP(payload.Host, payload.Port)
+	if err != nil {
+		newCh.Reject(ssh2.ConnectionFailed, err.Error())
+		return
+	}
+	acceptProxyChannel(c, newCh)
+}
+
+// serveDirectStreamLocal connects a direct-streamlocal@openssh.com channel to
+// the requested socket.
+func serveDirectStreamLocal(conf *ServerConfig, newCh ssh2.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := ssh2.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ssh2.ConnectionFailed, "invalid direct-streamlocal request")
+		return
+	}
+	c, err := conf.DirectStreamLocal(payload.SocketPath)
+	if err != nil {
+		newCh.Reject(ssh2.ConnectionFailed, err.Error())
+		return
+	}
+	acceptProxyChannel(c, newCh)
+}
+
+// acceptProxyChannel accepts a channel and connects it to the given
+// connection.
+func acceptProxyChannel(c net.Conn, newCh ssh2.NewChannel) {
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh2.DiscardRequests(reqs)
+	proxyTestChannel(c, ch)
+}
+
+// proxyTestChannel copies data between a connection and a channel until
+// either of them is closed.
+func proxyTestChannel(c net.Conn, ch ssh2.Channel) {
+	go func() {
+		io.Copy(c, ch)
+		c.Close()
+	}()
+	go func() {
+		defer ch.Close()
+		buf := make([]byte, 1<<10)
+		for {
+			// Reads from the pipe connections return immediately when there
+			// is no data.
+			n, err := c.Read(buf)
+			if n == 0 && err == nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if _, wErr := ch.Write(buf[:n]); wErr != nil || err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// serveTestGlobalRequests handles the global requests of a connection to the
+// server created with NewSSHServerWithConfig, which are the requests for
+// remote forwarding.
+func serveTestGlobalRequests(conn *ssh2.ServerConn, conf *ServerConfig, reqs <-chan *ssh2.Request) {
+	listeners := make(map[string]net.Listener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var payload struct {
+				Addr string
+				Port uint32
+			}
+			if conf.Listen == nil || ssh2.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			l, err := conf.Listen("tcp", net.JoinHostPort(payload.Addr, fmt.Sprint(payload.Port)))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			listeners[net.JoinHostPort(payload.Addr, fmt.Sprint(port))] = l
+			go serveTestForward(conn, l, "forwarded-tcpip", func(c net.Conn) []byte {
+				origin, _ := c.RemoteAddr().(*net.TCPAddr)
+				if origin == nil {
+					origin = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+				}
+				return ssh2.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)})
+			})
+			var reply []byte
+			if payload.Port == 0 {
+				reply = ssh2.Marshal(struct{ Port uint32 }{port})
+			}
+			req.Reply(true, reply)
+		case "streamlocal-forward@openssh.com":
+			var payload struct{ SocketPath string }
+			if conf.Listen == nil || ssh2.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			l, err := conf.Listen("unix", payload.SocketPath)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listeners[payload.SocketPath] = l
+			go serveTestForward(conn, l, "forwarded-streamlocal@openssh.com", func(net.Conn) []byte {
+				return ssh2.Marshal(struct {
+					SocketPath string
+					Reserved0  string
+				}{payload.SocketPath, ""})
+			})
+			req.Reply(true, nil)
+		case "cancel-tcpip-forward", "cancel-streamlocal-forward@openssh.com":
+			var key string
+			if req.Type == "cancel-tcpip-forward" {
+				var payload struct {
+					Addr string
+					Port uint32
+				}
+				ssh2.Unmarshal(req.Payload, &payload)
+				key = net.JoinHostPort(payload.Addr, fmt.Sprint(payload.Port))
+			} else {
+				var payload struct{ SocketPath string }
+				ssh2.Unmarshal(req.Payload, &payload)
+				key = payload.SocketPath
+			}
+			l, ok := listeners[key]
+			if ok {
+				l.Close()
+				delete(listeners, key)
+			}
+			req.Reply(ok, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// serveTestForward opens a channel of the given type to the client for each
+// connection accepted by the listener, until the listener is closed.
+func serveTestForward(conn *ssh2.ServerConn, l net.Listener, chanType string, payload func(net.Conn) []byte) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			ch, reqs, err := conn.OpenChannel(chanType, payload(c))
+			if err != nil {
+				c.Close()
+				return
+			}
+			go ssh2.DiscardRequests(reqs)
+			proxyTestChannel(c, ch)
+		}()
+	}
+}
+
+// serveTestSession handles the requests of a single session channel.
+func serveTestSession(conn *ssh2.ServerConn, conf *ServerConfig, ch ssh2.Channel, reqs <-chan *ssh2.Request) {
+	defer ch.Close()
+
+	var agentForwarded bool
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh2.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			if payload.Command == "ssh-add -L" {
+				sendExitStatus(ch, listForwardedKeys(conn, ch, agentForwarded))
+				return
+			}
+			if payload.Command == "wait-for-signal" {
+				waitForSignal(ch, reqs)
+				return
+			}
+			if payload.Command == "ignore-signals" {
+				ignoreSignals(ch, reqs)
+				return
+			}
+			if payload.Command == "cat" {
+				go ssh2.DiscardRequests(reqs)
+				io.Copy(ch, ch)
+				sendExitStatus(ch, 0)
+				return
+			}
+			if conf.SCP && strings.HasPrefix(payload.Command, "scp ") {
+				go ssh2.DiscardRequests(reqs)
+				sendExitStatus(ch, serveSCP(ch, payload.Command))
+				return
+			}
+
+			out := commandMap[payload.Command]
+			ch.Write([]byte(out.Output))
+			sendExitStatus(ch, out.Code)
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh2.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" || !conf.SFTP {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh2.DiscardRequests(reqs)
+
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+		case "auth-agent-req@openssh.com":
+			agentForwarded = true
+			req.Reply(true, nil)
+		case "env", "pty-req", "window-change":
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// waitForSignal runs a command that waits for a signal, writing out the name
+// of the signal received before exiting as if killed by it.
+func waitForSignal(ch ssh2.Channel, reqs <-chan *ssh2.Request) {
+	for req := range reqs {
+		if req.Type != "signal" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Signal string }
+		if err := ssh2.Unmarshal(req.Payload, &payload); err != nil {
+			continue
+		}
+		fmt.Fprintf(ch, "received SIG%s\n", payload.Signal)
+		sendExitSignal(ch, payload.Signal, "killed by signal")
+		return
+	}
+}
+
+// ignoreSignals runs a command that writes out the names of the signals that
+// it receives, without ever exiting. It only ends when the channel is closed.
+func ignoreSignals(ch ssh2.Channel, reqs <-chan *ssh2.Request) {
+	for req := range reqs {
+		if req.Type != "signal" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Signal string }
+		if err := ssh2.Unmarshal(req.Payload, &payload); err == nil {
+			fmt.Fprintf(ch, "received SIG%s\n", payload.Signal)
+		}
+	}
+}
+
+// serveSCP runs an scp command as either the sink or the source, returning
+// its exit status.
+func serveSCP(ch ssh2.Channel, command string) int {
+	args, err := shellquote.Split(command)
+	if err != nil {
+		return 1
+	}
+	var sink, source, targetDir bool
+	var target string
+	for _, arg := range args[1:] {
+		switch arg {
+		case "-t":
+			sink = true
+		case "-f":
+			source = true
+		case "-d":
+			targetDir = true
+		case "-r", "-p":
+		default:
+			target = arg
+		}
+	}
+
+	c := &scpConn{ctx: context.Background(), r: bufio.NewReader(ch), w: ch}
+	switch {
+	case sink:
+		fi, statErr := os.Stat(target)
+		isDir := statErr == nil && fi.IsDir()
+		if targetDir && !isDir {
+			err = errors2.New(target + ": Not a directory")
+			break
+		}
+		err = c.receive(target, isDir, target)
+	case source:
+		if err = c.readAck(); err != nil {
+			break
+		}
+		var fi os.FileInfo
+		if fi, err = os.Stat(target); err == nil {
+			err = c.send(target, filepath.Base(target), target, fi)
+		}
+	default:
+		err = errors2.New("either -t or -f is required")
+	}
+	if err != nil {
+		c.sendError(err)
+		return 1
+	}
+	return 0
+}
+
+// sendExitStatus sends the exit status of a command to the client.
+func sendExitStatus(ch ssh2.Channel, code int) {
+	status := struct{ Status uint32 }{uint32(code)}
+	ch.SendRequest("exit-status", false, ssh2.Marshal(&status))
+}
+
+// sendExitSignal sends the signal that killed a command to the client.
+func sendExitSignal(ch ssh2.Channel, signal, msg string) {
+	exit := struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{signal, false, msg, ""}
+	ch.SendRequest("exit-signal", false, ssh2.Marshal(&exit))
+}
+
+// listForwardedKeys writes out the keys of the agent forwarded by the client,
+// returning the exit code of the command.
+func listForwardedKeys(conn *ssh2.ServerConn, out io.Writer, forwarded bool) int {
+	if !forwarded {
+		fmt.Fprintln(out, "Could not open a connection to your authentication agent.")
+		return 2
+	}
+
+	agentCh, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		fmt.Fprintln(out, "Could not open a connection to your authentication agent.")
+		return 2
+	}
+	defer agentCh.Close()
+	go ssh2.DiscardRequests(reqs)
+
+	keys, err := agent.NewClient(agentCh).List()
+	if err != nil {
+		fmt.Fprintln(out, "Error connecting to agent:", err)
+		return 2
+	}
+	for _, k := range keys {
+		fmt.Fprintln(out, k.String())
+	}
+	return 0
+}
@@ -0,0 +1,222 @@
+package sshtarget
+
+import (
+	"context"
+	errors2 "errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// errNoSFTPSubsystem indicates that the SSH server does not have the SFTP
+// subsystem.
+var errNoSFTPSubsystem = errors2.New("no SFTP subsystem")
+
+// sftpBackend transfers files with SFTP.
+type sftpBackend struct {
+	c       *sftp.Client
+	session *ssh.Session
+}
+
+// newSFTPBackend starts SFTP with the given session, closing the session if
+// this fails. errNoSFTPSubsystem is returned if the server does not have the
+// SFTP subsystem.
+func newSFTPBackend(s *ssh.Session) (*sftpBackend, error) {
+	w, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to get SFTP input")
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to get SFTP output")
+	}
+	if err = s.RequestSubsystem("sftp"); err != nil {
+		s.Close()
+		return nil, errNoSFTPSubsystem
+	}
+
+	c, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "unable to start SFTP session")
+	}
+	return &sftpBackend{c: c, session: s}, nil
+}
+
+func (sb *sftpBackend) upload(ctx context.Context, localPath, remotePath string, opts *TransferOptions) error {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	return uploadPath(ctx, sb.c, localPath, remotePath, fi, opts)
+}
+
+func (sb *sftpBackend) download(ctx context.Context, remotePath, localPath string, opts *TransferOptions) error {
+	fi, err := sb.c.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	return downloadPath(ctx, sb.c, remotePath, localPath, fi, opts)
+}
+
+func (sb *sftpBackend) stat(_ context.Context, remotePath string) (os.FileInfo, error) {
+	return sb.c.Stat(remotePath)
+}
+
+func (sb *sftpBackend) readDir(_ context.Context, remotePath string) ([]os.FileInfo, error) {
+	entries, err := sb.c.ReadDir(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (sb *sftpBackend) remove(_ context.Context, remotePath string) error {
+	return sb.c.Remove(remotePath)
+}
+
+func (sb *sftpBackend) mkdir(_ context.Context, remotePath string, perm os.FileMode) error {
+	if err := sb.c.Mkdir(remotePath); err != nil {
+		return err
+	}
+	return errors.Wrap(sb.c.Chmod(remotePath, perm), "unable to set directory mode")
+}
+
+func (sb *sftpBackend) close() error {
+	err := sb.c.Close()
+	sb.session.Close()
+	return errors.Wrap(err, "unable to close SFTP client")
+}
+
+// uploadPath uploads a file or directory.
+func uploadPath(ctx context.Context, c *sftp.Client, localPath, remotePath string, fi os.FileInfo, opts *TransferOptions) error {
+	switch {
+	case fi.IsDir():
+		rfi, err := c.Stat(remotePath)
+		if err != nil {
+			err = c.Mkdir(remotePath)
+		} else if !rfi.IsDir() {
+			err = errors.Errorf("%s is not a directory", remotePath)
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to create remote directory")
+		}
+
+		entries, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			return errors.Wrap(err, "unable to read local directory")
+		}
+		for _, e := range entries {
+			err = uploadPath(ctx, c, filepath.Join(localPath, e.Name()), path.Join(remotePath, e.Name()), e, opts)
+			if err != nil {
+				return err
+			}
+		}
+	case fi.Mode().IsRegular():
+		if err := uploadFile(ctx, c, localPath, remotePath, fi, opts); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	// The attributes of directories are set after their contents, so that the
+	// modification time is kept and read only directories can be filled.
+	if err := c.Chmod(remotePath, fi.Mode().Perm()); err != nil {
+		return errors.Wrap(err, "unable to set remote mode")
+	}
+	return errors.Wrap(c.Chtimes(remotePath, fi.ModTime(), fi.ModTime()), "unable to set remote modification time")
+}
+
+// uploadFile copies the contents of a regular file.
+func uploadFile(ctx context.Context, c *sftp.Client, localPath, remotePath string, fi os.FileInfo, opts *TransferOptions) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to open local file")
+	}
+	defer src.Close()
+
+	dst, err := c.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return errors.Wrap(err, "unable to create remote file")
+	}
+	_, err = copyWithProgress(ctx, dst, src, TransferProgress{
+		Source:      localPath,
+		Destination: remotePath,
+		Size:        fi.Size(),
+	}, opts)
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "unable to close remote file")
+	}
+	return err
+}
+
+// downloadPath downloads a file or directory.
+func downloadPath(ctx context.Context, c *sftp.Client, remotePath, localPath string, fi os.FileInfo, opts *TransferOptions) error {
+	switch {
+	case fi.IsDir():
+		lfi, err := os.Stat(localPath)
+		if err != nil {
+			err = os.Mkdir(localPath, 0700)
+		} else if !lfi.IsDir() {
+			err = errors.Errorf("%s is not a directory", localPath)
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to create local directory")
+		}
+
+		entries, err := c.ReadDir(remotePath)
+		if err != nil {
+			return errors.Wrap(err, "unable to read remote directory")
+		}
+		for _, e := range entries {
+			err = downloadPath(ctx, c, path.Join(remotePath, e.Name()), filepath.Join(localPath, e.Name()), e, opts)
+			if err != nil {
+				return err
+			}
+		}
+	case fi.Mode().IsRegular():
+		if err := downloadFile(ctx, c, remotePath, localPath, fi, opts); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if err := os.Chmod(localPath, fi.Mode().Perm()); err != nil {
+		return errors.Wrap(err, "unable to set local mode")
+	}
+	return errors.Wrap(os.Chtimes(localPath, fi.ModTime(), fi.ModTime()), "unable to set local modification time")
+}
+
+// downloadFile copies the contents of a regular file.
+func downloadFile(ctx context.Context, c *sftp.Client, remotePath, localPath string, fi os.FileInfo, opts *TransferOptions) error {
+	src, err := c.Open(remotePath)
+	if err != nil {
+		return errors.Wrap(err, "unable to open remote file")
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to create local file")
+	}
+	_, err = copyWithProgress(ctx, dst, src, TransferProgress{
+		Source:      remotePath,
+		Destination: localPath,
+		Size:        fi.Size(),
+	}, opts)
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "unable to close local file")
+	}
+	return err
+}
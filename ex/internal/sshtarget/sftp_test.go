@@ -0,0 +1,155 @@
+package sshtarget_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFile is a file of a test directory tree.
+type testFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+	mtime   time.Time
+}
+
+// testTree is the directory tree used to test transfers, with binary data and
+// different modes.
+var testTree = []testFile{
+	{path: "a.txt", content: []byte("hello\n"), mode: 0640, mtime: time.Unix(1500000000, 0)},
+	{path: "sub/b.bin", content: []byte{0, 1, 2, 0xff, '\r', '\n', 0}, mode: 0755, mtime: time.Unix(1400000000, 0)},
+	{path: "sub/empty", content: []byte{}, mode: 0600, mtime: time.Unix(1300000000, 0)},
+}
+
+// writeTestTree writes the test tree to the given directory.
+func writeTestTree(t *testing.T, dir string) {
+	for _, f := range testTree {
+		p := filepath.Join(dir, f.path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, f.content, f.mode))
+		require.NoError(t, os.Chmod(p, f.mode))
+		require.NoError(t, os.Chtimes(p, f.mtime, f.mtime))
+	}
+	subTime := time.Unix(1200000000, 0)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "sub"), subTime, subTime))
+}
+
+// checkTestTree checks that the test tree was copied to the given directory.
+func checkTestTree(t *testing.T, dir string) {
+	for _, f := range testTree {
+		p := filepath.Join(dir, f.path)
+		content, err := ioutil.ReadFile(p)
+		require.NoError(t, err, "unable to read copied file")
+		assert.Equal(t, f.content, content, "unexpected content of %s", f.path)
+		fi, err := os.Stat(p)
+		require.NoError(t, err, "unable to stat copied file")
+		assert.Equal(t, f.mode, fi.Mode().Perm(), "unexpected mode of %s", f.path)
+		assert.True(t, f.mtime.Equal(fi.ModTime()), "unexpected modification time of %s: %s", f.path, fi.ModTime())
+	}
+	fi, err := os.Stat(filepath.Join(dir, "sub"))
+	require.NoError(t, err, "unable to stat copied directory")
+	assert.True(t, time.Unix(1200000000, 0).Equal(fi.ModTime()), "unexpected modification time of directory")
+}
+
+// newConfigTarget connects to a server created with the given configuration.
+func newConfigTarget(t *testing.T, logger log.Logger, conf *sshtarget.ServerConfig) (*sshtarget.SSHTarget, func()) {
+	d, hostKey, stop := sshtarget.NewSSHServerWithConfig(logger, conf)
+	server := &testServer{dialer: d, hostKey: hostKey, stop: stop}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := sshtarget.New(ctx, logger, server.dialer, "127.0.0.1", 22,
+		[]sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(server.hostKey))},
+		"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+	if err != nil {
+		server.close()
+		require.NoError(t, err, "unable to create target")
+	}
+	return st, func() {
+		st.Close()
+		server.close()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "sftp")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestTree(t, src)
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{SFTP: true})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var progress []sshtarget.TransferProgress
+	remote := filepath.Join(dir, "remote")
+	err = st.Upload(ctx, src, remote, &sshtarget.TransferOptions{
+		Progress: func(p sshtarget.TransferProgress) { progress = append(progress, p) },
+	})
+	require.NoError(t, err, "unable to upload directory")
+	checkTestTree(t, remote)
+	require.NotEmpty(t, progress, "progress must be reported")
+	last := progress[len(progress)-1]
+	assert.Equal(t, filepath.Join(src, "sub", "empty"), last.Source, "unexpected last file")
+	assert.Equal(t, filepath.Join(remote, "sub", "empty"), last.Destination, "unexpected last destination")
+	assert.EqualValues(t, 0, last.Size, "unexpected size of last file")
+	for _, p := range progress {
+		if p.Source == filepath.Join(src, "a.txt") && p.Transferred == p.Size {
+			assert.EqualValues(t, 6, p.Size, "unexpected size of file")
+		}
+	}
+
+	fi, err := st.Stat(filepath.Join(remote, "a.txt"))
+	require.NoError(t, err, "unable to stat remote file")
+	assert.EqualValues(t, 6, fi.Size(), "unexpected size")
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm(), "unexpected mode")
+
+	entries, err := st.ReadDir(filepath.Join(remote, "sub"))
+	require.NoError(t, err, "unable to read remote directory")
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"b.bin", "empty"}, names, "unexpected directory entries")
+
+	downloaded := filepath.Join(dir, "downloaded")
+	require.NoError(t, st.Download(ctx, remote, downloaded, nil), "unable to download directory")
+	checkTestTree(t, downloaded)
+
+	single := filepath.Join(dir, "single.bin")
+	require.NoError(t, st.Download(ctx, filepath.Join(remote, "sub", "b.bin"), single, nil),
+		"unable to download file")
+	content, err := ioutil.ReadFile(single)
+	require.NoError(t, err)
+	assert.Equal(t, testTree[1].content, content, "unexpected downloaded content")
+
+	made := filepath.Join(dir, "made")
+	require.NoError(t, st.Mkdir(made, 0750), "unable to make directory")
+	fi, err = os.Stat(made)
+	require.NoError(t, err, "directory must exist")
+	assert.True(t, fi.IsDir(), "must be a directory")
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm(), "unexpected directory mode")
+	require.NoError(t, st.Remove(made), "unable to remove directory")
+	_, err = st.Stat(made)
+	assert.Error(t, err, "removed directory must not exist")
+
+	assert.Error(t, st.Remove(filepath.Join(dir, "missing")), "removing missing file must fail")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
@@ -0,0 +1,286 @@
+package sshtarget
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// SOCKS protocol values, from RFC 1928 and RFC 1929.
+const (
+	socksVersion         = 5
+	socksAuthVersion     = 1
+	socksMethodNoAuth    = 0x00
+	socksMethodPassword  = 0x02
+	socksMethodNoAccept  = 0xff
+	socksCmdConnect      = 0x01
+	socksAddrIPv4        = 0x01
+	socksAddrDomain      = 0x03
+	socksAddrIPv6        = 0x04
+	socksReplySucceeded  = 0x00
+	socksReplyFailure    = 0x01
+	socksReplyNotAllowed = 0x02
+	socksReplyRefused    = 0x05
+	socksReplyBadCommand = 0x07
+	socksReplyBadAddress = 0x08
+
+	// socksNoReply indicates that no reply can be sent to a client.
+	socksNoReply = 0xff
+)
+
+// SOCKSRule allows or denies connections to matching destinations of a
+// dynamic forward.
+type SOCKSRule struct {
+	// Allow indicates that matching destinations are allowed, rather than
+	// denied.
+	//
+	// Rules match only the host as it is requested, which is not resolved,
+	// so denying a host name does not deny its IP addresses or its other
+	// names. Hosts are only reliably denied by allowing the permitted hosts
+	// and denying all others.
+	Allow bool
+	// Hosts are the patterns that the host of the destination is matched
+	// against, as with MatchHostPatterns. The host is the name or IP address
+	// requested by the SOCKS client.
+	Hosts []string
+	// Ports are the ports that the rule applies to. The rule applies to all
+	// ports if there are none.
+	Ports []uint16
+}
+
+// matches reports whether the rule applies to the given destination.
+func (sr *SOCKSRule) matches(host string, port uint16) bool {
+	if !MatchHostPatterns(sr.Hosts, host) {
+		return false
+	}
+	if len(sr.Ports) == 0 {
+		return true
+	}
+	for _, p := range sr.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// SOCKSConfig contains the optional settings of a dynamic forward.
+type SOCKSConfig struct {
+	// Username and Password, if Username is set, are the credentials that
+	// SOCKS clients must give with username/password authentication.
+	Username string
+	Password string
+
+	// Rules are checked in order for each requested destination, with the
+	// first matching rule deciding whether the connection is allowed.
+	// Destinations that do not match any rule are allowed, so a final rule
+	// that denies "*" makes the other rules an allow list.
+	Rules []SOCKSRule
+}
+
+// allowed reports whether connections to the given destination are allowed.
+func (sc *SOCKSConfig) allowed(host string, port uint16) bool {
+	for i := range sc.Rules {
+		if sc.Rules[i].matches(host, port) {
+			return sc.Rules[i].Allow
+		}
+	}
+	return true
+}
+
+// ForwardDynamic listens on the given local address for SOCKS5 clients and
+// connects them to the destinations they request through the SSH server, as
+// with the -D option of ssh(1).
+//
+// Only the CONNECT command is supported. The configuration may be nil, in
+// which case no authentication is required and all destinations are allowed.
+//
+// The forward is closed when the target is closed.
+func (st *SSHTarget) ForwardDynamic(network, address string, conf *SOCKSConfig) (*Forward, error) {
+	if conf == nil {
+		conf = &SOCKSConfig{}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.isClosed {
+		return nil, ErrNoSSHConnection
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen for dynamic forward")
+	}
+	client := st.client
+	// Failed and denied requests are usually caused by the clients, so they
+	// are only logged for debugging.
+	return st.addForward(l, st.logger.Debugf, func(ctx context.Context, accepted net.Conn) (net.Conn, error) {
+		return socksConnect(ctx, accepted, conf, client.DialContext)
+	}), nil
+}
+
+// socksConnect performs the SOCKS handshake with a client and connects it to
+// the requested destination with the dial function.
+func socksConnect(ctx context.Context, c net.Conn, conf *SOCKSConfig,
+	dial func(ctx context.Context, network, address string) (net.Conn, error)) (net.Conn, error) {
+	err := socksAuthenticate(c, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, reply, err := socksReadRequest(c)
+	if err != nil {
+		if reply != socksNoReply {
+			socksReply(c, reply)
+		}
+		return nil, err
+	}
+
+	if !conf.allowed(host, port) {
+		socksReply(c, socksReplyNotAllowed)
+		return nil, errors.Errorf("SOCKS connection to %s:%d not allowed", host, port)
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	dialed, err := dial(ctx, "tcp", address)
+	if err != nil {
+		socksReply(c, socksReplyRefused)
+		return nil, err
+	}
+	if err = socksReply(c, socksReplySucceeded); err != nil {
+		dialed.Close()
+		return nil, err
+	}
+	return dialed, nil
+}
+
+// socksAuthenticate negotiates the authentication method with a client and
+// authenticates it.
+func socksAuthenticate(c net.Conn, conf *SOCKSConfig) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return errors.Wrap(err, "unable to read SOCKS greeting")
+	}
+	if header[0] != socksVersion {
+		return errors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return errors.Wrap(err, "unable to read SOCKS authentication methods")
+	}
+
+	want := byte(socksMethodNoAuth)
+	if conf.Username != "" {
+		want = socksMethodPassword
+	}
+	method := byte(socksMethodNoAccept)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return errors.Wrap(err, "unable to write SOCKS authentication method")
+	}
+	switch method {
+	case socksMethodNoAccept:
+		return errors.New("no acceptable SOCKS authentication methods")
+	case socksMethodNoAuth:
+		return nil
+	}
+
+	// Username/password authentication, from RFC 1929.
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(c, ver); err != nil {
+		return errors.Wrap(err, "unable to read SOCKS authentication")
+	}
+	if ver[0] != socksAuthVersion {
+		return errors.Errorf("unsupported SOCKS authentication version %d", ver[0])
+	}
+	user, err := readSOCKSString(c)
+	if err != nil {
+		return errors.Wrap(err, "unable to read SOCKS username")
+	}
+	pass, err := readSOCKSString(c)
+	if err != nil {
+		return errors.Wrap(err, "unable to read SOCKS password")
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(conf.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(conf.Password)) == 1
+	if !userOK || !passOK {
+		c.Write([]byte{socksAuthVersion, 1})
+		return errors.New("invalid SOCKS credentials")
+	}
+	_, err = c.Write([]byte{socksAuthVersion, 0})
+	return errors.Wrap(err, "unable to write SOCKS authentication status")
+}
+
+// socksReadRequest reads the request of a client, returning the requested
+// destination.
+//
+// If the request cannot be handled, the reply code to send to the client is
+// also returned, which is socksNoReply if the request could not be read.
+func socksReadRequest(c net.Conn) (host string, port uint16, reply byte, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(c, header); err != nil {
+		return "", 0, socksNoReply, errors.Wrap(err, "unable to read SOCKS request")
+	}
+	if header[0] != socksVersion {
+		return "", 0, socksReplyFailure, errors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(c, ip); err != nil {
+			return "", 0, socksNoReply, errors.Wrap(err, "unable to read SOCKS address")
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		if host, err = readSOCKSString(c); err != nil {
+			return "", 0, socksNoReply, errors.Wrap(err, "unable to read SOCKS address")
+		}
+	default:
+		return "", 0, socksReplyBadAddress, errors.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err = io.ReadFull(c, portBytes); err != nil {
+		return "", 0, socksNoReply, errors.Wrap(err, "unable to read SOCKS port")
+	}
+	port = binary.BigEndian.Uint16(portBytes)
+
+	if header[1] != socksCmdConnect {
+		return "", 0, socksReplyBadCommand, errors.Errorf("unsupported SOCKS command %d", header[1])
+	}
+	return host, port, socksReplySucceeded, nil
+}
+
+// readSOCKSString reads a string that is prefixed with its length.
+func readSOCKSString(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	b := make([]byte, length[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// socksReply sends a reply to a request. The bound address is always given as
+// 0.0.0.0:0, as the address used by the SSH server is not known.
+func socksReply(c net.Conn, reply byte) error {
+	_, err := c.Write([]byte{socksVersion, reply, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return errors.Wrap(err, "unable to write SOCKS reply")
+}
@@ -0,0 +1,131 @@
+package sshtarget_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socksDial connects to a host through a SOCKS5 server, returning the reply
+// code of the server, or the status of the authentication if it failed.
+func socksDial(t *testing.T, server net.Addr, user, pass, host string, port uint16) (net.Conn, byte) {
+	c, err := net.Dial(server.Network(), server.String())
+	require.NoError(t, err, "unable to dial SOCKS server")
+	require.NoError(t, c.SetDeadline(time.Now().Add(20*time.Second)))
+
+	method := byte(0x00)
+	if user != "" {
+		method = 0x02
+	}
+	_, err = c.Write([]byte{5, 1, method})
+	require.NoError(t, err, "unable to write SOCKS greeting")
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(c, resp)
+	require.NoError(t, err, "unable to read SOCKS method")
+	if resp[1] != method {
+		c.Close()
+		return nil, resp[1]
+	}
+
+	if user != "" {
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		_, err = c.Write(req)
+		require.NoError(t, err, "unable to write SOCKS credentials")
+		_, err = io.ReadFull(c, resp)
+		require.NoError(t, err, "unable to read SOCKS authentication status")
+		if resp[1] != 0 {
+			c.Close()
+			return nil, resp[1]
+		}
+	}
+
+	req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], port)
+	_, err = c.Write(req)
+	require.NoError(t, err, "unable to write SOCKS request")
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	require.NoError(t, err, "unable to read SOCKS reply")
+	if reply[1] != 0 {
+		c.Close()
+		return nil, reply[1]
+	}
+	return c, 0
+}
+
+func TestForwardDynamic(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	echo := newEchoListener(t, "tcp", "127.0.0.1:0")
+	defer echo.Close()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	var requested []string
+	server := newServer(logger, func(host string, port uint32) (net.Conn, error) {
+		requested = append(requested, host)
+		if host != "echo.internal" {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	defer server.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := sshtarget.New(ctx, logger, server.dialer, "127.0.0.1", 22,
+		[]sshtarget.Option{sshtarget.HostKeyValidationOption(sshtarget.FixedHostKey(server.hostKey))},
+		"test", []sshtarget.Authorizer{sshtarget.NewPasswordAuth("Password123")})
+	require.NoError(t, err, "unable to create target")
+	defer st.Close()
+
+	f, err := st.ForwardDynamic("tcp", "127.0.0.1:0", &sshtarget.SOCKSConfig{
+		Username: "user",
+		Password: "secret",
+		Rules: []sshtarget.SOCKSRule{
+			{Allow: false, Hosts: []string{"echo.internal"}, Ports: []uint16{22}},
+			{Allow: true, Hosts: []string{"*.internal"}},
+			{Allow: false, Hosts: []string{"*"}},
+		},
+	})
+	require.NoError(t, err, "unable to create dynamic forward")
+
+	c, reply := socksDial(t, f.Addr(), "user", "secret", "echo.internal", 7)
+	require.EqualValues(t, 0, reply, "connection must be allowed")
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err, "unable to write through SOCKS connection")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err, "unable to read through SOCKS connection")
+	assert.Equal(t, "hello", string(buf), "unexpected data through SOCKS connection")
+	c.Close()
+
+	_, reply = socksDial(t, f.Addr(), "user", "secret", "echo.internal", 22)
+	assert.EqualValues(t, 2, reply, "denied port must not be allowed")
+	_, reply = socksDial(t, f.Addr(), "user", "secret", "example.com", 80)
+	assert.EqualValues(t, 2, reply, "unlisted host must not be allowed")
+	_, reply = socksDial(t, f.Addr(), "user", "secret", "missing.internal", 80)
+	assert.EqualValues(t, 5, reply, "failed connection must be refused")
+	_, reply = socksDial(t, f.Addr(), "user", "wrong", "echo.internal", 7)
+	assert.EqualValues(t, 1, reply, "wrong password must fail authentication")
+	_, reply = socksDial(t, f.Addr(), "", "", "echo.internal", 7)
+	assert.EqualValues(t, 0xff, reply, "authentication must be required")
+
+	assert.Equal(t, []string{"echo.internal", "missing.internal"}, requested,
+		"only allowed destinations must be dialed")
+	require.NoError(t, f.Close(), "unable to close dynamic forward")
+	assert.EqualValues(t, 5, f.BytesSent(), "unexpected number of bytes sent")
+	assert.Empty(t, logBuf.String(), "failed requests must only be logged for debugging")
+}
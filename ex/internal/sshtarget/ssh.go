@@ -10,9 +10,11 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/rwool/ex/ex/internal/recorder"
 	"github.com/rwool/ex/log"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // SSH is a wrapper around the SSH client.
@@ -25,6 +27,50 @@ func (s *SSH) Close() error {
 	return s.sshClient.Close()
 }
 
+// DialContext opens a connection to the address through the SSH connection,
+// using a direct-tcpip channel.
+//
+// The address is resolved by the SSH server.
+func (s *SSH) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		conn, err := s.sshClient.Dial(network, address)
+		resultC <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return nil, errors.Wrapf(r.err, "unable to dial %s through SSH connection", address)
+		}
+		return r.conn, nil
+	case <-ctx.Done():
+		// The channel may still be opened after giving up on it.
+		go func() {
+			if r := <-resultC; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errors.Wrapf(ctx.Err(), "unable to dial %s through SSH connection", address)
+	}
+}
+
+// Listen requests that the SSH server listens on the given address. The
+// connections accepted by the server are forwarded through the SSH connection.
+//
+// The network must be "tcp", "tcp4", "tcp6" or "unix".
+func (s *SSH) Listen(network, address string) (net.Listener, error) {
+	l, err := s.sshClient.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on %s through SSH connection", address)
+	}
+	return l, nil
+}
+
 // HostKeyCallback is a function for handling host keys.
 type HostKeyCallback = ssh.HostKeyCallback
 
@@ -35,7 +81,85 @@ var (
 	FixedHostKey = ssh.FixedHostKey
 )
 
+// HostKeyError indicates that the host key presented by the server was rejected
+// by the host key callback.
+type HostKeyError struct {
+	// Hostname is the address that the connection was made to.
+	Hostname string
+	// Remote is the network address of the server.
+	Remote net.Addr
+	// Key is the host key presented by the server.
+	Key ssh.PublicKey
+	// Err is the error returned by the host key callback.
+	Err error
+}
+
+// Error returns the error string of the host key error.
+func (hke *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s: %v", hke.Hostname, hke.Err)
+}
+
+// Unwrap returns the error returned by the host key callback.
+func (hke *HostKeyError) Unwrap() error {
+	return hke.Err
+}
+
+// ExitError indicates that a command exited unsuccessfully, or without
+// reporting how it exited.
+type ExitError struct {
+	recorder.ExitStatus
+	// Err is the error returned by the SSH library.
+	Err error
+}
+
+// Error returns the error string of the exit error.
+func (ee *ExitError) Error() string {
+	return ee.Err.Error()
+}
+
+// Cause returns the error returned by the SSH library.
+func (ee *ExitError) Cause() error {
+	return ee.Err
+}
+
+// Unwrap returns the error returned by the SSH library.
+func (ee *ExitError) Unwrap() error {
+	return ee.Err
+}
+
+// newExitError converts the error from waiting for a command to an
+// *ExitError, returning nil if the error is not about how the command exited.
+//
+// The SSH library does not report whether a command dumped core, so
+// CoreDumped is never set.
+func newExitError(err error) *ExitError {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		return &ExitError{
+			ExitStatus: recorder.ExitStatus{
+				Code:    e.ExitStatus(),
+				Signal:  e.Signal(),
+				Message: e.Msg(),
+			},
+			Err: err,
+		}
+	case *ssh.ExitMissingError:
+		return &ExitError{
+			ExitStatus: recorder.ExitStatus{
+				Code:    -1,
+				Message: e.Error(),
+			},
+			Err: err,
+		}
+	default:
+		return nil
+	}
+}
+
 // NewSSH creates a new SSH connection with the given configuration.
+//
+// If the host key is rejected, the returned error has a *HostKeyError as its
+// cause.
 func NewSSH(ctx context.Context, logger log.Logger, conn net.Conn, address string,
 	keyCallback HostKeyCallback, username string, auths []Authorizer) (*SSH, error) {
 	sshAuths := make([]ssh.AuthMethod, 0, len(auths))
@@ -46,10 +170,25 @@ func NewSSH(ctx context.Context, logger log.Logger, conn net.Conn, address strin
 		sshAuths = append(sshAuths, v.GetAuthMethod())
 	}
 
+	// The SSH library only keeps the message of the callback error, so the
+	// error is captured here to be able to return it intact.
+	var hostKeyErr *HostKeyError
 	sshConf := ssh.ClientConfig{
-		User:            username,
-		Auth:            sshAuths,
-		HostKeyCallback: keyCallback,
+		User: username,
+		Auth: sshAuths,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := keyCallback(hostname, remote, key)
+			if err != nil {
+				hostKeyErr = &HostKeyError{
+					Hostname: hostname,
+					Remote:   remote,
+					Key:      key,
+					Err:      err,
+				}
+				return hostKeyErr
+			}
+			return nil
+		},
 	}
 
 	// Error used to indicate that the ssh connection closed due to the
@@ -87,6 +226,9 @@ func NewSSH(ctx context.Context, logger log.Logger, conn net.Conn, address strin
 		if contextError != nil {
 			return nil, contextError
 		}
+		if hostKeyErr != nil {
+			return nil, errors.Wrap(hostKeyErr, "failed to create SSH client connection")
+		}
 		return nil, errors.Wrap(err, "failed to create SSH client connection")
 	}
 
@@ -121,14 +263,26 @@ type RunConfig struct {
 	// WinCh is an optional channel that will be received from that will update
 	// the window dimensions dynamically.
 	WinCh <-chan struct{ Height, Width int }
+	// WindowChangeFunc, if set, is called after each update of the window
+	// dimensions.
+	WindowChangeFunc func(height, width int)
 
 	AsyncErrLogger func(error)
 
 	Command string
 	EnvVars map[string]string
 
+	// ForwardAgent requests forwarding of the agent set up for the SSH
+	// connection to the session.
+	ForwardAgent bool
+
 	PreRunFunc  func()
 	PostRunFunc func()
+
+	// SessionFunc, if set, is called with the session once the command has
+	// started, and with nil once it has finished, so that signals can be sent
+	// to the running command.
+	SessionFunc func(*ssh.Session)
 }
 
 // DefaultTerminalMode is the default mode that will be set for the terminal.
@@ -145,9 +299,14 @@ func noOpIfNil(fn *func()) {
 }
 
 // RunCommand runs a command with the given configuration.
+//
+// If the command exits unsuccessfully, the returned error wraps an *ExitError.
 func (s *SSH) RunCommand(ctx context.Context, config RunConfig) error {
 	noOpIfNil(&config.PreRunFunc)
 	noOpIfNil(&config.PostRunFunc)
+	if config.SessionFunc == nil {
+		config.SessionFunc = func(*ssh.Session) {}
+	}
 
 	sess, err := s.sshClient.NewSession()
 	if err != nil {
@@ -165,6 +324,13 @@ func (s *SSH) RunCommand(ctx context.Context, config RunConfig) error {
 		}
 	}
 
+	if config.ForwardAgent {
+		err = agent.RequestAgentForwarding(sess)
+		if err != nil {
+			return errors.Wrap(err, "unable to request agent forwarding")
+		}
+	}
+
 	if config.PTYConfig != nil {
 		err = sess.RequestPty(config.PTYConfig.Term,
 			config.PTYConfig.Height,
@@ -184,14 +350,23 @@ func (s *SSH) RunCommand(ctx context.Context, config RunConfig) error {
 			} else {
 				logger = config.AsyncErrLogger
 			}
-			select {
-			case dims := <-config.WinCh:
-				err = sess.WindowChange(dims.Height, dims.Width)
-				if err != nil {
-					logger(errors.Wrap(err, "unable to update window dimensions"))
+			for {
+				select {
+				case dims, ok := <-config.WinCh:
+					if !ok {
+						return
+					}
+					err := sess.WindowChange(dims.Height, dims.Width)
+					if err != nil {
+						logger(errors.Wrap(err, "unable to update window dimensions"))
+						continue
+					}
+					if config.WindowChangeFunc != nil {
+						config.WindowChangeFunc(dims.Height, dims.Width)
+					}
+				case <-doneC:
+					return
 				}
-			case <-doneC:
-				return
 			}
 		}()
 	}
@@ -199,6 +374,7 @@ func (s *SSH) RunCommand(ctx context.Context, config RunConfig) error {
 
 	config.PreRunFunc()
 	defer config.PostRunFunc()
+	defer config.SessionFunc(nil)
 
 	if config.Command == "" {
 		// Requesting Shell.
@@ -206,9 +382,18 @@ func (s *SSH) RunCommand(ctx context.Context, config RunConfig) error {
 		if err != nil {
 			return errors.Wrap(err, "unable to create shell via SSH")
 		}
+		config.SessionFunc(sess)
 	} else {
 		// Running command.
-		err = sess.Run(config.Command)
+		err = sess.Start(config.Command)
+		if err != nil {
+			return errors.Wrap(err, "unable to run command via SSH")
+		}
+		config.SessionFunc(sess)
+		err = sess.Wait()
+		if ee := newExitError(err); ee != nil {
+			err = ee
+		}
 		if err != nil {
 			return errors.Wrap(err, "unable to run command via SSH")
 		}
@@ -10,12 +10,38 @@ import (
 	"github.com/rwool/ex/ex/internal/recorder"
 	"github.com/rwool/ex/ex/internal/signal"
 	"github.com/rwool/ex/log"
+	"golang.org/x/crypto/ssh"
 )
 
 // ErrCancelledByTarget indicates command was cancelled indirectly by the
 // target.
 var ErrCancelledByTarget = errors2.New("cancelled by target")
 
+// ErrNotRunning indicates a failure due to the command not running.
+var ErrNotRunning = errors2.New("command not running")
+
+// ErrSignalUnsupported indicates that an attempt to use an unsupported
+// signal was made.
+var ErrSignalUnsupported = errors2.New("unsupported signal")
+
+// sshSignals maps signals to their names in SSH, which are the signals listed
+// in RFC 4254.
+var sshSignals = map[signal.Signal]ssh.Signal{
+	signal.SIGABRT: ssh.SIGABRT,
+	signal.SIGALRM: ssh.SIGALRM,
+	signal.SIGFPE:  ssh.SIGFPE,
+	signal.SIGHUP:  ssh.SIGHUP,
+	signal.SIGILL:  ssh.SIGILL,
+	signal.SIGINT:  ssh.SIGINT,
+	signal.SIGKILL: ssh.SIGKILL,
+	signal.SIGPIPE: ssh.SIGPIPE,
+	signal.SIGQUIT: ssh.SIGQUIT,
+	signal.SIGSEGV: ssh.SIGSEGV,
+	signal.SIGTERM: ssh.SIGTERM,
+	signal.SIGUSR1: ssh.SIGUSR1,
+	signal.SIGUSR2: ssh.SIGUSR2,
+}
+
 // SSHSession is a single session within a SSH connection.
 type SSHSession struct {
 	ssh    *SSH
@@ -23,6 +49,11 @@ type SSHSession struct {
 	rec    *recorder.Recorder
 	logger log.Logger
 
+	// recordInput is whether the input of the command is recorded, with
+	// redact applied to it.
+	recordInput bool
+	redact      recorder.Redactor
+
 	mu sync.Mutex
 
 	errC chan error
@@ -30,6 +61,16 @@ type SSHSession struct {
 	parentCtx, ctx context.Context
 
 	finishFn func()
+
+	// sessionMu protects session, which is separate from mu as mu is held
+	// while the command runs.
+	sessionMu sync.Mutex
+	// session is the session of the running command, if any.
+	session *ssh.Session
+	// doneC is closed once the command has finished running, or has failed to
+	// start.
+	doneC    chan struct{}
+	doneOnce sync.Once
 }
 
 func newSSHSession(ctx context.Context, finishFn func()) *SSHSession {
@@ -39,6 +80,7 @@ func newSSHSession(ctx context.Context, finishFn func()) *SSHSession {
 
 	ss := &SSHSession{
 		parentCtx: ctx,
+		doneC:     make(chan struct{}),
 	}
 
 	if finishFn == nil {
@@ -65,6 +107,24 @@ func (ss *SSHSession) SetInput(stdIn io.Reader) {
 	ss.conf.StdIn = stdIn
 }
 
+// RecordInput records the input of the command along with its output. If redact
+// is not nil, the input is recorded as it returns, which allows secrets to be
+// left out of the recording.
+func (ss *SSHSession) RecordInput(redact recorder.Redactor) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.recordInput = true
+	ss.redact = redact
+}
+
+// SetRecordingSink sets the sink that the output and the input of the command
+// are recorded to, which keeps them in memory by default. It must be called
+// before the command is run.
+func (ss *SSHSession) SetRecordingSink(sink recorder.Sink) {
+	ss.rec.SetSink(sink)
+}
+
 // SetOutput sets the stdout target.
 func (ss *SSHSession) SetOutput(stdOut, stdErr io.Writer) {
 	ss.rec.SetPassthrough(stdOut, stdErr)
@@ -76,6 +136,7 @@ func (ss *SSHSession) SetEnv(vars map[string]string) {
 	defer ss.mu.Unlock()
 
 	ss.conf.EnvVars = vars
+	ss.rec.SetEnv(vars)
 }
 
 // SetTerm sets the terminal dimensions on connection.
@@ -89,6 +150,7 @@ func (ss *SSHSession) SetTerm(height, width int) {
 		Width:        width,
 		TerminalMode: DefaultTerminalMode,
 	}
+	ss.rec.SetTerm(ss.conf.PTYConfig.Term, height, width)
 }
 
 // SetWindowChange sets the channel used to update the window dimensions.
@@ -99,12 +161,85 @@ func (ss *SSHSession) SetWindowChange(winChC <-chan struct{ Height, Width int })
 	ss.conf.WinCh = winChC
 }
 
-// Signal is used to send a signal.
+// setSession sets the session of the running command, which is nil once it
+// has finished.
+func (ss *SSHSession) setSession(s *ssh.Session) {
+	ss.sessionMu.Lock()
+	defer ss.sessionMu.Unlock()
+
+	ss.session = s
+	if s == nil {
+		ss.done()
+	}
+}
+
+// done closes the channel returned by Done, if it has not been closed.
+func (ss *SSHSession) done() {
+	ss.doneOnce.Do(func() { close(ss.doneC) })
+}
+
+// running indicates whether the command is running.
+func (ss *SSHSession) running() bool {
+	ss.sessionMu.Lock()
+	defer ss.sessionMu.Unlock()
+
+	return ss.session != nil
+}
+
+// Done returns a channel that is closed once the command has finished
+// running, or has failed to start. The channel is not closed if the command is
+// never run.
+func (ss *SSHSession) Done() <-chan struct{} {
+	return ss.doneC
+}
+
+// Close closes the channel of the running command, which ends the command
+// without waiting for it to exit.
+//
+// ErrNotRunning is returned if the command has not been started or has
+// finished.
+func (ss *SSHSession) Close() error {
+	ss.sessionMu.Lock()
+	defer ss.sessionMu.Unlock()
+
+	if ss.session == nil {
+		return ErrNotRunning
+	}
+	err := ss.session.Close()
+	if err == io.EOF {
+		return ErrNotRunning
+	}
+	return errors.Wrap(err, "unable to close session")
+}
+
+// Signal sends a signal to the running command.
+//
+// ErrNotRunning is returned if the command has not been started or has
+// finished, and ErrSignalUnsupported is returned for signals that SSH does not
+// support.
 func (ss *SSHSession) Signal(s signal.Signal) error {
-	return errors.New("unimplemented")
+	name, ok := sshSignals[s]
+	if !ok {
+		return ErrSignalUnsupported
+	}
+
+	ss.sessionMu.Lock()
+	defer ss.sessionMu.Unlock()
+
+	if ss.session == nil {
+		return ErrNotRunning
+	}
+	err := ss.session.Signal(name)
+	if err == io.EOF {
+		// The command finished, but has not been waited on yet.
+		return ErrNotRunning
+	}
+	return errors.Wrapf(err, "unable to send %s", s)
 }
 
 // Run runs the session and waits for it to complete.
+//
+// If the command exits unsuccessfully, the returned error wraps an *ExitError.
 func (ss *SSHSession) Run(ctx context.Context) (*recorder.Recorder, error) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
@@ -129,15 +264,42 @@ func (ss *SSHSession) Run(ctx context.Context) (*recorder.Recorder, error) {
 		}
 	}()
 
-	err := ss.ssh.RunCommand(ctx, ss.conf)
+	err := ss.runCommand(ctx)
 	ss.logger.Debugf("Finished run of command: %s", ss.conf.Command)
 	return ss.rec, errors.Wrap(err, "run command error")
 }
 
+// runCommand runs the command, recording how it exited. The recording is
+// finished once it returns.
+func (ss *SSHSession) runCommand(ctx context.Context) error {
+	defer ss.rec.Finish()
+	// The command may fail before it is given a session.
+	defer ss.done()
+
+	conf := ss.conf
+	if ss.recordInput && conf.StdIn != nil {
+		conf.StdIn = ss.rec.RecordInput(conf.StdIn, ss.redact)
+	}
+
+	err := ss.ssh.RunCommand(ctx, conf)
+	if ss.conf.Command == "" {
+		// Shells are not waited on, so there is no exit status.
+		return err
+	}
+
+	var ee *ExitError
+	if err == nil {
+		ss.rec.SetExitStatus(recorder.ExitStatus{})
+	} else if errors2.As(err, &ee) {
+		ss.rec.SetExitStatus(ee.ExitStatus)
+	}
+	return err
+}
+
 // Start starts the session in a sesparate goroutine.
 //
 // The returned Recorder pointer should not be dereferenced until after Wait
-// completes.
+// completes, other than to subscribe to its events.
 func (ss *SSHSession) Start(ctx context.Context) (*recorder.Recorder, error) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
@@ -159,7 +321,7 @@ func (ss *SSHSession) Start(ctx context.Context) (*recorder.Recorder, error) {
 		case <-ss.parentCtx.Done():
 			cancel()
 			return
-		case ss.errC <- ss.ssh.RunCommand(ctx, ss.conf):
+		case ss.errC <- ss.runCommand(ctx):
 			return
 		}
 	}()
@@ -169,7 +331,8 @@ func (ss *SSHSession) Start(ctx context.Context) (*recorder.Recorder, error) {
 
 // Wait waits for the session to complete after calling Start.
 //
-// If Start has not been called, an error will be returned.
+// If Start has not been called, an error will be returned. If the command
+// exits unsuccessfully, the returned error wraps an *ExitError.
 func (ss *SSHSession) Wait() error {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
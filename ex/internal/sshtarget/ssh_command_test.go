@@ -0,0 +1,157 @@
+package sshtarget_test
+
+import (
+	"bytes"
+	"context"
+	errors2 "errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex/internal/recorder"
+	"github.com/rwool/ex/ex/internal/signal"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHSessionSignal(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := st.Command("wait-for-signal")
+	assert.Equal(t, sshtarget.ErrNotRunning, cmd.Signal(signal.SIGTERM),
+		"signal must not be sent before starting")
+	rec, err := cmd.Start(ctx)
+	require.NoError(t, err, "unable to start command")
+	assert.Equal(t, sshtarget.ErrSignalUnsupported, cmd.Signal(signal.Signal(100)),
+		"unknown signal must not be sent")
+
+	// The command may not have started running yet.
+	for {
+		err = cmd.Signal(signal.SIGTERM)
+		if err != sshtarget.ErrNotRunning || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err, "unable to send signal")
+
+	err = cmd.Wait()
+	var exitErr *sshtarget.ExitError
+	require.True(t, errors2.As(err, &exitErr), "error must be an exit error: %+v", err)
+	assert.Equal(t, "TERM", exitErr.Signal, "unexpected exit signal")
+	assert.Equal(t, 143, exitErr.Code, "unexpected exit code")
+	assert.Equal(t, "killed by signal", exitErr.Message, "unexpected exit message")
+	assert.Equal(t, &exitErr.ExitStatus, rec.ExitStatus(), "exit status must be recorded")
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(buf, buf, 0))
+	assert.Equal(t, "received SIGTERM\n", buf.String(), "unexpected signal received")
+
+	assert.Equal(t, sshtarget.ErrNotRunning, cmd.Signal(signal.SIGTERM),
+		"signal must not be sent after finishing")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestSSHSessionWindowChange(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := st.Command("ignore-signals")
+	cmd.SetTerm(24, 80)
+	winCh := make(chan struct{ Height, Width int })
+	cmd.SetWindowChange(winCh)
+	rec, err := cmd.Start(ctx)
+	require.NoError(t, err, "unable to start command")
+	for {
+		err = cmd.Signal(signal.SIGUSR1)
+		if err != sshtarget.ErrNotRunning || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err, "unable to signal command")
+
+	// Every change must be applied, not only the first.
+	winCh <- struct{ Height, Width int }{40, 120}
+	winCh <- struct{ Height, Width int }{50, 132}
+	var cast string
+	for ctx.Err() == nil {
+		buf := &bytes.Buffer{}
+		require.NoError(t, rec.WriteAsciicast(buf))
+		if cast = buf.String(); strings.Contains(cast, `"132x50"`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, cast, `"width":80,"height":24`, "initial size must be in header")
+	assert.Contains(t, cast, `"r","120x40"`, "first change must be recorded")
+	assert.Contains(t, cast, `"r","132x50"`, "second change must be recorded")
+
+	require.NoError(t, cmd.Close(), "unable to close command")
+	assert.Error(t, cmd.Wait(), "closed command must fail")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestSSHSessionRecordInput(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := st.Command("cat")
+	cmd.SetInput(strings.NewReader("user\nhunter2\n"))
+	cmd.RecordInput(func(p []byte) []byte {
+		return bytes.Replace(p, []byte("hunter2"), []byte("*******"), -1)
+	})
+	rec, err := cmd.Run(ctx)
+	require.NoError(t, err, "unable to run command")
+
+	out, in := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, rec.ReplayWithOptions(recorder.ReplayOptions{Stdout: out, Input: in}))
+	assert.Equal(t, "user\nhunter2\n", out.String(), "input must not be redacted for the command")
+	assert.Equal(t, "user\n*******\n", in.String(), "unexpected recorded input")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestSSHSessionDoneOnFailure(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	st, closeTarget := newConfigTarget(t, logger, &sshtarget.ServerConfig{RejectSessions: true})
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The command fails before it is given a session.
+	cmd := st.Command("whoami")
+	_, err := cmd.Start(ctx)
+	require.NoError(t, err, "unable to start command")
+	select {
+	case <-cmd.Done():
+	case <-ctx.Done():
+		require.Fail(t, "done must be closed when the command fails to start")
+	}
+	assert.Error(t, cmd.Wait(), "command must fail without a session")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rwool/ex/ex/internal/recorder"
 	"github.com/rwool/ex/log"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // Dialer is the interface that wraps the dial method.
@@ -31,21 +32,43 @@ type SSHTarget struct {
 	auths     []Authorizer
 	hostKeyCB HostKeyCallback
 
+	// forwardAgent is the agent forwarded to sessions, if any.
+	forwardAgent agent.Agent
+
+	// jumpHosts are connected through, in order, to reach the host.
+	jumpHosts []JumpHost
+	// jumpClients are the connections to the jump hosts.
+	jumpClients []*SSH
+
 	mu sync.Mutex
 
 	client *SSH
 
-	sessions []*SSHSession
+	// sessionsMu protects sessions. It is separate from mu so that the running
+	// sessions can be found while the target is being closed.
+	sessionsMu sync.Mutex
+	sessions   []*SSHSession
 
 	sessionCtx    context.Context
 	sessionCancel context.CancelFunc
 
 	sessionWG sync.WaitGroup
 
+	// forwards are the open port forwards.
+	forwards map[*Forward]struct{}
+
+	// transferMu protects transfer, which is created on first use.
+	transferMu sync.Mutex
+	transfer   transferBackend
+
 	isClosed bool
 }
 
 // New creates a new connection with an SSH server.
+//
+// The host key of the server is verified with the callback given with
+// HostKeyValidationOption, which must be set. If the host key is rejected, the
+// returned error has a *HostKeyError as its cause.
 func New(ctx context.Context, logger log.Logger, dialer Dialer,
 	host string, port uint16, opts []Option, username string, auths []Authorizer) (*SSHTarget, error) {
 	if logger == nil {
@@ -59,13 +82,21 @@ func New(ctx context.Context, logger log.Logger, dialer Dialer,
 	}
 
 	var hkc HostKeyCallback
+	var fwdAgent agent.Agent
+	var hops jumpHosts
 	for _, v := range opts {
 		switch v.(type) {
 		case HostKeyCallback:
 			hkc = v.(HostKeyCallback)
+		case agentForwarding:
+			fwdAgent = v.(agentForwarding).agent
+		case jumpHosts:
+			hops = v.(jumpHosts)
 		}
 	}
-	hkc = InsecureIgnoreHostKey()
+	if hkc == nil {
+		panic("no host key callback given")
+	}
 
 	c := &SSHTarget{
 		user:      username,
@@ -75,6 +106,9 @@ func New(ctx context.Context, logger log.Logger, dialer Dialer,
 		logger:    logger,
 		auths:     auths,
 		hostKeyCB: hkc,
+
+		forwardAgent: fwdAgent,
+		jumpHosts:    hops,
 	}
 
 	// Distinct from the context passed into this function.
@@ -111,38 +145,74 @@ func (st *SSHTarget) Command(cmd string, args ...string) *SSHSession {
 		as.logger.Errorf("Error in SSH session: %+v", e)
 	}
 	as.conf.PreRunFunc = as.rec.StartTiming
+	as.conf.SessionFunc = as.setSession
+	as.conf.WindowChangeFunc = as.rec.AddResize
+	as.conf.ForwardAgent = st.forwardAgent != nil
 	as.rec.SetOutput(&as.conf.StdOut, &as.conf.StdErr)
 	as.ssh = st.client
 	as.errC = make(chan error)
 
+	st.sessionsMu.Lock()
 	st.sessions = append(st.sessions, as)
+	st.sessionsMu.Unlock()
 
 	return as
 }
 
+// Running returns the sessions of the target whose commands are running.
+func (st *SSHTarget) Running() []*SSHSession {
+	st.sessionsMu.Lock()
+	defer st.sessionsMu.Unlock()
+
+	var running []*SSHSession
+	for _, s := range st.sessions {
+		if s.running() {
+			running = append(running, s)
+		}
+	}
+	return running
+}
+
 // Option is an an additional setting that may be made when creating an
 // SSHTarget.
 type Option interface{}
 
 // getClient gets an SSH connection by connecting to an SSH server.
 func (st *SSHTarget) getClient(ctx context.Context) error {
+	dial, jumpClients, err := dialJumpHosts(ctx, st)
+	if err != nil {
+		return err
+	}
+
 	address := net.JoinHostPort(st.host, strconv.Itoa(int(st.port)))
-	conn, err := st.dialer.DialContext(ctx, "tcp", address)
+	conn, err := dial(ctx, "tcp", address)
 	if err != nil {
+		closeClients(jumpClients)
 		return errors.Wrap(err, "unable to dial remote host")
 	}
 
 	client, err := NewSSH(ctx, st.logger, conn, address, st.hostKeyCB, st.user, st.auths)
 	if err != nil {
+		closeClients(jumpClients)
 		return errors.Wrap(err, "unable to get SSH session")
 	}
 
+	if st.forwardAgent != nil {
+		err = agent.ForwardToAgent(client.sshClient, st.forwardAgent)
+		if err != nil {
+			client.Close()
+			closeClients(jumpClients)
+			return errors.Wrap(err, "unable to set up agent forwarding")
+		}
+	}
+
 	st.client = client
+	st.jumpClients = jumpClients
 	return nil
 }
 
-// Close closes the SSH target and all related commands.
-// Blocks until all commands have been closed.
+// Close closes the SSH target and all related commands and forwards.
+// Blocks until all commands and forwards have been closed.
 func (st *SSHTarget) Close() error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
@@ -157,18 +227,62 @@ func (st *SSHTarget) Close() error {
 	st.sessionCancel()
 	st.sessionWG.Wait()
 
+	// Transfers also hold sessionWG, so the backend is no longer in use.
+	st.transferMu.Lock()
+	if st.transfer != nil {
+		st.transfer.close()
+		st.transfer = nil
+	}
+	st.transferMu.Unlock()
+
+	// Forwards are closed directly as the lock is held.
+	for f := range st.forwards {
+		f.close()
+	}
+	st.forwards = nil
+
 	// Close the underlying connection used for the SSH connection.
 	// Note that this will likely cause multiple calls to be made with the Close
 	// method of the Conn.
 	// This is because calling Close makes a call, which indirectly causes the
 	// SSH handshake and mux goroutines to also make calls to Close.
 	st.client.Close()
+	closeClients(st.jumpClients)
 	st.isClosed = true
 	st.logger.Debugf("No errors closing SSH target: %s", hp)
 
 	return nil
 }
 
+// DialContext connects to the given address through the SSH connection, using
+// a direct-tcpip channel, so that the address is resolved and dialed by the
+// SSH server. This allows the target to be used as the dialer of other targets
+// or of HTTP clients.
+//
+// Only TCP networks are supported. Connections that are still open when the
+// target is closed are closed with it.
+//
+// ErrNoSSHConnection is returned if the target has been closed, and
+// ErrUnsupportedNetwork is returned for networks other than "tcp", "tcp4" and
+// "tcp6".
+func (st *SSHTarget) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrUnsupportedNetwork
+	}
+
+	st.mu.Lock()
+	if st.isClosed {
+		st.mu.Unlock()
+		return nil, ErrNoSSHConnection
+	}
+	client := st.client
+	st.mu.Unlock()
+
+	return client.DialContext(ctx, network, address)
+}
+
 // TermConfig represents the configuration that will be used for managing the
 // terminal's dimensions.
 type TermConfig struct {
@@ -192,6 +306,10 @@ var ErrPTYAllocFail = errors2.New("unable to allocate PTY")
 // ErrNoSSHConnection indicates that there was no SSH connection.
 var ErrNoSSHConnection = errors2.New("no SSH connection")
 
+// ErrUnsupportedNetwork indicates that a connection was requested over a
+// network that cannot be dialed through the SSH connection.
+var ErrUnsupportedNetwork = errors2.New("unsupported network")
+
 // HostKeyValidationOption returns an option to set the use of a host key
 // callback.
 func HostKeyValidationOption(callback HostKeyCallback) Option {
@@ -3,6 +3,7 @@ package sshtarget
 import (
 	"bytes"
 	"context"
+	errors2 "errors"
 	"io"
 	"testing"
 	"time"
@@ -51,10 +52,15 @@ func TestConnectionSSH(t *testing.T) {
 	rec, err := c.Command("whoami").Run(ctx)
 	assert.NoError(t, err)
 	validateRecording(rec, "test\n")
+	assert.Equal(t, &recorder.ExitStatus{}, rec.ExitStatus(), "unexpected exit status")
 
 	rec, err = c.Command("doesNotExist").Run(ctx)
 	assert.EqualError(t, errors.Cause(err), "Process exited with status 127")
 	validateRecording(rec, "-bash: doesNotExist: command not found\n")
+	var exitErr *ExitError
+	require.True(t, errors2.As(err, &exitErr), "error must be an exit error")
+	assert.Equal(t, 127, exitErr.Code, "unexpected exit code")
+	assert.Equal(t, &recorder.ExitStatus{Code: 127}, rec.ExitStatus(), "unexpected exit status")
 
 	assert.NoError(t, c.Close(), "unexpected error from SSH target close")
 }
@@ -0,0 +1,115 @@
+package sshtarget
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyDecider decides whether the key of a host that is not in the
+// known_hosts file should be trusted.
+//
+// Returning false rejects the key, leaving the known_hosts file unchanged.
+type HostKeyDecider func(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error)
+
+// AcceptNewHostKeys is a HostKeyDecider that trusts the keys of all new hosts.
+//
+// This is the equivalent of the "accept-new" setting of the
+// StrictHostKeyChecking option of ssh(1). Changed and revoked keys are still
+// rejected.
+func AcceptNewHostKeys(string, net.Addr, ssh.PublicKey) (bool, error) {
+	return true, nil
+}
+
+// knownHostsLocks serializes the use of known_hosts files within the process.
+var knownHostsLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// knownHostsLock returns the lock for the known_hosts file at the given path.
+func knownHostsLock(path string) *sync.Mutex {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	knownHostsLocks.Lock()
+	defer knownHostsLocks.Unlock()
+	mu, ok := knownHostsLocks.m[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		knownHostsLocks.m[path] = mu
+	}
+	return mu
+}
+
+// TrustOnFirstUseCallback creates a host key callback that verifies host keys
+// against the known_hosts file at the given path, adding the keys of unknown
+// hosts that the decider accepts.
+//
+// The file, and its directory, are created if they do not exist. The file is
+// read each time the callback is called, so keys added by other callbacks are
+// seen. Callbacks for the same file are serialized, so they may be used by
+// many targets at once without the decider being asked about the same host
+// more than once.
+//
+// Keys rejected by the decider cause the callback to return the original
+// error, so IsUnknownHost will report true for it.
+func TrustOnFirstUseCallback(path string, decide HostKeyDecider, disableHashing bool) HostKeyCallback {
+	if decide == nil {
+		panic("nil host key decider")
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu := knownHostsLock(path)
+		mu.Lock()
+		defer mu.Unlock()
+
+		f, err := openKnownHosts(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		db := &knownHostsDB{}
+		err = db.read(f, path)
+		if err != nil {
+			return err
+		}
+		err = db.checkHostKey(hostname, remote, key)
+		if !IsUnknownHost(err) {
+			return err
+		}
+
+		ok, decideErr := decide(hostname, remote, key)
+		if decideErr != nil {
+			return errors.Wrap(decideErr, "unable to decide on host key")
+		}
+		if !ok {
+			return err
+		}
+
+		if cert, isCert := key.(*ssh.Certificate); isCert {
+			key = cert.Key
+		}
+		return AddToKnownHosts(f, []string{hostname}, key, disableHashing, MarkerNone)
+	}
+}
+
+// openKnownHosts opens the known_hosts file at the given path for reading and
+// writing, creating it if necessary.
+func openKnownHosts(path string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create known_hosts directory")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open known_hosts file")
+	}
+	return f, nil
+}
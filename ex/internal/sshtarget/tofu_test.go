@@ -0,0 +1,102 @@
+package sshtarget_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTrustOnFirstUseCallback(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tofu")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	hostKey := generateKey(ecdsa.PublicKey{})
+
+	t.Run("Accept New", func(t2 *testing.T) {
+		path := filepath.Join(dir, "accept", ".ssh", "known_hosts")
+		cb := sshtarget.TrustOnFirstUseCallback(path, sshtarget.AcceptNewHostKeys, false)
+
+		require.NoError(t2, cb("db.example.com:22", remote, hostKey), "new host key must be accepted")
+		assert.NoError(t2, cb("db.example.com:22", remote, hostKey), "added host key must be accepted")
+
+		err := cb("db.example.com:22", remote, generateKey(ecdsa.PublicKey{}))
+		assert.True(t2, sshtarget.IsKeyChange(err), "changed host key must be rejected")
+
+		// The added key is usable by other callbacks.
+		kh, err := sshtarget.KnownHostsFilesCallback(path)
+		require.NoError(t2, err, "unable to create known_hosts callback")
+		assert.NoError(t2, kh("db.example.com:22", remote, hostKey), "added host key not found")
+	})
+
+	t.Run("Rejected", func(t2 *testing.T) {
+		path := filepath.Join(dir, "rejected")
+		var asked ssh.PublicKey
+		cb := sshtarget.TrustOnFirstUseCallback(path, func(hostname string, _ net.Addr, key ssh.PublicKey) (bool, error) {
+			assert.Equal(t2, "db.example.com:22", hostname, "unexpected host name")
+			asked = key
+			return false, nil
+		}, false)
+
+		err := cb("db.example.com:22", remote, hostKey)
+		assert.True(t2, sshtarget.IsUnknownHost(err), "rejected host key must be unknown")
+		assert.Equal(t2, hostKey, asked, "unexpected key given to decider")
+
+		contents, err := ioutil.ReadFile(path)
+		require.NoError(t2, err, "unable to read known_hosts file")
+		assert.Empty(t2, contents, "rejected host key added")
+	})
+
+	t.Run("Decider Error", func(t2 *testing.T) {
+		path := filepath.Join(dir, "error")
+		decideErr := errors.New("no terminal")
+		cb := sshtarget.TrustOnFirstUseCallback(path, func(string, net.Addr, ssh.PublicKey) (bool, error) {
+			return false, decideErr
+		}, false)
+
+		err := cb("db.example.com:22", remote, hostKey)
+		assert.Equal(t2, decideErr, errors2.Cause(err), "unexpected error from decider")
+	})
+
+	t.Run("Concurrent", func(t2 *testing.T) {
+		path := filepath.Join(dir, "concurrent")
+		var asked int32
+		decide := func(string, net.Addr, ssh.PublicKey) (bool, error) {
+			atomic.AddInt32(&asked, 1)
+			return true, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Separate callbacks, as used by separate targets.
+				cb := sshtarget.TrustOnFirstUseCallback(path, decide, true)
+				assert.NoError(t2, cb("db.example.com:22", remote, hostKey), "host key must be accepted")
+			}()
+		}
+		wg.Wait()
+
+		assert.EqualValues(t2, 1, atomic.LoadInt32(&asked), "decider must be asked once")
+		contents, err := ioutil.ReadFile(path)
+		require.NoError(t2, err, "unable to read known_hosts file")
+		assert.Equal(t2, 1, bytes.Count(contents, []byte("\n")), "unexpected number of known_hosts lines")
+	})
+}
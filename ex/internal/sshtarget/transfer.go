@@ -0,0 +1,241 @@
+package sshtarget
+
+import (
+	"context"
+	errors2 "errors"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/log"
+)
+
+// ErrTransferUnsupported indicates that a file operation is not supported by
+// the transfer backend used for the target, which is the case for some
+// operations when the SSH server has no SFTP subsystem.
+var ErrTransferUnsupported = errors2.New("file operation not supported without SFTP")
+
+// TransferProgress is the progress of copying a single file.
+type TransferProgress struct {
+	// Source is the path of the file being copied.
+	Source string
+	// Destination is the path that the file is being copied to.
+	Destination string
+	// Transferred is the number of bytes of the file that have been copied.
+	Transferred int64
+	// Size is the size of the file.
+	Size int64
+}
+
+// TransferOptions contains the optional settings of a file transfer.
+type TransferOptions struct {
+	// Progress, if set, is called as each file is copied, starting with a
+	// call with nothing transferred.
+	Progress func(TransferProgress)
+}
+
+// progress reports the progress of a file, if there is a callback.
+func (to *TransferOptions) progress(p TransferProgress) {
+	if to != nil && to.Progress != nil {
+		to.Progress(p)
+	}
+}
+
+// transferBufferSize is the size of the chunks that files are copied in.
+const transferBufferSize = 32 * 1024
+
+// transferBackend transfers files to and from the remote system.
+//
+// Remote paths use forward slashes, and local paths use the separator of the
+// local system.
+type transferBackend interface {
+	upload(ctx context.Context, localPath, remotePath string, opts *TransferOptions) error
+	download(ctx context.Context, remotePath, localPath string, opts *TransferOptions) error
+	stat(ctx context.Context, remotePath string) (os.FileInfo, error)
+	readDir(ctx context.Context, remotePath string) ([]os.FileInfo, error)
+	remove(ctx context.Context, remotePath string) error
+	mkdir(ctx context.Context, remotePath string, perm os.FileMode) error
+	close() error
+}
+
+// newTransferBackend creates the transfer backend for an SSH connection.
+//
+// SFTP is used if the server has the SFTP subsystem. Otherwise, the scp
+// protocol is used.
+func newTransferBackend(logger log.Logger, client *SSH) (transferBackend, error) {
+	s, err := client.sshClient.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create session for file transfer")
+	}
+	b, err := newSFTPBackend(s)
+	if err == errNoSFTPSubsystem {
+		logger.Debugf("SFTP subsystem unavailable, falling back to scp")
+		return &scpBackend{client: client}, nil
+	}
+	return b, err
+}
+
+// beginTransfer gets the transfer backend of the target, creating it if
+// necessary. The returned context is cancelled when the target is closed.
+//
+// The returned function must be called once the backend is no longer in use.
+// The target is not closed until then.
+func (st *SSHTarget) beginTransfer(ctx context.Context) (transferBackend, context.Context, func(), error) {
+	st.mu.Lock()
+	if st.isClosed {
+		st.mu.Unlock()
+		return nil, nil, nil, ErrNoSSHConnection
+	}
+	st.sessionWG.Add(1)
+	client := st.client
+	sessionCtx := st.sessionCtx
+	st.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-sessionCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	done := func() {
+		cancel()
+		st.sessionWG.Done()
+	}
+
+	st.transferMu.Lock()
+	defer st.transferMu.Unlock()
+	if st.transfer == nil {
+		b, err := newTransferBackend(st.logger, client)
+		if err != nil {
+			done()
+			return nil, nil, nil, err
+		}
+		st.transfer = b
+	}
+	return st.transfer, ctx, done, nil
+}
+
+// Upload copies the local file or directory at the given path to the remote
+// path, which is the path of the copy rather than the directory to copy it
+// into. Directories are copied recursively.
+//
+// The modes and modification times of the files and directories are
+// preserved. Anything that is not a regular file or directory, such as a
+// symbolic link within a directory, is skipped.
+//
+// SFTP is used if the SSH server supports it. Otherwise, the scp protocol is
+// used, which requires scp to be installed on the remote system.
+func (st *SSHTarget) Upload(ctx context.Context, localPath, remotePath string, opts *TransferOptions) error {
+	b, ctx, done, err := st.beginTransfer(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return errors.Wrapf(b.upload(ctx, localPath, remotePath, opts), "unable to upload %s", localPath)
+}
+
+// Download copies the remote file or directory at the given path to the local
+// path, which is the path of the copy rather than the directory to copy it
+// into. Directories are copied recursively.
+//
+// The modes and modification times of the files and directories are
+// preserved. Anything that is not a regular file or directory, such as a
+// symbolic link within a directory, is skipped.
+//
+// SFTP is used if the SSH server supports it. Otherwise, the scp protocol is
+// used, which requires scp to be installed on the remote system.
+func (st *SSHTarget) Download(ctx context.Context, remotePath, localPath string, opts *TransferOptions) error {
+	b, ctx, done, err := st.beginTransfer(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return errors.Wrapf(b.download(ctx, remotePath, localPath, opts), "unable to download %s", remotePath)
+}
+
+// Stat returns information about the remote file at the given path, following
+// symbolic links.
+func (st *SSHTarget) Stat(remotePath string) (os.FileInfo, error) {
+	b, ctx, done, err := st.beginTransfer(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	fi, err := b.stat(ctx, remotePath)
+	return fi, errors.Wrapf(err, "unable to stat %s", remotePath)
+}
+
+// ReadDir returns information about the entries of the remote directory at the
+// given path, sorted by name.
+//
+// ErrTransferUnsupported is returned if the SSH server does not support SFTP.
+func (st *SSHTarget) ReadDir(remotePath string) ([]os.FileInfo, error) {
+	b, ctx, done, err := st.beginTransfer(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	entries, err := b.readDir(ctx, remotePath)
+	return entries, errors.Wrapf(err, "unable to read directory %s", remotePath)
+}
+
+// Remove removes the remote file or empty directory at the given path.
+//
+// ErrTransferUnsupported is returned if the SSH server does not support SFTP.
+func (st *SSHTarget) Remove(remotePath string) error {
+	b, ctx, done, err := st.beginTransfer(context.Background())
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return errors.Wrapf(b.remove(ctx, remotePath), "unable to remove %s", remotePath)
+}
+
+// Mkdir creates the remote directory at the given path with the given
+// permissions. The parent directory must already exist.
+//
+// Without SFTP, an existing directory is not an error, and has its permissions
+// changed.
+func (st *SSHTarget) Mkdir(remotePath string, perm os.FileMode) error {
+	b, ctx, done, err := st.beginTransfer(context.Background())
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return errors.Wrapf(b.mkdir(ctx, remotePath, perm), "unable to create directory %s", remotePath)
+}
+
+// copyWithProgress copies a file, reporting its progress after each chunk.
+// The number of bytes copied is returned.
+func copyWithProgress(ctx context.Context, dst io.Writer, src io.Reader, p TransferProgress, opts *TransferOptions) (int64, error) {
+	opts.progress(p)
+	buf := make([]byte, transferBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return p.Transferred, errors.Wrap(err, "transfer cancelled")
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				return p.Transferred, errors.Wrap(wErr, "unable to write file")
+			}
+			p.Transferred += int64(n)
+			opts.progress(p)
+		}
+		if err == io.EOF {
+			return p.Transferred, nil
+		}
+		if err != nil {
+			return p.Transferred, errors.Wrap(err, "unable to read file")
+		}
+	}
+}
@@ -2,6 +2,9 @@ package ex
 
 import (
 	"io"
+	"regexp"
+
+	"github.com/pkg/errors"
 
 	"github.com/rwool/ex/ex/internal/recorder"
 )
@@ -14,9 +17,194 @@ const (
 	EscapeEvent = recorder.EscapeEvent
 )
 
+// ExitStatus describes how a command exited.
+type ExitStatus = recorder.ExitStatus
+
+// TermSize is the size of a terminal.
+type TermSize = recorder.TermSize
+
+// ReplayOptions contains the settings for replaying a recording with the
+// ReplayWithOptions method of Recorder.
+type ReplayOptions = recorder.ReplayOptions
+
+// Renderer writes the data of recorded events when a recording is replayed.
+type Renderer = recorder.Renderer
+
+// RenderFunc is a function that is used as a Renderer.
+type RenderFunc = recorder.RenderFunc
+
+// PrefixRenderer writes the data of events with a prefix at the start of each
+// line.
+type PrefixRenderer = recorder.PrefixRenderer
+
+// HTMLRenderer writes the data of events as HTML, with the escape sequences
+// that style terminal output turned into styled spans.
+type HTMLRenderer = recorder.HTMLRenderer
+
+// PlainRenderer writes the data of events unchanged.
+var PlainRenderer = recorder.PlainRenderer
+
+// DefaultRenderer colors the output of stderr green, if the output of this
+// process is a terminal, and writes the data of the other streams unchanged.
+// It is used when replaying if no renderer is given.
+var DefaultRenderer = recorder.DefaultRenderer
+
+// NewColorRenderer returns a renderer that colors the data of each stream with
+// the given SGR parameters, such as "31" for red or "1;33" for bold yellow.
+func NewColorRenderer(colors map[RecordingSource]string) Renderer {
+	return recorder.NewColorRenderer(colors)
+}
+
+// NewPrefixRenderer returns a renderer that starts each line of a stream with
+// its prefix, and with the offset of the event that it begins in if
+// timestamps is true.
+func NewPrefixRenderer(prefixes map[RecordingSource]string, timestamps bool) *PrefixRenderer {
+	return recorder.NewPrefixRenderer(prefixes, timestamps)
+}
+
+// NewHTMLRenderer returns a renderer that writes the data of events as HTML.
+func NewHTMLRenderer() *HTMLRenderer {
+	return recorder.NewHTMLRenderer()
+}
+
+// PlayerOptions contains the settings of a Player.
+type PlayerOptions = recorder.PlayerOptions
+
+// Player plays a recording interactively, with playback that can be paused,
+// moved, sped up or slowed down, or stepped through one event at a time.
+type Player = recorder.Player
+
+// InputRedactor is given the input that is read by a command, and returns the
+// data to record in its place.
+type InputRedactor = recorder.Redactor
+
+// RecordingSource is the stream that recorded data came from.
+type RecordingSource = recorder.Source
+
+// Streams that data can be recorded from.
+const (
+	RecordedStdout = recorder.Stdout
+	RecordedStderr = recorder.Stderr
+	RecordedStdin  = recorder.Stdin
+)
+
+// RecordingEvent is data that was written to or read from a stream of a
+// command.
+type RecordingEvent = recorder.Event
+
+// RecordingSink stores the output and the input of a command as it is
+// recorded. Sinks must be safe for concurrent use.
+type RecordingSink = recorder.Sink
+
+// MemoryRecordingSink is a RecordingSink that keeps every event in memory.
+type MemoryRecordingSink = recorder.MemorySink
+
+// RingRecordingSink is a RecordingSink that keeps only the most recent events.
+type RingRecordingSink = recorder.RingSink
+
+// FileRecordingSink is a RecordingSink that appends events to a log file.
+type FileRecordingSink = recorder.FileSink
+
+// RecordingSubscription follows the output and the input of a command as it is
+// recorded. It must be closed once it is no longer needed.
+type RecordingSubscription = recorder.Subscription
+
+// ErrRecordingSubscriptionOverflow indicates that a subscription was closed
+// because its events were not read quickly enough.
+var ErrRecordingSubscriptionOverflow = recorder.ErrSubscriptionOverflow
+
+// ErrRecordingSinkClosed indicates that a sink was used after being closed.
+var ErrRecordingSinkClosed = recorder.ErrSinkClosed
+
+// NewMemoryRecordingSink returns a sink that keeps every event in memory, as
+// commands do by default.
+func NewMemoryRecordingSink() *MemoryRecordingSink {
+	return recorder.NewMemorySink()
+}
+
+// NewRingRecordingSink returns a sink that keeps at most the given number of
+// events and bytes of data, dropping older events. A limit that is 0 or less
+// is not applied.
+func NewRingRecordingSink(maxEvents, maxBytes int) *RingRecordingSink {
+	return recorder.NewRingSink(maxEvents, maxBytes)
+}
+
+// NewFileRecordingSink creates a sink that appends events to a log file at the
+// given path, replacing the file if it exists. The sink must be closed once it
+// is no longer needed.
+func NewFileRecordingSink(path string) (*FileRecordingSink, error) {
+	return recorder.NewFileSink(path)
+}
+
+// RecordingFormatVersion is the version of the format that recordings are
+// saved in with the Save method of Recorder.
+const RecordingFormatVersion = recorder.FormatVersion
+
+// ErrUnsupportedRecordingVersion indicates that a recording was saved with a
+// version of the format that is not supported.
+var ErrUnsupportedRecordingVersion = recorder.ErrUnsupportedVersion
+
 // Recorder wraps the set of methods for interacting with a recording of a
 // Target session.
 type Recorder interface {
 	Replay(out io.Writer, err io.Writer, speedMultipler float64) error
+	// ReplayWithOptions replays the recording, including the recorded input
+	// and the changes of the terminal size if requested.
+	ReplayWithOptions(opts ReplayOptions) error
+	// NewPlayer creates a player for playing the recording interactively.
+	NewPlayer(opts PlayerOptions) (*Player, error)
 	GetSpecialEvents() []SpecialEvent
+	// ExitStatus gets how the command exited, returning nil if it has not
+	// exited or could not be run.
+	ExitStatus() *ExitStatus
+	// Save writes the recording in a versioned format that can be loaded with
+	// LoadRecording.
+	Save(w io.Writer) error
+	// Subscribe begins following the output and the input of the command as
+	// it is recorded, starting from the beginning of the recording if
+	// fromStart is true. It may be used while the command is running.
+	Subscribe(fromStart bool) (*RecordingSubscription, error)
+	// WriteHTML writes the output of the recording as a preformatted HTML
+	// block, with the escape sequences that style terminal output turned into
+	// styled spans.
+	WriteHTML(w io.Writer) error
+	// WriteAsciicast writes the recording as an asciicast v2 file, which can
+	// be played with asciinema players.
+	WriteAsciicast(w io.Writer) error
+	// Search finds the matches of the regular expression in the lines of the
+	// recording, as a terminal would have shown them.
+	Search(re *regexp.Regexp, opts *SearchOptions) ([]SearchMatch, error)
+}
+
+// SearchOptions contains the settings of a search of recordings.
+type SearchOptions = recorder.SearchOptions
+
+// SearchMatch is a match of a search in a line of a recording, with the lines
+// around it.
+type SearchMatch = recorder.Match
+
+// SearchRecordings finds the matches of the regular expression in each of the
+// recordings, in the order of the recordings.
+func SearchRecordings(recs []Recorder, re *regexp.Regexp, opts *SearchOptions) ([]SearchMatch, error) {
+	var matches []SearchMatch
+	for i, rec := range recs {
+		m, err := rec.Search(re, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to search recording %d", i)
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// LoadRecording reads a recording that was written with the Save method of a
+// Recorder, so that it can be replayed.
+func LoadRecording(r io.Reader) (Recorder, error) {
+	return recorder.Load(r)
+}
+
+// LoadAsciicast reads an asciicast v2 file as a recording, so that it can be
+// replayed.
+func LoadAsciicast(r io.Reader) (Recorder, error) {
+	return recorder.ReadAsciicast(r)
 }
@@ -0,0 +1,409 @@
+package ex
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rwool/ex/ex/internal/signal"
+	"github.com/rwool/ex/log"
+)
+
+// Signals that can be sent to commands.
+const (
+	SIGABRT = signal.SIGABRT
+	SIGALRM = signal.SIGALRM
+	SIGFPE  = signal.SIGFPE
+	SIGHUP  = signal.SIGHUP
+	SIGILL  = signal.SIGILL
+	SIGINT  = signal.SIGINT
+	SIGKILL = signal.SIGKILL
+	SIGPIPE = signal.SIGPIPE
+	SIGQUIT = signal.SIGQUIT
+	SIGSEGV = signal.SIGSEGV
+	SIGTERM = signal.SIGTERM
+	SIGUSR1 = signal.SIGUSR1
+	SIGUSR2 = signal.SIGUSR2
+)
+
+// SignalEscalation is a step taken to stop a command that is still running
+// after a signal has been forwarded to it.
+type SignalEscalation struct {
+	// After is how long to wait for the command to finish, after the previous
+	// step, before taking this step.
+	After time.Duration
+	// Signal is the signal that is sent to the command.
+	Signal Signal
+}
+
+// DefaultSignalEscalation is the escalation used if none is given. Commands
+// that do not stop after the forwarded signal are sent SIGTERM and then
+// SIGKILL.
+var DefaultSignalEscalation = []SignalEscalation{
+	{After: 5 * time.Second, Signal: SIGTERM},
+	{After: 5 * time.Second, Signal: SIGKILL},
+}
+
+// defaultForwardedSignals are the signals that are forwarded if none are
+// given.
+var defaultForwardedSignals = []Signal{SIGINT, SIGTERM, SIGHUP, SIGQUIT}
+
+// defaultCloseAfter is how long to wait after the last step of the escalation
+// before closing commands if no time is given.
+const defaultCloseAfter = 5 * time.Second
+
+// SignalForwarding contains the settings for forwarding the signals received
+// by this process to remote commands.
+//
+// The received signal is sent to each running command, followed by the steps
+// of the escalation for the commands that are still running. Commands that
+// are still running after that have their channel closed, which ends them
+// without waiting for them to exit.
+//
+// A signal that is received while no commands are running, or while all of
+// them are already being stopped, has its usual effect on this process. This
+// way, a repeated interrupt still ends the process.
+type SignalForwarding struct {
+	// Signals are the signals that are forwarded. SIGINT, SIGTERM, SIGHUP and
+	// SIGQUIT are forwarded if none are given.
+	Signals []Signal
+	// Escalation is the steps taken for commands that are still running after
+	// the signal has been forwarded. DefaultSignalEscalation is used if this
+	// is nil.
+	Escalation []SignalEscalation
+	// CloseAfter is how long to wait for commands to finish after the last
+	// step of the escalation before closing them. Five seconds is used if this
+	// is zero.
+	CloseAfter time.Duration
+}
+
+// signalForwarder forwards signals to the commands returned by its commands
+// function.
+type signalForwarder struct {
+	logger   log.Logger
+	conf     SignalForwarding
+	commands func() []Signaller
+
+	mu sync.Mutex
+	// escalating are the commands that signals are being forwarded to.
+	escalating map[Signaller]struct{}
+	stopped    bool
+	stopC      chan struct{}
+	wg         sync.WaitGroup
+}
+
+func newSignalForwarder(logger log.Logger, conf *SignalForwarding, commands func() []Signaller) *signalForwarder {
+	sf := &signalForwarder{
+		logger:     logger,
+		commands:   commands,
+		escalating: make(map[Signaller]struct{}),
+		stopC:      make(chan struct{}),
+	}
+	if conf != nil {
+		sf.conf = *conf
+	}
+	if len(sf.conf.Signals) == 0 {
+		sf.conf.Signals = defaultForwardedSignals
+	}
+	if sf.conf.Escalation == nil {
+		sf.conf.Escalation = DefaultSignalEscalation
+	}
+	if sf.conf.CloseAfter == 0 {
+		sf.conf.CloseAfter = defaultCloseAfter
+	}
+	return sf
+}
+
+// forwards reports whether the signal is one of the forwarded signals.
+func (sf *signalForwarder) forwards(sig Signal) bool {
+	for _, s := range sf.conf.Signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// handle forwards a signal to the running commands, if it is one of the
+// forwarded signals. Commands that signals are already being forwarded to
+// are skipped, as they are already being stopped.
+//
+// Returns true if the signal was forwarded to any command.
+func (sf *signalForwarder) handle(sig Signal) bool {
+	if !sf.forwards(sig) {
+		return false
+	}
+
+	// The commands are found without holding mu, as finding them may wait
+	// for the targets.
+	cmds := sf.commands()
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.stopped {
+		return false
+	}
+	var forwarded bool
+	for _, cmd := range cmds {
+		if _, ok := sf.escalating[cmd]; ok {
+			continue
+		}
+		forwarded = true
+		sf.escalating[cmd] = struct{}{}
+		sf.wg.Add(1)
+		go func(cmd Signaller) {
+			defer sf.wg.Done()
+			sf.escalate(cmd, sig)
+
+			sf.mu.Lock()
+			delete(sf.escalating, cmd)
+			sf.mu.Unlock()
+		}(cmd)
+	}
+	return forwarded
+}
+
+// escalate sends a signal to a command, followed by the steps of the
+// escalation until the command finishes.
+func (sf *signalForwarder) escalate(cmd Signaller, sig Signal) {
+	var doneC <-chan struct{}
+	if d, ok := cmd.(interface{ Done() <-chan struct{} }); ok {
+		doneC = d.Done()
+	}
+	// wait waits for the given time, returning false if the command finished
+	// or forwarding was stopped.
+	wait := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-doneC:
+			return false
+		case <-sf.stopC:
+			return false
+		}
+	}
+
+	sf.logger.Debugf("Forwarding %s to command", sig)
+	if err := cmd.Signal(sig); err != nil {
+		if err != ErrNotRunning {
+			sf.logger.Warnf("Unable to forward %s to command: %+v", sig, err)
+		}
+		return
+	}
+	for _, step := range sf.conf.Escalation {
+		if !wait(step.After) {
+			return
+		}
+		sf.logger.Debugf("Escalating to %s for command", step.Signal)
+		if err := cmd.Signal(step.Signal); err != nil {
+			if err != ErrNotRunning {
+				sf.logger.Warnf("Unable to send %s to command: %+v", step.Signal, err)
+			}
+			return
+		}
+	}
+	if !wait(sf.conf.CloseAfter) {
+		return
+	}
+	if c, ok := cmd.(io.Closer); ok {
+		sf.logger.Debugf("Closing command that did not stop")
+		if err := c.Close(); err != nil && err != ErrNotRunning {
+			sf.logger.Warnf("Unable to close command: %+v", err)
+		}
+	}
+}
+
+// stop stops forwarding signals, abandoning any escalations in progress.
+func (sf *signalForwarder) stop() {
+	sf.mu.Lock()
+	if sf.stopped {
+		sf.mu.Unlock()
+		return
+	}
+	sf.stopped = true
+	close(sf.stopC)
+	sf.mu.Unlock()
+
+	sf.wg.Wait()
+}
+
+// signalRelay handles the signals received by this process and passes them on
+// to the registered forwarders. Signals are only handled while there are
+// forwarders.
+type signalRelay struct {
+	// handlingMu serializes beginning and stopping signal handling. It is
+	// separate from mu as stopping signal handling waits for the signal that
+	// is being passed on, which needs mu.
+	handlingMu sync.Mutex
+
+	mu         sync.Mutex
+	forwarders map[*signalForwarder]struct{}
+	// unhandled is called for forwarded signals that no command was sent.
+	unhandled func(Signal) error
+}
+
+// relay is the relay for the signals of this process, which can only be
+// handled in one place.
+var relay = &signalRelay{unhandled: signal.RaiseDefault}
+
+// add registers a forwarder, beginning signal handling if it is the first.
+func (sr *signalRelay) add(logger log.Logger, sf *signalForwarder) error {
+	sr.handlingMu.Lock()
+	defer sr.handlingMu.Unlock()
+
+	sr.mu.Lock()
+	first := len(sr.forwarders) == 0
+	sr.mu.Unlock()
+	if first {
+		err := signal.BeginSignalHandling(logger, sr.handle)
+		if err != nil {
+			return errors.Wrap(err, "unable to begin handling signals")
+		}
+	}
+
+	sr.mu.Lock()
+	if sr.forwarders == nil {
+		sr.forwarders = make(map[*signalForwarder]struct{})
+	}
+	sr.forwarders[sf] = struct{}{}
+	sr.mu.Unlock()
+	return nil
+}
+
+// remove unregisters a forwarder, stopping signal handling if it was the
+// last.
+func (sr *signalRelay) remove(sf *signalForwarder) {
+	sr.handlingMu.Lock()
+	defer sr.handlingMu.Unlock()
+
+	sr.mu.Lock()
+	_, ok := sr.forwarders[sf]
+	delete(sr.forwarders, sf)
+	last := ok && len(sr.forwarders) == 0
+	sr.mu.Unlock()
+	if last {
+		signal.StopSignalHandling()
+	}
+}
+
+// handle passes a signal on to the forwarders. If it is forwarded by any of
+// them, but no command is sent it, then it is given its usual effect.
+//
+// mu is not held while the signal is passed on, so that handling signals does
+// not wait for forwarders to be added or removed.
+func (sr *signalRelay) handle(sig Signal) {
+	sr.mu.Lock()
+	forwarders := make([]*signalForwarder, 0, len(sr.forwarders))
+	for sf := range sr.forwarders {
+		forwarders = append(forwarders, sf)
+	}
+	unhandled := sr.unhandled
+	sr.mu.Unlock()
+
+	var logger log.Logger
+	var forwarded bool
+	for _, sf := range forwarders {
+		if !sf.forwards(sig) {
+			continue
+		}
+		logger = sf.logger
+		if sf.handle(sig) {
+			forwarded = true
+		}
+	}
+	if logger == nil || forwarded {
+		return
+	}
+
+	logger.Debugf("No commands to forward %s to, giving it its usual effect", sig)
+	if err := unhandled(sig); err != nil {
+		logger.Errorf("Unable to raise %s: %+v", sig, err)
+	}
+}
+
+// ForwardCommandSignals forwards the signals received by this process to a
+// single command, until the returned function is called.
+//
+// While signals are forwarded, they are handled instead of having their usual
+// effect on this process, so that the process does not exit before the remote
+// command has been stopped. Signals that are received while the command is
+// not running, or is already being stopped, have their usual effect.
+func ForwardCommandSignals(logger log.Logger, cmd CommandSignaller, conf *SignalForwarding) (stop func(), err error) {
+	if logger == nil {
+		panic("nil logger")
+	}
+
+	sf := newSignalForwarder(logger, conf, func() []Signaller { return []Signaller{cmd} })
+	if err = relay.add(logger, sf); err != nil {
+		return nil, err
+	}
+	return func() {
+		relay.remove(sf)
+		sf.stop()
+	}, nil
+}
+
+// ForwardSignals begins forwarding the signals received by this process to the
+// running commands of all of the targets of the Ex that support being
+// signalled. Signals are forwarded until StopForwardingSignals or Close is
+// called.
+//
+// While signals are forwarded, they are handled instead of having their usual
+// effect on this process, so that the process does not exit before the remote
+// commands have been stopped. Signals that are received while no commands are
+// running, or while they are all already being stopped, have their usual
+// effect.
+func (r *Ex) ForwardSignals(conf *SignalForwarding) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.signalForwarder != nil {
+		return errors.New("signals already being forwarded")
+	}
+	sf := newSignalForwarder(r.logger, conf, r.runningCommands)
+	if err := relay.add(r.logger, sf); err != nil {
+		return err
+	}
+	r.signalForwarder = sf
+	return nil
+}
+
+// StopForwardingSignals stops forwarding signals that was started with
+// ForwardSignals. Commands that are being stopped are no longer escalated.
+func (r *Ex) StopForwardingSignals() {
+	r.mu.Lock()
+	sf := r.signalForwarder
+	r.signalForwarder = nil
+	r.mu.Unlock()
+
+	if sf != nil {
+		relay.remove(sf)
+		sf.stop()
+	}
+}
+
+// runningCommands gets the running commands of the targets that can be
+// signalled.
+func (r *Ex) runningCommands() []Signaller {
+	r.nameToTargetsMu.RLock()
+	var targets []*SSHTarget
+	for _, t := range r.nameToTargets {
+		if st, ok := t.(*SSHTarget); ok {
+			targets = append(targets, st)
+		}
+	}
+	r.nameToTargetsMu.RUnlock()
+
+	var cmds []Signaller
+	for _, st := range targets {
+		for _, s := range st.Running() {
+			cmds = append(cmds, s)
+		}
+	}
+	return cmds
+}
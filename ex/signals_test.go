@@ -0,0 +1,190 @@
+package ex_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex"
+	"github.com/rwool/ex/ex/internal/signal"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSignalTarget creates an Ex with a target whose server supports the
+// commands that handle signals.
+func newSignalTarget(t *testing.T, logger log.Logger) (*ex.Ex, ex.Target, func()) {
+	dialer, hostKey, stopServer := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{})
+	closeServer := func() {
+		stopServer()
+		if v, ok := dialer.(io.Closer); ok {
+			v.Close()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e := ex.New(logger, nil, nil)
+	e.SetDialer(dialer)
+	target, err := e.NewSSHTarget(ctx, &ex.SSHTargetConfig{
+		Name:            "target",
+		Host:            "127.0.0.1",
+		Port:            22,
+		User:            "test",
+		Auths:           []ex.SSHAuthorizer{ex.NewSSHPasswordAuth("Password123")},
+		HostKeyCallback: sshtarget.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		closeServer()
+		require.NoError(t, err, "error creating target")
+	}
+	return e, target, func() {
+		e.Close()
+		closeServer()
+	}
+}
+
+// startIgnoringSignals starts a command that ignores signals, and waits for it
+// to be running by sending it SIGUSR1.
+func startIgnoringSignals(ctx context.Context, t *testing.T, target ex.Target) (ex.CommandSignaller, ex.Recorder) {
+	cmd, ok := target.Command("ignore-signals").(ex.CommandSignaller)
+	require.True(t, ok, "SSH commands must support signals")
+	rec, err := cmd.Start(ctx)
+	require.NoError(t, err, "unable to start command")
+	for {
+		err = cmd.Signal(ex.SIGUSR1)
+		if err != ex.ErrNotRunning || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err, "unable to signal command")
+	return cmd, rec
+}
+
+// replayed gets the output of a recording.
+func replayed(t *testing.T, rec ex.Recorder) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, rec.Replay(buf, buf, 0), "error replaying recording")
+	return buf.String()
+}
+
+func TestExForwardSignals(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	e, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, e.ForwardSignals(&ex.SignalForwarding{
+		Escalation: []ex.SignalEscalation{{After: 50 * time.Millisecond, Signal: ex.SIGKILL}},
+		CloseAfter: 50 * time.Millisecond,
+	}), "unable to forward signals")
+	assert.Error(t, e.ForwardSignals(nil), "signals must not be forwarded twice")
+
+	cmd1, rec1 := startIgnoringSignals(ctx, t, target)
+	cmd2, rec2 := startIgnoringSignals(ctx, t, target)
+	signal.SendSignal(signal.SIGINT)
+
+	assert.Error(t, cmd1.Wait(), "closed command must fail")
+	assert.Error(t, cmd2.Wait(), "closed command must fail")
+	for _, rec := range []ex.Recorder{rec1, rec2} {
+		assert.Equal(t, "received SIGUSR1\nreceived SIGINT\nreceived SIGKILL\n", replayed(t, rec),
+			"unexpected signals received")
+	}
+
+	e.StopForwardingSignals()
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestForwardCommandSignals(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	_, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd, rec := startIgnoringSignals(ctx, t, target)
+	stop, err := ex.ForwardCommandSignals(logger, cmd, &ex.SignalForwarding{
+		Signals:    []ex.Signal{ex.SIGHUP},
+		Escalation: []ex.SignalEscalation{},
+		CloseAfter: 50 * time.Millisecond,
+	})
+	require.NoError(t, err, "unable to forward signals")
+	defer stop()
+
+	// Signals are handled in order, so SIGINT would have been received first if
+	// it had been forwarded.
+	signal.SendSignal(signal.SIGINT)
+	signal.SendSignal(signal.SIGHUP)
+
+	assert.Error(t, cmd.Wait(), "closed command must fail")
+	assert.Equal(t, "received SIGUSR1\nreceived SIGHUP\n", replayed(t, rec), "unexpected signals received")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
+
+func TestExForwardSignalsUnhandled(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	e, target, closeTarget := newSignalTarget(t, logger)
+	defer closeTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	unhandledC := make(chan ex.Signal, 1)
+	defer ex.SetUnhandledSignalFunc(func(sig ex.Signal) error {
+		unhandledC <- sig
+		return nil
+	})()
+	require.NoError(t, e.ForwardSignals(&ex.SignalForwarding{
+		Escalation: []ex.SignalEscalation{{After: time.Minute, Signal: ex.SIGKILL}},
+	}), "unable to forward signals")
+	defer e.StopForwardingSignals()
+
+	// Without running commands, the signal must have its usual effect.
+	signal.SendSignal(signal.SIGTERM)
+	select {
+	case sig := <-unhandledC:
+		assert.Equal(t, ex.SIGTERM, sig, "unexpected unhandled signal")
+	case <-ctx.Done():
+		require.Fail(t, "signal without running commands must not be dropped")
+	}
+
+	// A repeated signal for a command that is being stopped must also have
+	// its usual effect.
+	cmd, rec := startIgnoringSignals(ctx, t, target)
+	signal.SendSignal(signal.SIGINT)
+	signal.SendSignal(signal.SIGINT)
+	select {
+	case sig := <-unhandledC:
+		assert.Equal(t, ex.SIGINT, sig, "unexpected unhandled signal")
+	case <-ctx.Done():
+		require.Fail(t, "repeated signal must not be dropped")
+	}
+	for !strings.Contains(replayed(t, rec), "SIGINT") && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "received SIGUSR1\nreceived SIGINT\n", replayed(t, rec), "signal must be forwarded once")
+
+	e.StopForwardingSignals()
+	c, ok := cmd.(io.Closer)
+	require.True(t, ok, "SSH commands must be closable")
+	require.NoError(t, c.Close(), "unable to stop command")
+	assert.Error(t, cmd.Wait(), "closed command must fail")
+	assert.Empty(t, logBuf.String(), "unexpected log output")
+}
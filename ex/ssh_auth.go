@@ -1,6 +1,14 @@
 package ex
 
-import "github.com/rwool/ex/ex/internal/sshtarget"
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
 
 // SSHAuthorizer is an SSH authorization method.
 type SSHAuthorizer interface {
@@ -33,3 +41,126 @@ func adaptAuth(auth sshtarget.Authorizer) sshAuthorizer {
 func NewSSHPasswordAuth(password string) SSHAuthorizer {
 	return adaptAuth(sshtarget.NewPasswordAuth(password))
 }
+
+// NewSSHPublicKeyAuth creates a new public key authorizer for SSH targets that
+// uses the given signers.
+func NewSSHPublicKeyAuth(signers ...ssh.Signer) SSHAuthorizer {
+	return adaptAuth(sshtarget.NewPublicKeyAuth(signers...))
+}
+
+// NewSSHPrivateKeyAuth creates a new public key authorizer for SSH targets
+// from a PEM or OpenSSH encoded private key.
+//
+// The passphrase may be nil if the private key is not encrypted.
+func NewSSHPrivateKeyAuth(pemBytes, passphrase []byte) (SSHAuthorizer, error) {
+	auth, err := sshtarget.NewPrivateKeyAuth(pemBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return adaptAuth(auth), nil
+}
+
+// NewSSHPrivateKeyFileAuth creates a new public key authorizer for SSH targets
+// from the private key file at the given path.
+//
+// The passphrase may be nil if the private key is not encrypted.
+func NewSSHPrivateKeyFileAuth(path string, passphrase []byte) (SSHAuthorizer, error) {
+	auth, err := sshtarget.NewPrivateKeyFileAuth(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return adaptAuth(auth), nil
+}
+
+// NewSSHDefaultKeysAuth creates a new public key authorizer for SSH targets
+// from the unencrypted private keys found in ~/.ssh (id_rsa, id_ecdsa,
+// id_ed25519 and id_dsa, in that order).
+func NewSSHDefaultKeysAuth() (SSHAuthorizer, error) {
+	auth, err := sshtarget.NewDefaultKeysAuth()
+	if err != nil {
+		return nil, err
+	}
+	return adaptAuth(auth), nil
+}
+
+// NewSSHCertificateAuth creates a new authorizer for SSH targets that
+// authenticates with an OpenSSH user certificate and its private key.
+func NewSSHCertificateAuth(signer ssh.Signer, cert *ssh.Certificate) (SSHAuthorizer, error) {
+	auth, err := sshtarget.NewCertificateAuth(signer, cert)
+	if err != nil {
+		return nil, err
+	}
+	return adaptAuth(auth), nil
+}
+
+// NewSSHCertificateFileAuth creates a new authorizer for SSH targets that
+// authenticates with the OpenSSH user certificate at certPath and the private
+// key at keyPath.
+//
+// If certPath is empty, then keyPath with "-cert.pub" appended is used. The
+// passphrase may be nil if the private key is not encrypted.
+func NewSSHCertificateFileAuth(keyPath, certPath string, passphrase []byte) (SSHAuthorizer, error) {
+	auth, err := sshtarget.NewCertificateFileAuth(keyPath, certPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return adaptAuth(auth), nil
+}
+
+// SSHAgent is an SSH agent that holds keys that can be used for
+// authentication.
+type SSHAgent = agent.Agent
+
+// NewSSHAgentClient creates an agent that communicates with a running SSH agent
+// over the given connection.
+func NewSSHAgentClient(conn io.ReadWriter) SSHAgent {
+	return agent.NewClient(conn)
+}
+
+// DialSSHAgent connects to the SSH agent listening on the socket given by
+// SSH_AUTH_SOCK.
+//
+// The returned connection should be closed when the agent is no longer needed.
+func DialSSHAgent() (net.Conn, error) {
+	return sshtarget.DialAgent("")
+}
+
+// NewSSHAgentAuth creates a new authorizer for SSH targets that uses the keys
+// held by the SSH agent on the other end of the given connection.
+func NewSSHAgentAuth(conn io.ReadWriter) SSHAuthorizer {
+	return adaptAuth(sshtarget.NewAgentAuth(agent.NewClient(conn)))
+}
+
+// SSHKeyboardInteractiveResponder answers the questions asked by an SSH server
+// during keyboard-interactive authentication.
+type SSHKeyboardInteractiveResponder = sshtarget.KeyboardInteractiveResponder
+
+// NewSSHKeyboardInteractiveAuth creates a new keyboard-interactive authorizer
+// for SSH targets.
+//
+// If the responder is nil, then the questions are asked on stderr and answered
+// from stdin.
+func NewSSHKeyboardInteractiveAuth(responder SSHKeyboardInteractiveResponder) SSHAuthorizer {
+	if responder == nil {
+		responder = sshtarget.NewTerminalResponder(os.Stdin, os.Stderr)
+	}
+	return adaptAuth(sshtarget.NewKeyboardInteractiveAuth(responder))
+}
+
+// NewSSHTerminalResponder creates a responder that writes the questions to out
+// and reads the answers from in, one per line.
+//
+// Answers that should not be echoed are read with echoing disabled if in is a
+// terminal.
+func NewSSHTerminalResponder(in io.Reader, out io.Writer) SSHKeyboardInteractiveResponder {
+	return sshtarget.NewTerminalResponder(in, out)
+}
+
+// NewSSHStaticResponder creates a responder that answers the questions with the
+// answers in the given map, keyed by question.
+//
+// Surrounding whitespace is removed from the questions before looking them
+// up. This is useful for answering challenges from scripts.
+func NewSSHStaticResponder(answers map[string]string) SSHKeyboardInteractiveResponder {
+	return sshtarget.NewStaticResponder(answers)
+}
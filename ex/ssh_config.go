@@ -0,0 +1,275 @@
+package ex
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rwool/ex/ex/internal/sshconfig"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"golang.org/x/crypto/ssh"
+)
+
+const globalSSHConfig = "/etc/ssh/ssh_config"
+
+// defaultSSHConfigPaths returns the paths of the user and system ssh_config
+// files that exist.
+func defaultSSHConfigPaths() ([]string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get user for ssh_config file")
+	}
+
+	var paths []string
+	for _, p := range []string{filepath.Join(u.HomeDir, ".ssh", "config"), globalSSHConfig} {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// LoadSSHConfig creates the configuration for an SSH target by resolving the
+// given host alias through the ssh_config(5) files at the given paths, which
+// are applied in order.
+//
+// If no paths are given, ~/.ssh/config and /etc/ssh/ssh_config are used, if
+// they exist.
+//
+// The Host, Match, Include, HostName, Port, User, IdentityFile,
+// CertificateFile, UserKnownHostsFile, GlobalKnownHostsFile,
+// StrictHostKeyChecking, HashKnownHosts and ProxyJump options are used. Jump
+// hosts are resolved through the same files.
+// StrictHostKeyChecking values of "yes" and "ask" both cause unknown hosts to
+// be rejected, so that IsUnknownHost may be used to handle them.
+//
+// Unencrypted keys from the identity files are used for authentication.
+// Keys held by an SSH agent are not, so an authorizer from NewSSHAgentAuth may
+// need to be added to the Auths of the returned configuration.
+func LoadSSHConfig(alias string, paths ...string) (*SSHTargetConfig, error) {
+	if len(paths) == 0 {
+		var err error
+		paths, err = defaultSSHConfigPaths()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	configs := make([]*sshconfig.Config, len(paths))
+	for i, p := range paths {
+		c, err := sshconfig.Load(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load ssh_config")
+		}
+		configs[i] = c
+	}
+
+	return loadSSHConfig(alias, configs, 0)
+}
+
+// maxJumpDepth is the maximum number of jump hosts that may be chained
+// through the ProxyJump options of the jump hosts themselves.
+const maxJumpDepth = 16
+
+// loadSSHConfig creates the configuration for the given host alias, where
+// depth is the number of jump hosts that have been resolved to reach it.
+func loadSSHConfig(alias string, configs []*sshconfig.Config, depth int) (*SSHTargetConfig, error) {
+	host, err := sshconfig.Resolve(alias, configs...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve %s", alias)
+	}
+
+	conf, err := sshTargetConfigFromHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.JumpHosts, err = sshConfigJumpHosts(host, configs, depth)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// sshConfigJumpHosts creates the jump hosts for the ProxyJump option of a host.
+//
+// Each jump host is resolved through the same configuration files, so it has
+// its own authorizers and host key callback. If a jump host has a ProxyJump
+// option itself, its jump hosts come before it.
+func sshConfigJumpHosts(host *sshconfig.Host, configs []*sshconfig.Config, depth int) ([]SSHJumpHost, error) {
+	pj := host.Get("proxyjump")
+	if pj == "" || pj == "none" {
+		return nil, nil
+	}
+
+	var hops []SSHJumpHost
+	for _, spec := range strings.Split(pj, ",") {
+		if depth+1 > maxJumpDepth {
+			return nil, errors.New("too many nested ProxyJump hosts")
+		}
+
+		user, alias, port, err := parseJumpSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		hop, err := loadSSHConfig(alias, configs, depth+1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to configure jump host %s", alias)
+		}
+		if len(hop.Auths) == 0 {
+			return nil, errors.Errorf("no identity files found for jump host %s", alias)
+		}
+		if user != "" {
+			hop.User = user
+		}
+		if port != 0 {
+			hop.Port = port
+		}
+
+		hops = append(hops, hop.JumpHosts...)
+		hops = append(hops, SSHJumpHost{
+			Host:            hop.Host,
+			Port:            hop.Port,
+			User:            hop.User,
+			Auths:           hop.Auths,
+			HostKeyCallback: hop.HostKeyCallback,
+		})
+	}
+	return hops, nil
+}
+
+// parseJumpSpec parses a jump host of the form [user@]host[:port], which may
+// also be given as a URI of the form ssh://[user@]host[:port].
+//
+// The port is 0 if it is not given.
+func parseJumpSpec(spec string) (user, host string, port uint16, err error) {
+	s := strings.TrimPrefix(spec, "ssh://")
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		user, s = s[:i], s[i+1:]
+	}
+
+	host = s
+	if h, p, splitErr := net.SplitHostPort(s); splitErr == nil {
+		n, parseErr := strconv.ParseUint(p, 10, 16)
+		if parseErr != nil {
+			return "", "", 0, errors.Errorf("invalid port in ProxyJump host %q", spec)
+		}
+		host, port = h, uint16(n)
+	}
+	if host == "" {
+		return "", "", 0, errors.Errorf("invalid ProxyJump host %q", spec)
+	}
+	return user, host, port, nil
+}
+
+// sshTargetConfigFromHost creates a target configuration from the resolved
+// configuration of a host, apart from its jump hosts.
+func sshTargetConfigFromHost(host *sshconfig.Host) (*SSHTargetConfig, error) {
+	if pc := host.Get("proxycommand"); pc != "" && pc != "none" {
+		return nil, errors.New("ProxyCommand is not supported")
+	}
+
+	port, err := host.Port()
+	if err != nil {
+		return nil, err
+	}
+
+	auths, err := sshConfigAuths(host)
+	if err != nil {
+		return nil, err
+	}
+
+	hkc, err := sshConfigHostKeyCallback(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHTargetConfig{
+		Name:            host.Alias,
+		Host:            host.Hostname(),
+		Port:            port,
+		User:            host.User(),
+		Auths:           auths,
+		HostKeyCallback: hkc,
+	}, nil
+}
+
+// sshConfigAuths loads the identity files of a host.
+func sshConfigAuths(host *sshconfig.Host) ([]SSHAuthorizer, error) {
+	keyPaths := host.ExpandPaths(host.GetAll("identityfile"))
+	if len(keyPaths) == 0 {
+		keyPaths = sshtarget.DefaultIdentityFiles(host.ExpandPath("~/.ssh"))
+	}
+	certPaths := host.ExpandPaths(host.GetAll("certificatefile"))
+
+	signers, err := sshtarget.LoadIdentityFiles(keyPaths, certPaths)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load identity files")
+	}
+	if len(signers) == 0 {
+		return nil, nil
+	}
+	return []SSHAuthorizer{NewSSHPublicKeyAuth(signers...)}, nil
+}
+
+// sshConfigHostKeyCallback creates the host key callback for a host.
+func sshConfigHostKeyCallback(host *sshconfig.Host) (SSHHostKeyCallback, error) {
+	userFiles := host.Args("userknownhostsfile")
+	if userFiles == nil {
+		userFiles = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+	globalFiles := host.Args("globalknownhostsfile")
+	if globalFiles == nil {
+		globalFiles = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+	}
+	userFiles = knownHostsFiles(host.ExpandPaths(userFiles))
+	globalFiles = knownHostsFiles(host.ExpandPaths(globalFiles))
+
+	var existing []string
+	for _, p := range append(append([]string(nil), userFiles...), globalFiles...) {
+		if _, err := os.Stat(p); err == nil {
+			existing = append(existing, p)
+		}
+	}
+
+	switch strings.ToLower(host.Get("stricthostkeychecking")) {
+	case "no", "off":
+		return SSHInsecureIgnoreHostKey(), nil
+	case "accept-new":
+		if len(userFiles) == 0 {
+			return nil, errors.New("StrictHostKeyChecking accept-new requires a UserKnownHostsFile")
+		}
+		known, err := KnownHostsFilesCallback(existing...)
+		if err != nil {
+			return nil, err
+		}
+		disableHashing := strings.ToLower(host.Get("hashknownhosts")) != "yes"
+		tofu := SSHTrustOnFirstUseHostKey(userFiles[0], SSHAcceptNewHostKeys, disableHashing)
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := known(hostname, remote, key)
+			if IsUnknownHost(err) {
+				return tofu(hostname, remote, key)
+			}
+			return err
+		}, nil
+	case "", "yes", "ask":
+		return KnownHostsFilesCallback(existing...)
+	default:
+		return nil, errors.Errorf("invalid StrictHostKeyChecking value %q", host.Get("stricthostkeychecking"))
+	}
+}
+
+// knownHostsFiles removes the "none" entries from known_hosts file paths.
+func knownHostsFiles(paths []string) []string {
+	var files []string
+	for _, p := range paths {
+		if p != "none" {
+			files = append(files, p)
+		}
+	}
+	return files
+}
@@ -0,0 +1,200 @@
+package ex_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwool/ex/ex"
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"github.com/rwool/ex/log"
+	"github.com/rwool/ex/test/helpers/goroutinechecker"
+	"github.com/rwool/ex/test/helpers/testlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeIdentity writes a new private key to the given path, returning its
+// public key.
+func writeIdentity(t *testing.T, path string) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "unable to generate key")
+	der, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err, "unable to marshal key")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600),
+		"unable to write key")
+	pub, err := ssh.NewPublicKey(priv.Public())
+	require.NoError(t, err, "unable to create public key")
+	return pub
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	defer goroutinechecker.New(t)()
+
+	dir, err := ioutil.TempDir("", "ssh_config")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	logger, logBuf := testlogger.NewTestLogger(t, log.Warn)
+	identity := filepath.Join(dir, "id_ecdsa")
+	pub := writeIdentity(t, identity)
+	dialer, hostKey, stopServer := sshtarget.NewSSHServerWithConfig(logger, &sshtarget.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != "test" || !bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	})
+	defer func() {
+		stopServer()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	if v, ok := dialer.(io.Closer); ok {
+		defer v.Close()
+	}
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	f, err := os.Create(knownHosts)
+	require.NoError(t, err, "unable to create known_hosts file")
+	require.NoError(t, ex.AddToKnownHosts(f, []string{"127.0.0.1:22"}, hostKey, false, ex.MarkerNone))
+	require.NoError(t, f.Close())
+
+	config := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(config, []byte(strings.Join([]string{
+		"Host server",
+		"\tHostName 127.0.0.1",
+		"\tUser test",
+		"\tIdentityFile " + identity,
+		"Host unknown",
+		"\tHostName 127.0.0.1",
+		"\tUser test",
+		"\tIdentityFile " + identity,
+		"\tUserKnownHostsFile none",
+		"Host *",
+		"\tUserKnownHostsFile " + knownHosts,
+		"\tGlobalKnownHostsFile none",
+	}, "\n")), 0600))
+
+	conf, err := ex.LoadSSHConfig("server", config)
+	require.NoError(t, err, "unable to load ssh_config")
+	assert.Equal(t, "server", conf.Name, "unexpected name")
+	assert.Equal(t, "127.0.0.1", conf.Host, "unexpected host")
+	assert.EqualValues(t, 22, conf.Port, "unexpected port")
+	assert.Equal(t, "test", conf.User, "unexpected user")
+
+	e := ex.New(logger, nil, nil)
+	e.SetDialer(dialer)
+	defer func() {
+		require.NoError(t, e.Close(), "error closing Ex")
+		assert.Empty(t, logBuf.String(), "unexpected log output")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	target, err := e.NewSSHTarget(ctx, conf)
+	require.NoError(t, err, "error creating target")
+	rec, err := target.Command("whoami").Run(ctx)
+	require.NoError(t, err, "error running whoami")
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, rec.Replay(&stdout, &stderr, 0), "error replaying recording")
+	assert.Equal(t, "test\n", stdout.String(), "unexpected stdout output")
+
+	// Without a known_hosts file, the host is unknown.
+	conf, err = ex.LoadSSHConfig("unknown", config)
+	require.NoError(t, err, "unable to load ssh_config")
+	_, err = e.NewSSHTarget(ctx, conf)
+	assert.True(t, ex.IsUnknownHost(err), "host must be unknown: %+v", err)
+}
+
+func TestLoadSSHConfigUnsupported(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh_config")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(config, []byte(strings.Join([]string{
+		"Host proxied",
+		"\tProxyCommand nc %h %p",
+		"Host *",
+		"\tIdentityFile " + filepath.Join(dir, "missing"),
+		"\tUserKnownHostsFile none",
+		"\tGlobalKnownHostsFile none",
+		"\tStrictHostKeyChecking maybe",
+	}, "\n")), 0600))
+
+	_, err = ex.LoadSSHConfig("proxied", config)
+	assert.Error(t, err, "ProxyCommand must not be ignored")
+	_, err = ex.LoadSSHConfig("other", config)
+	assert.Error(t, err, "invalid StrictHostKeyChecking value must be rejected")
+}
+
+func TestLoadSSHConfigProxyJump(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh_config")
+	require.NoError(t, err, "unable to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	identity := filepath.Join(dir, "id_ecdsa")
+	writeIdentity(t, identity)
+	config := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(config, []byte(strings.Join([]string{
+		"Host db",
+		"\tHostName 10.0.0.5",
+		"\tProxyJump alice@bastion2:2200",
+		"Host bastion2",
+		"\tHostName bastion2.internal",
+		"\tProxyJump ssh://bastion1",
+		"Host bastion1",
+		"\tHostName bastion1.example.com",
+		"\tUser bob",
+		"Host direct",
+		"\tProxyJump none",
+		"Host loop",
+		"\tProxyJump loop",
+		"Host *",
+		"\tUser test",
+		"\tIdentityFile " + identity,
+		"\tUserKnownHostsFile none",
+		"\tGlobalKnownHostsFile none",
+	}, "\n")), 0600))
+
+	conf, err := ex.LoadSSHConfig("db", config)
+	require.NoError(t, err, "unable to load ssh_config")
+	assert.Equal(t, "10.0.0.5", conf.Host, "unexpected host")
+	require.Len(t, conf.JumpHosts, 2, "jump hosts of jump hosts must be included")
+
+	first, second := conf.JumpHosts[0], conf.JumpHosts[1]
+	assert.Equal(t, "bastion1.example.com", first.Host, "unexpected first jump host")
+	assert.EqualValues(t, 22, first.Port, "unexpected first jump host port")
+	assert.Equal(t, "bob", first.User, "unexpected first jump host user")
+	assert.Equal(t, "bastion2.internal", second.Host, "unexpected second jump host")
+	assert.EqualValues(t, 2200, second.Port, "unexpected second jump host port")
+	assert.Equal(t, "alice", second.User, "unexpected second jump host user")
+	for _, hop := range conf.JumpHosts {
+		assert.NotEmpty(t, hop.Auths, "jump host must have authorizers")
+		assert.NotNil(t, hop.HostKeyCallback, "jump host must have a host key callback")
+	}
+
+	conf, err = ex.LoadSSHConfig("direct", config)
+	require.NoError(t, err, "unable to load ssh_config")
+	assert.Empty(t, conf.JumpHosts, "ProxyJump none must not add jump hosts")
+
+	_, err = ex.LoadSSHConfig("loop", config)
+	assert.Error(t, err, "ProxyJump loop must be rejected")
+}
@@ -1,6 +1,9 @@
 package ex
 
-import "github.com/rwool/ex/ex/internal/sshtarget"
+import (
+	"github.com/rwool/ex/ex/internal/sshtarget"
+	"golang.org/x/crypto/ssh"
+)
 
 // SSHHostKeyCallback is a function for validating a host's SSH key.
 type SSHHostKeyCallback = sshtarget.HostKeyCallback
@@ -12,3 +15,14 @@ var SSHFixedHostKey = sshtarget.FixedHostKey
 // SSHInsecureIgnoreHostKey is a function for skipping verification of a
 // host's key.
 var SSHInsecureIgnoreHostKey = sshtarget.InsecureIgnoreHostKey
+
+// SSHCertAuthorityHostKey creates a function for verifying that a host's key is
+// a certificate signed by one of the given certificate authorities.
+//
+// The authorities are only trusted for hosts matching the given known_hosts
+// style patterns. Certificates must be valid at the time of connection and
+// must list the host as a principal. Host keys that are not certificates are
+// verified with the fallback, or rejected if the fallback is nil.
+func SSHCertAuthorityHostKey(caKeys []ssh.PublicKey, hostPatterns []string, fallback SSHHostKeyCallback) SSHHostKeyCallback {
+	return sshtarget.CertAuthorityCallback(caKeys, hostPatterns, fallback)
+}
@@ -2,21 +2,38 @@ package ex
 
 import (
 	"io"
+	"net"
 
 	"github.com/rwool/ex/ex/internal/sshtarget"
 	"golang.org/x/crypto/ssh"
 )
 
 // KnownHostsMarker represents the usage of a marker in a known_hosts file.
-type KnownHostsMarker uint8
+type KnownHostsMarker = sshtarget.KnownHostsMarker
 
 // Markers available to use with lines in the known_hosts file(s).
 const (
-	MarkerNone KnownHostsMarker = iota
-	MarkerCertAuthority
-	MarkerRevoked
+	MarkerNone          = sshtarget.MarkerNone
+	MarkerCertAuthority = sshtarget.MarkerCertAuthority
+	MarkerRevoked       = sshtarget.MarkerRevoked
 )
 
+// KnownHostsEntry is a host key line of a known_hosts file.
+type KnownHostsEntry = sshtarget.KnownHostsEntry
+
+// KnownHostsFile is a parsed known_hosts file that may be modified and saved.
+//
+// Comments, blank lines, and lines that cannot be parsed are preserved as they
+// are. Saving the file replaces it atomically.
+type KnownHostsFile = sshtarget.KnownHostsFile
+
+// LoadKnownHostsFile reads the known_hosts file at the given path.
+//
+// A missing file is treated as being empty, and is created when saved.
+func LoadKnownHostsFile(path string) (*KnownHostsFile, error) {
+	return sshtarget.LoadKnownHostsFile(path)
+}
+
 // AddToKnownHosts adds hosts to the given known_hosts file.
 //
 // Disabling hashing has the effect of not hashing the hostnames provided to
@@ -30,7 +47,7 @@ const (
 // Note that if the Want field of the KeyError is not empty, then that may be an
 // indication of a MITM attack.
 func AddToKnownHosts(f io.WriteSeeker, hosts []string, pubKey ssh.PublicKey, disableHashing bool, marker KnownHostsMarker) error {
-	return sshtarget.AddToKnownHosts(f, hosts, pubKey, disableHashing, sshtarget.KnownHostsMarker(marker))
+	return sshtarget.AddToKnownHosts(f, hosts, pubKey, disableHashing, marker)
 }
 
 // DefaultKnownHosts returns the standard known_hosts file paths
@@ -42,6 +59,11 @@ func DefaultKnownHosts() ([]string, error) {
 // KnownHostsFilesCallback creates a host key callback using the hosts
 // specified in the given known_hosts files.
 //
+// Lines marked with "@cert-authority" are honoured, so a host presenting a
+// host certificate signed by one of those authorities is accepted, as long as
+// the certificate is currently valid and lists the host as a principal.
+// Keys on lines marked with "@revoked" are always rejected.
+//
 // To support adding host keys dynamically, the returned HostKeyCallback may
 // be wrapped in a function to support handling the returned errors from the
 // callback.
@@ -49,7 +71,38 @@ func KnownHostsFilesCallback(knownHostsPaths ...string) (ssh.HostKeyCallback, er
 	return sshtarget.KnownHostsFilesCallback(knownHostsPaths...)
 }
 
+// SSHHostKeyDecider decides whether the key of a host that is not in the
+// known_hosts file should be trusted.
+type SSHHostKeyDecider = sshtarget.HostKeyDecider
+
+// SSHAcceptNewHostKeys is an SSHHostKeyDecider that trusts the keys of all new
+// hosts, like the "accept-new" setting of the StrictHostKeyChecking option of
+// ssh(1).
+func SSHAcceptNewHostKeys(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	return sshtarget.AcceptNewHostKeys(hostname, remote, key)
+}
+
+// SSHTrustOnFirstUseHostKey creates a host key callback that verifies host keys
+// against the known_hosts file at the given path, adding the keys of unknown
+// hosts that the decider accepts.
+//
+// The file is created if it does not exist. The callback is safe to use with
+// many targets at once, including through separate callbacks for the same
+// file.
+func SSHTrustOnFirstUseHostKey(path string, decide SSHHostKeyDecider, disableHashing bool) SSHHostKeyCallback {
+	return sshtarget.TrustOnFirstUseCallback(path, decide, disableHashing)
+}
+
+// SSHHostKeyError indicates that the host key presented by an SSH server was
+// rejected by the host key callback.
+//
+// Errors from NewSSHTarget for rejected host keys have a *SSHHostKeyError as
+// their cause.
+type SSHHostKeyError = sshtarget.HostKeyError
+
 // IsUnknownHost indicates if the given error was due to an unknown host.
+//
+// Errors returned from NewSSHTarget are supported.
 func IsUnknownHost(e error) bool {
 	return sshtarget.IsUnknownHost(e)
 }